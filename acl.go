@@ -0,0 +1,160 @@
+package mpdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"strings"
+)
+
+// Rights is a set of permissions a node has on a collection
+type Rights uint8
+
+const (
+	RightRead Rights = 1 << iota
+	RightWrite
+	// admin rights allow a node to change the ACL and versioning of a
+	// collection, and imply read and write rights
+	RightAdmin
+
+	RightAll = RightRead | RightWrite | RightAdmin
+)
+
+// The ACL stored under this name applies to all collections that do not have
+// their own ACL
+const DefaultACL = "*"
+
+// holds the ACL of each collection, keyed by collection name
+var aclBucket = []byte(".acl")
+
+// An ACLEntry grants Rights to all nodes with ids between First and Last,
+// inclusive. A node's rights on a collection are the union of the rights of
+// all entries in the ACL that contain its nodeid
+type ACLEntry struct {
+	First  uint64
+	Last   uint64
+	Rights Rights
+}
+
+// Returns the rights as a string of letters, e.g. "rw" for read and write
+func (r Rights) String() string {
+	var s string
+	if r&RightRead != 0 {
+		s += "r"
+	}
+	if r&RightWrite != 0 {
+		s += "w"
+	}
+	if r&RightAdmin != 0 {
+		s += "a"
+	}
+	return s
+}
+
+// ParseRights is the inverse of Rights.String
+func ParseRights(s string) (Rights, error) {
+	var r Rights
+	for _, c := range s {
+		switch c {
+		case 'r':
+			r |= RightRead
+		case 'w':
+			r |= RightWrite
+		case 'a':
+			r |= RightAdmin
+		default:
+			return 0, fmt.Errorf("Unknown right %q in %q", c, s)
+		}
+	}
+	return r, nil
+}
+
+// SetACL replaces the ACL of [collection] with [entries]. An empty list of
+// entries removes the ACL, so that the collection falls back to the default
+// ACL. If neither exist, all nodes have all rights on the collection
+func (db *DB) SetACL(collection string, entries []ACLEntry) error {
+	if collection == "" || isSystemBucket(collection) || strings.Contains(collection, ".") {
+		return fmt.Errorf("Invalid collection name %s", collection)
+	}
+	for _, entry := range entries {
+		if entry.First > entry.Last {
+			return fmt.Errorf("Invalid nodeid range %v-%v", entry.First, entry.Last)
+		}
+	}
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(aclBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create ACL bucket (%s)", err)
+		}
+		if len(entries) == 0 {
+			return b.Delete([]byte(collection))
+		}
+		var buf = new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(entries); err != nil {
+			return err
+		}
+		return b.Put([]byte(collection), buf.Bytes())
+	})
+	return err
+}
+
+// GetACL returns the ACL of [collection], which is empty if the collection
+// does not have one
+func (db *DB) GetACL(collection string) ([]ACLEntry, error) {
+	var entries []ACLEntry
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entries, _, err = db.getACL(tx, collection)
+		return err
+	})
+	return entries, err
+}
+
+// Rights returns the rights [nodeid] has on [collection], using the default
+// ACL if the collection does not have its own
+func (db *DB) Rights(collection string, nodeid uint64) (Rights, error) {
+	var rights Rights
+	err := db.db.View(func(tx *bolt.Tx) error {
+		entries, found, err := db.getACL(tx, collection)
+		if err != nil {
+			return err
+		}
+		if !found {
+			if entries, found, err = db.getACL(tx, DefaultACL); err != nil {
+				return err
+			}
+		}
+		if !found {
+			rights = RightAll
+			return nil
+		}
+		for _, entry := range entries {
+			if entry.First <= nodeid && nodeid <= entry.Last {
+				rights |= entry.Rights
+			}
+		}
+		if rights&RightAdmin != 0 {
+			rights = RightAll
+		}
+		return nil
+	})
+	return rights, err
+}
+
+// returns the ACL for the given collection, if it has one
+func (db *DB) getACL(tx *bolt.Tx, collection string) ([]ACLEntry, bool, error) {
+	var entries []ACLEntry
+	b := tx.Bucket(aclBucket)
+	if b == nil {
+		return entries, false, nil
+	}
+	v := b.Get([]byte(collection))
+	if v == nil {
+		return entries, false, nil
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&entries); err != nil {
+		return entries, false, fmt.Errorf("Could not decode ACL for collection %s (%s)", collection, err)
+	}
+	return entries, true, nil
+}
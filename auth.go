@@ -0,0 +1,469 @@
+package mpdb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math"
+)
+
+// Authenticated datagrams are wrapped in an envelope:
+//
+//	0xc1 | mode (1 byte) | epoch (4 bytes, big-endian) | msgpack payload | MAC (8 bytes)
+//
+// 0xc1 is never used by msgpack, so the server can tell enveloped datagrams
+// apart from plain msgpack ones. The MAC is the truncated HMAC-SHA256 of
+// everything before it, keyed with the pre-shared key of the node. The epoch
+// is a session counter the node increments every time it starts over with echo
+// tag 1. Together with the echo tag inside the payload, it forms the
+// anti-replay counter: the server only accepts datagrams from the current
+// epoch of a node, and starting a new session requires a strictly greater
+// epoch than the last one the server has seen
+//
+// Encrypted datagrams use AES-128-GCM with a 12-byte tag instead of a MAC:
+//
+//	0xc1 | mode (1 byte) | epoch (4 bytes) | counter (4 bytes) | ciphertext | tag (12 bytes)
+//
+// The counter is sent in the clear because it is part of the nonce:
+//
+//	direction (1 byte) | 3 zero bytes | epoch (4 bytes) | counter (4 bytes)
+//
+// where direction is 0 for requests and 1 for responses, so that a request and
+// a response never share a nonce. The counter of a request is its echo tag,
+// and that of a response is a sequence number the server increments for every
+// encrypted datagram of the session. The header is authenticated as additional
+// data. The encryption key is derived from the pre-shared key of the node
+const (
+	envelopeMarker   = 0xc1
+	envelopeAuth     = 0x01
+	envelopeEncrypt  = 0x02
+	envelopeHeader   = 6
+	macLength        = 8
+	encryptedHeader  = 10
+	tagLength        = 12
+	minimumKeyLength = 16
+)
+
+// nonce directions
+const (
+	toServer   = 0
+	fromServer = 1
+)
+
+// A KeyPolicy determines which envelopes MPDB accepts from a node with a key
+type KeyPolicy uint8
+
+const (
+	// accept authenticated or encrypted requests
+	PolicyAuthenticate KeyPolicy = iota
+	// only accept encrypted requests
+	PolicyEncrypt
+)
+
+// holds the pre-shared key of each protected node, keyed by nodeid
+var keysBucket = []byte(".keys")
+
+// returned for authenticated datagrams from an epoch older than the current
+// session of a node
+var errStaleEpoch = errors.New("Stale epoch")
+
+// on-disk representation of a node's pre-shared key
+type nodeKey struct {
+	Key    []byte
+	Policy KeyPolicy
+	// the last epoch the server accepted from this node
+	Epoch uint32
+}
+
+// SetNodeKey provisions the pre-shared key for [nodeid]. Once a node has a
+// key, MPDB rejects every request from it that is not authenticated with that
+// key, or not encrypted with it if [policy] is PolicyEncrypt. A nil key
+// removes the key, so that the node can send plain requests
+func (db *DB) SetNodeKey(nodeid uint64, key []byte, policy KeyPolicy) error {
+	if key != nil && len(key) < minimumKeyLength {
+		return fmt.Errorf("Key for node %v must be at least %v bytes", nodeid, minimumKeyLength)
+	}
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(keysBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create keys bucket (%s)", err)
+		}
+		if key == nil {
+			return b.Delete(itob(nodeid))
+		}
+		return putNodeKey(b, nodeid, key, policy)
+	})
+	return err
+}
+
+// stores the key of [nodeid] in the keys bucket [b]. If the node keeps the
+// same key, its last epoch is kept as well, so that datagrams from earlier
+// sessions cannot be replayed
+func putNodeKey(b *bolt.Bucket, nodeid uint64, key []byte, policy KeyPolicy) error {
+	nk := nodeKey{Key: key, Policy: policy}
+	if v := b.Get(itob(nodeid)); v != nil {
+		var old nodeKey
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&old); err != nil {
+			return fmt.Errorf("Could not decode key for node %v (%s)", nodeid, err)
+		}
+		if bytes.Equal(old.Key, key) {
+			nk.Epoch = old.Epoch
+		}
+	}
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(nk); err != nil {
+		return err
+	}
+	return b.Put(itob(nodeid), buf.Bytes())
+}
+
+// NodeCredentials are the pre-shared key (see SetNodeKey) and HTTP tokens (see
+// AddNodeToken) of a node. A nil Key leaves the node without a key
+type NodeCredentials struct {
+	Key    []byte
+	Policy KeyPolicy
+	Tokens []string
+}
+
+// SetCredentials replaces the keys and tokens of all nodes with [creds], keyed
+// by nodeid, in a single transaction: nodes missing from [creds] lose their key
+// and tokens. This is how the mpdb command applies the credentials of its
+// config file
+func (db *DB) SetCredentials(creds map[uint64]NodeCredentials) error {
+	for nodeid, cred := range creds {
+		if cred.Key != nil && len(cred.Key) < minimumKeyLength {
+			return fmt.Errorf("Key for node %v must be at least %v bytes", nodeid, minimumKeyLength)
+		}
+		for _, token := range cred.Tokens {
+			if len(token) < minimumKeyLength {
+				return fmt.Errorf("Token for node %v must be at least %v bytes", nodeid, minimumKeyLength)
+			}
+		}
+	}
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(keysBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create keys bucket (%s)", err)
+		}
+		var removed [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			if cred, found := creds[binary.BigEndian.Uint64(k)]; !found || cred.Key == nil {
+				removed = append(removed, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range removed {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for nodeid, cred := range creds {
+			if cred.Key != nil {
+				if err = putNodeKey(b, nodeid, cred.Key, cred.Policy); err != nil {
+					return err
+				}
+			}
+		}
+
+		if tx.Bucket(tokensBucket) != nil {
+			if err = tx.DeleteBucket(tokensBucket); err != nil {
+				return fmt.Errorf("Could not remove tokens (%s)", err)
+			}
+		}
+		tb, err := tx.CreateBucket(tokensBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create tokens bucket (%s)", err)
+		}
+		for nodeid, cred := range creds {
+			for _, token := range cred.Tokens {
+				hash := sha256.Sum256([]byte(token))
+				if err = tb.Put(hash[:], itob(nodeid)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// holds the nodeid of each HTTP token, keyed by the SHA-256 hash of the token
+var tokensBucket = []byte(".tokens")
+
+// AddNodeToken provisions [token] for [nodeid]. HTTP requests that carry the
+// token as a bearer token are made on behalf of the node. A node can have any
+// number of tokens
+func (db *DB) AddNodeToken(nodeid uint64, token string) error {
+	if len(token) < minimumKeyLength {
+		return fmt.Errorf("Token for node %v must be at least %v bytes", nodeid, minimumKeyLength)
+	}
+	hash := sha256.Sum256([]byte(token))
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(tokensBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create tokens bucket (%s)", err)
+		}
+		return b.Put(hash[:], itob(nodeid))
+	})
+	return err
+}
+
+// RemoveNodeToken revokes [token]
+func (db *DB) RemoveNodeToken(token string) error {
+	hash := sha256.Sum256([]byte(token))
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(tokensBucket); b != nil {
+			return b.Delete(hash[:])
+		}
+		return nil
+	})
+	return err
+}
+
+// returns the node [token] was provisioned for. [found] is false if the token
+// is unknown
+func (db *DB) tokenNode(token string) (nodeid uint64, found bool, err error) {
+	hash := sha256.Sum256([]byte(token))
+	err = db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokensBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(hash[:]); v != nil {
+			nodeid, found = binary.BigEndian.Uint64(v), true
+		}
+		return nil
+	})
+	return nodeid, found, err
+}
+
+// returns the key of the given node, or nil if the node is not protected
+func (db *DB) getNodeKey(nodeid uint64) (*nodeKey, error) {
+	var nk *nodeKey
+	err := db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get(itob(nodeid))
+		if v == nil {
+			return nil
+		}
+		nk = new(nodeKey)
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(nk); err != nil {
+			return fmt.Errorf("Could not decode key for node %v (%s)", nodeid, err)
+		}
+		return nil
+	})
+	return nk, err
+}
+
+// records [epoch] as the current epoch of the given node. Fails if the epoch
+// is not greater than the last recorded one, so that concurrent sessions
+// cannot be started with the same epoch
+func (db *DB) advanceNodeEpoch(nodeid uint64, epoch uint32) error {
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+		if b == nil {
+			return fmt.Errorf("Node %v does not have a key", nodeid)
+		}
+		v := b.Get(itob(nodeid))
+		if v == nil {
+			return fmt.Errorf("Node %v does not have a key", nodeid)
+		}
+		var nk nodeKey
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&nk); err != nil {
+			return fmt.Errorf("Could not decode key for node %v (%s)", nodeid, err)
+		}
+		if epoch <= nk.Epoch {
+			return errStaleEpoch
+		}
+		nk.Epoch = epoch
+		var buf = new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(nk); err != nil {
+			return err
+		}
+		return b.Put(itob(nodeid), buf.Bytes())
+	})
+	return err
+}
+
+// computes the truncated MAC of [msg]
+func computeMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)[:macLength]
+}
+
+// derives the AES-128 key used for encrypted envelopes from a pre-shared key
+func encryptionKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("MPDB encryption"))
+	return mac.Sum(nil)[:16]
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encryptionKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithTagSize(block, tagLength)
+}
+
+func envelopeNonce(direction byte, epoch uint32, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	nonce[0] = direction
+	binary.BigEndian.PutUint32(nonce[4:], epoch)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+// wraps [payload] in an envelope of the given mode. [direction] and [counter]
+// are only used by encrypted envelopes, and must never be used twice with the
+// same key and epoch for different payloads
+func sealEnvelope(key []byte, mode byte, direction byte, epoch uint32, counter uint64, payload []byte) ([]byte, error) {
+	switch mode {
+	case envelopeAuth:
+		buf := make([]byte, envelopeHeader, envelopeHeader+len(payload)+macLength)
+		buf[0] = envelopeMarker
+		buf[1] = envelopeAuth
+		binary.BigEndian.PutUint32(buf[2:], epoch)
+		buf = append(buf, payload...)
+		return append(buf, computeMAC(key, buf)...), nil
+	case envelopeEncrypt:
+		if counter > math.MaxUint32 {
+			return nil, fmt.Errorf("Counter %v does not fit in an encrypted envelope", counter)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, encryptedHeader, encryptedHeader+len(payload)+tagLength)
+		buf[0] = envelopeMarker
+		buf[1] = envelopeEncrypt
+		binary.BigEndian.PutUint32(buf[2:], epoch)
+		binary.BigEndian.PutUint32(buf[6:], uint32(counter))
+		nonce := envelopeNonce(direction, epoch, uint32(counter))
+		return aead.Seal(buf, nonce, payload, buf[:encryptedHeader]), nil
+	}
+	return nil, fmt.Errorf("Unknown envelope mode %v", mode)
+}
+
+// checks an envelope and returns its mode, epoch and payload. Encrypted
+// envelopes are decrypted in place
+func verifyEnvelope(key []byte, direction byte, buf []byte) (byte, uint32, []byte, error) {
+	if len(buf) < 2 || buf[0] != envelopeMarker {
+		return 0, 0, nil, fmt.Errorf("Datagram is not an envelope")
+	}
+	switch mode := buf[1]; mode {
+	case envelopeAuth:
+		if len(buf) < envelopeHeader+macLength {
+			return 0, 0, nil, fmt.Errorf("Envelope is too short")
+		}
+		body, mac := buf[:len(buf)-macLength], buf[len(buf)-macLength:]
+		if !hmac.Equal(mac, computeMAC(key, body)) {
+			return 0, 0, nil, fmt.Errorf("Invalid MAC")
+		}
+		return mode, binary.BigEndian.Uint32(buf[2:]), body[envelopeHeader:], nil
+	case envelopeEncrypt:
+		if len(buf) < encryptedHeader+tagLength {
+			return 0, 0, nil, fmt.Errorf("Envelope is too short")
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		header, ciphertext := buf[:encryptedHeader], buf[encryptedHeader:]
+		epoch := binary.BigEndian.Uint32(header[2:])
+		nonce := envelopeNonce(direction, epoch, binary.BigEndian.Uint32(header[6:]))
+		payload, err := aead.Open(ciphertext[:0], nonce, ciphertext, header)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("Could not decrypt envelope")
+		}
+		return mode, epoch, payload, nil
+	default:
+		return 0, 0, nil, fmt.Errorf("Unknown envelope mode %v", mode)
+	}
+}
+
+// returns the counter carried in the header of an encrypted envelope, which
+// is the echo tag for requests
+func envelopeEcho(buf []byte) uint64 {
+	return uint64(binary.BigEndian.Uint32(buf[6:]))
+}
+
+// checks the envelope of an incoming datagram from this client and returns the
+// msgpack payload. Plain datagrams are only accepted from nodes without a key,
+// and nodes with PolicyEncrypt must send encrypted datagrams. An enveloped
+// datagram with a new epoch, or a new key, starts a new session for the
+// client. If the epoch is stale, the payload is returned along with
+// errStaleEpoch so that the caller can tell the node to start over
+func (c *Client) openEnvelope(buf []byte) ([]byte, error) {
+	nk, err := c.db.getNodeKey(c.nodeid)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 || buf[0] != envelopeMarker {
+		if nk != nil {
+			return nil, fmt.Errorf("Node %v requires authenticated requests", c.nodeid)
+		}
+		c.key = nil
+		return buf, nil
+	}
+	if nk == nil {
+		return nil, fmt.Errorf("Node %v does not have a key", c.nodeid)
+	}
+	var echo uint64
+	if len(buf) >= encryptedHeader && buf[1] == envelopeEncrypt {
+		echo = envelopeEcho(buf)
+	}
+	mode, epoch, payload, err := verifyEnvelope(nk.Key, toServer, buf)
+	if err != nil {
+		return nil, err
+	}
+	if nk.Policy == PolicyEncrypt && mode != envelopeEncrypt {
+		return nil, fmt.Errorf("Node %v requires encrypted requests", c.nodeid)
+	}
+	if mode == envelopeEncrypt {
+		if err = checkEcho(payload, echo); err != nil {
+			return nil, err
+		}
+	}
+	if epoch != c.epoch || c.key == nil || !bytes.Equal(c.key, nk.Key) {
+		if err = c.db.advanceNodeEpoch(c.nodeid, epoch); err != nil {
+			return payload, err
+		}
+		c.log.Info("Node %v started session with epoch %v", c.nodeid, epoch)
+		c.reset(epoch)
+	}
+	c.key = nk.Key
+	c.mode = mode
+	return payload, nil
+}
+
+// checks that the decrypted payload is a single request, and that its echo
+// tag matches the one in the header of its envelope, which was used for the
+// nonce
+func checkEcho(payload []byte, echo uint64) error {
+	req, consumed, err := decodeRequest(&payload, 0)
+	if err != nil {
+		return err
+	}
+	if consumed != len(payload) {
+		return fmt.Errorf("Encrypted envelopes can only carry a single request")
+	}
+	if req.Echo != echo {
+		return fmt.Errorf("Echo tag of payload does not match envelope")
+	}
+	return nil
+}
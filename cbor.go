@@ -0,0 +1,151 @@
+package mpdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A minimal CBOR (RFC 7049) codec for the CoAP front-end. It covers the types
+// MPDB stores (unsigned and negative integers and text strings), along with
+// maps with text keys, arrays and null for results. Values are encoded in the
+// shortest form, and maps with sorted keys, so the encoding is canonical
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+)
+
+// the CBOR encoding of null
+const cborNull = 0xf6
+
+// appends the head of a data item with major type [major] and argument [arg]
+func encodeCBORHead(output *[]byte, major byte, arg uint64) {
+	major <<= 5
+	switch {
+	case arg < 24:
+		*output = append(*output, major|byte(arg))
+	case arg <= math.MaxUint8:
+		*output = append(*output, major|24, byte(arg))
+	case arg <= math.MaxUint16:
+		*output = append(*output, major|25)
+		putUint(output, arg, 2)
+	case arg <= math.MaxUint32:
+		*output = append(*output, major|26)
+		putUint(output, arg, 4)
+	default:
+		*output = append(*output, major|27)
+		putUint(output, arg, 8)
+	}
+}
+
+// appends the CBOR encoding of a signed integer
+func encodeCBORInt(output *[]byte, value int64) {
+	if value >= 0 {
+		encodeCBORHead(output, cborUint, uint64(value))
+	} else {
+		encodeCBORHead(output, cborNegint, uint64(-1-value))
+	}
+}
+
+// Appends the CBOR encoding of [value] to [output]. Supports the types a
+// Record holds, nil, []string, []interface{} and map[string]interface{}
+func encodeCBOR(output *[]byte, value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		*output = append(*output, cborNull)
+	case uint64:
+		encodeCBORHead(output, cborUint, value)
+	case uint:
+		encodeCBORHead(output, cborUint, uint64(value))
+	case int64:
+		encodeCBORInt(output, value)
+	case int:
+		encodeCBORInt(output, int64(value))
+	case string:
+		encodeCBORHead(output, cborText, uint64(len(value)))
+		*output = append(*output, value...)
+	case []string:
+		encodeCBORHead(output, cborArray, uint64(len(value)))
+		for _, item := range value {
+			encodeCBORHead(output, cborText, uint64(len(item)))
+			*output = append(*output, item...)
+		}
+	case []interface{}:
+		encodeCBORHead(output, cborArray, uint64(len(value)))
+		for _, item := range value {
+			if err := encodeCBOR(output, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if value == nil {
+			*output = append(*output, cborNull)
+			break
+		}
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		encodeCBORHead(output, cborMap, uint64(len(value)))
+		for _, k := range keys {
+			encodeCBORHead(output, cborText, uint64(len(k)))
+			*output = append(*output, k...)
+			if err := encodeCBOR(output, value[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Cannot encode value %v of type %T as CBOR", value, value)
+	}
+	return nil
+}
+
+// Decodes the CBOR data item at [offset], which must be an unsigned integer
+// (decoded as uint64), a negative integer (int64) or a text string. Returns
+// the value and the number of bytes consumed
+func decodeCBOR(input []byte, offset int) (interface{}, int, error) {
+	if offset >= len(input) {
+		return nil, 0, fmt.Errorf("CBOR input truncated at offset %v", offset)
+	}
+	major, info := input[offset]>>5, input[offset]&0x1f
+	var (
+		arg      uint64
+		consumed = 1
+	)
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		n := 1 << (info - 24)
+		if offset+1+n > len(input) {
+			return nil, 0, fmt.Errorf("CBOR input truncated at offset %v", offset)
+		}
+		arg = getUint(&input, offset+1, n)
+		consumed += n
+	default:
+		return nil, 0, fmt.Errorf("Unsupported CBOR additional information %v at offset %v", info, offset)
+	}
+	switch major {
+	case cborUint:
+		return arg, consumed, nil
+	case cborNegint:
+		if arg > math.MaxInt64 {
+			return nil, 0, fmt.Errorf("CBOR negative integer at offset %v does not fit in an int64", offset)
+		}
+		return -1 - int64(arg), consumed, nil
+	case cborText:
+		if arg > uint64(len(input)-offset-consumed) {
+			return nil, 0, fmt.Errorf("CBOR input truncated at offset %v", offset)
+		}
+		start := offset + consumed
+		return string(input[start : start+int(arg)]), consumed + int(arg), nil
+	default:
+		return nil, 0, fmt.Errorf("Unsupported CBOR major type %v at offset %v", major, offset)
+	}
+}
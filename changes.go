@@ -0,0 +1,167 @@
+package mpdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+// Every commit is recorded in the change log, keyed by its revision, so that
+// subscribers can follow the changes to the database and resume after the
+// last revision they have seen. Only the most recent commits are kept
+var changesBucket = []byte(".changes")
+
+// the number of commits kept in the change log
+const maxChangeLogLength = 10000
+
+// returned by ChangesSince if some of the requested commits were already
+// dropped from the change log
+var ErrChangesPruned = errors.New("Changes were pruned from the change log")
+
+// A Change is a value written or a key deleted by a commit
+type Change struct {
+	// the full key, or the key within the persist bucket for Persist changes
+	Key string
+	// the collection of the key, or the nodeid for Persist changes
+	Collection string
+	// set for changes to the persist bucket of a node
+	Persist bool
+	// set if the key was deleted, in which case Value is nil
+	Deleted bool
+	Value   interface{}
+}
+
+// A ChangeSet holds the changes made by a single commit
+type ChangeSet struct {
+	Revision uint64
+	Time     time.Time
+	Writer   string
+	Changes  []Change
+}
+
+// on-disk representation of a Change
+type changeRecord struct {
+	Bucket  string
+	Key     string
+	Value   Record
+	Deleted bool
+	// set for changes to the persist bucket of the writer
+	Persist bool
+}
+
+// on-disk representation of a ChangeSet
+type changeSetRecord struct {
+	Time    int64 // unix nanoseconds
+	Writer  string
+	Changes []changeRecord
+}
+
+// adds the changes of [cm] to the change log, and drops the oldest commits
+// from the log
+func (db *DB) logChanges(cm *commit) error {
+	b, err := cm.tx.CreateBucketIfNotExists(changesBucket)
+	if err != nil {
+		return fmt.Errorf("Could not create change log (%s)", err)
+	}
+	var buf = new(bytes.Buffer)
+	err = gob.NewEncoder(buf).Encode(changeSetRecord{Time: cm.time.UnixNano(), Writer: cm.writer, Changes: cm.changes})
+	if err != nil {
+		return err
+	}
+	if err = b.Put(itob(cm.revision), buf.Bytes()); err != nil {
+		return fmt.Errorf("Could not log changes of revision %v (%s)", cm.revision, err)
+	}
+	if cm.revision <= maxChangeLogLength {
+		return nil
+	}
+	cutoff := cm.revision - maxChangeLogLength
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= cutoff; k, _ = c.First() {
+		if err = c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangesSince returns the commits after revision [after], oldest first, up
+// to [limit] of them. It returns ErrChangesPruned if commits after [after]
+// were already dropped from the change log, in which case the caller has to
+// read the current values instead (e.g. with GetBucket) and continue from
+// the current Revision
+func (db *DB) ChangesSince(after uint64, limit int) ([]ChangeSet, error) {
+	var sets []ChangeSet
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var current uint64
+		if b := tx.Bucket(revisionBucket); b != nil {
+			current = b.Sequence()
+		}
+		if after >= current {
+			return nil
+		}
+		b := tx.Bucket(changesBucket)
+		if b == nil {
+			return ErrChangesPruned
+		}
+		c := b.Cursor()
+		k, v := c.Seek(itob(after + 1))
+		if k == nil || binary.BigEndian.Uint64(k) != after+1 {
+			return ErrChangesPruned
+		}
+		for ; k != nil && len(sets) < limit; k, v = c.Next() {
+			var csr changeSetRecord
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&csr); err != nil {
+				return fmt.Errorf("Could not decode changes (%s)", err)
+			}
+			set, err := csr.changeSet(binary.BigEndian.Uint64(k))
+			if err != nil {
+				return err
+			}
+			sets = append(sets, set)
+		}
+		return nil
+	})
+	return sets, err
+}
+
+// returns the ChangeSet of revision [revision] that [csr] is the on-disk
+// representation of
+func (csr changeSetRecord) changeSet(revision uint64) (ChangeSet, error) {
+	set := ChangeSet{Revision: revision, Time: time.Unix(0, csr.Time), Writer: csr.Writer,
+		Changes: make([]Change, len(csr.Changes))}
+	for idx, cr := range csr.Changes {
+		change := Change{Key: joinKey(cr.Bucket, cr.Key), Collection: cr.Bucket, Persist: cr.Persist, Deleted: cr.Deleted}
+		if cr.Persist {
+			change.Key = cr.Key
+		}
+		if !cr.Deleted {
+			val, err := cr.Value.value()
+			if err != nil {
+				return set, err
+			}
+			change.Value = val
+		}
+		set.Changes[idx] = change
+	}
+	return set, nil
+}
+
+// Changed returns a channel that is closed once the next commit is written.
+// Callers wait on it and then read the new commits with ChangesSince
+func (db *DB) Changed() <-chan struct{} {
+	db.changedLock.Lock()
+	defer db.changedLock.Unlock()
+	return db.changed
+}
+
+// wakes up the callers waiting on Changed
+func (db *DB) notifyChanged() {
+	db.changedLock.Lock()
+	defer db.changedLock.Unlock()
+	close(db.changed)
+	db.changed = make(chan struct{})
+}
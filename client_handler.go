@@ -1,195 +1,477 @@
-package main
+package mpdb
 
 import (
+	"context"
 	"fmt"
-	"github.com/ugorji/go/codec"
+	"github.com/op/go-logging"
+	"math"
 	"net"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type Client struct {
+	// the server the client belongs to
+	server *Server
+	db     *DB
+	log    *logging.Logger
 	// address of the client
 	addr *net.UDPAddr
-	// Node ID
-	nodeid uint64
+	// the socket of the listener the client first sent to, which is used for
+	// all responses so that they come from the address the client sent to
+	conn *net.UDPConn
+	// serializes datagrams from the client, which can arrive on several
+	// listeners
+	incoming sync.Mutex
+	// guards the nodeid, the session and the state of the reliable protocol,
+	// which handleIncoming and the loop share. It is never held while waiting
+	// on the queue
+	state sync.Mutex
+	// the nodeid the address of the client resolves to
+	peer
 	// window start. We have ACK'd all messages up until this echo tag
 	window uint64
 	// window size
 	windowSize uint64
 	// the last echo tag we have committed. Should be within the window
 	lastCommitted uint64
-	// key-value = echo:message for echo tags we can't commit yet
-	cached map[uint64]map[string]interface{}
+	// key-value = echo:request for echo tags we can't commit yet
+	cached map[uint64]*Request
 	// cache of responses for resends
-	cachedResp  map[uint64]map[string]interface{}
+	cachedResp  map[uint64]*cachedResponse
 	resendTimer *time.Ticker
 	// processing queue of messages
-	queue chan map[string]interface{}
+	queue chan *Request
+	// responses waiting to be sent, so that the responses to several
+	// messages can be packed into one datagram
+	outbox []*cachedResponse
+	// set if the last datagram from the client was in compact mode, in which
+	// case responses are sent in compact mode as well
+	compact bool
+	// cancelled when the server shuts down. The loop then sends the responses
+	// waiting in the outbox, stops and closes done
+	ctx  context.Context
+	done chan struct{}
 	// server time-out
 	timeout     time.Duration
 	servertimer <-chan time.Time
+	// pre-shared key, epoch and envelope mode of the current session. The key
+	// is nil for clients that send plain requests
+	key   []byte
+	epoch uint32
+	mode  byte
+	// sequence number of the last encrypted datagram sent in the current
+	// session, which is part of its nonce
+	seq uint64
+}
+
+// a response encoded once, so that every resend carries the same bytes
+type cachedResponse struct {
+	msg []byte
+	// the encrypted datagram carrying the response, once it was sent in an
+	// encrypted envelope. Resends send these exact bytes, as sealing the
+	// response again would need a new nonce
+	sealed []byte
 }
 
-func NewClient(timeout time.Duration, addr *net.UDPAddr) *Client {
-	address_nodeid := uint64(addr.IP[12])<<12 | uint64(addr.IP[13])<<8 | uint64(addr.IP[14])<<4 | uint64(addr.IP[15])
-	log.Debug("string %v nodeid %v", addr.String(), address_nodeid)
-	c := &Client{nodeid: address_nodeid, timeout: timeout,
-		addr: addr, window: 1, windowSize: 5, lastCommitted: 0,
-		cached:      make(map[uint64]map[string]interface{}),
-		cachedResp:  make(map[uint64]map[string]interface{}),
-		resendTimer: time.NewTicker(timeout),
-		queue:       make(chan map[string]interface{})}
+func (s *Server) newClient(addr *net.UDPAddr, conn *net.UDPConn) *Client {
+	opts := s.options()
+	c := &Client{server: s, db: s.db, log: s.log, peer: peer{ip: addr.IP},
+		ctx: s.clientsCtx, done: make(chan struct{}), timeout: opts.Timeout,
+		addr: addr, conn: conn, window: 1, windowSize: opts.WindowSize, lastCommitted: 0,
+		cached:      make(map[uint64]*Request),
+		cachedResp:  make(map[uint64]*cachedResponse),
+		resendTimer: time.NewTicker(opts.Timeout),
+		queue:       make(chan *Request)}
+	s.resolve(&c.peer)
+	c.log.Debug("string %v nodeid %v", addr.String(), c.nodeid)
 	go c.loop()
 	return c
 }
 
+// the sender of requests, on whose behalf they are executed
+type peer struct {
+	// address of the sender
+	ip net.IP
+	// Node ID
+	nodeid uint64
+	// set if the nodeid of the sender could not be resolved (e.g. because
+	// the node is retired). Only REGISTER is served while it is set
+	identityErr error
+}
+
+// looks up the nodeid of [p] in the registry. This is done for every datagram
+// and frame, so that registering, retiring and renaming nodes takes effect
+// immediately
+func (s *Server) resolve(p *peer) {
+	nodeid, err := s.db.ResolveNode(p.ip)
+	if err != nil {
+		s.log.Warning("Could not resolve nodeid of %v (%v)", p.ip, err)
+		p.identityErr = err
+		return
+	}
+	p.nodeid, p.identityErr = nodeid, nil
+}
+
 func (c *Client) loop() {
 	for {
 		select {
-		case msg := <-c.queue:
-			log.Debug("got msg off queue")
-			// get echo tag from message
-			echo := getUint64(msg["echo"])
-			if echo == c.lastCommitted+1 { // next in line to be processed
-				log.Debug("commit %v -- after last committed %v", echo, c.lastCommitted)
-				c.commitAndReply(msg)
+		case req := <-c.queue:
+			c.log.Debug("got msg off queue")
+			c.state.Lock()
+			if req.Echo == c.lastCommitted+1 { // next in line to be processed
+				c.log.Debug("commit %v -- after last committed %v", req.Echo, c.lastCommitted)
+				c.commitAndReply(req)
+				c.flush()
 			}
+			c.state.Unlock()
 		case <-c.resendTimer.C:
-			log.Debug("resending committed messages in window %v til %v", c.window, c.lastCommitted)
+			c.log.Debug("resending committed messages in window %v til %v", c.window, c.lastCommitted)
+			c.state.Lock()
+			var resend []*cachedResponse
 			for echo := c.window; echo <= c.lastCommitted; echo++ {
-				c.doSend(c.cachedResp[echo])
+				if resp, found := c.cachedResp[echo]; found {
+					resend = append(resend, resp)
+				}
 			}
+			c.sendResponses(resend)
+			c.state.Unlock()
+		case <-c.ctx.Done():
+			c.log.Debug("stopping client %v", c.addr)
+			c.state.Lock()
+			c.flush()
+			c.state.Unlock()
+			c.resendTimer.Stop()
+			close(c.done)
+			return
 		}
 	}
 }
 
-func (c *Client) handleIncoming(buf []byte, writeback *net.UDPConn) {
-	var (
-		msg  map[string]interface{}
-		echo uint64
-		ok   bool
-	)
+// starts a new session with the given epoch, forgetting the state of the
+// reliable protocol for the previous session
+func (c *Client) reset(epoch uint32) {
+	c.epoch = epoch
+	c.window = 1
+	c.windowSize = c.server.options().WindowSize
+	c.lastCommitted = 0
+	c.seq = 0
+	c.cached = make(map[uint64]*Request)
+	c.cachedResp = make(map[uint64]*cachedResponse)
+}
 
-	offset := 0
-	_, decoded := decode(&buf, offset) // decode msgpack
-	log.Debug("client w/ addr %v decoded %v", c.addr, decoded)
+// handles a datagram from the client. A datagram can carry several messages
+// back to back, which are handled in order
+func (c *Client) handleIncoming(buf []byte, writeback *net.UDPConn) {
+	var err error
+	c.incoming.Lock()
+	defer c.incoming.Unlock()
 
-	// decode top-level msg
-	if msg, ok = decoded.(map[string]interface{}); !ok {
-		log.Debug("Did not decode msg %v as map[string]interface{}", decoded)
+	c.state.Lock()
+	c.server.resolve(&c.peer)
+	buf, err = c.openEnvelope(buf)
+	if err == errStaleEpoch {
+		c.rejectStale(buf)
+		c.state.Unlock()
+		return
+	} else if err != nil {
+		c.state.Unlock()
+		c.log.Warning("Rejected datagram from %v (%v)", c.addr, err)
 		return
 	}
+	c.compact = isCompact(&buf, 0)
+	c.state.Unlock()
 
-	// get echo tag
-	if _echo, found := msg["echo"]; !found {
-		log.Debug("Msg did not have key 'echo' (%v)", msg)
-		return
-	} else {
-		echo = getUint64(_echo)
+	for offset := 0; offset < len(buf); {
+		req, consumed, err := decodeRequest(&buf, offset) // decode msgpack
+		if err != nil {
+			c.log.Warning("Could not decode datagram from %v (%v)", c.addr, err)
+			// the echo of a request that cannot be decoded is not known, so
+			// the error is sent with echo 0, outside of the reliable protocol
+			c.state.Lock()
+			c.doSend(response(c.nodeid, 0, nil, fmt.Errorf("Could not decode request (%s)", err)))
+			c.state.Unlock()
+			return
+		}
+		offset += consumed
+		c.log.Debug("client w/ addr %v decoded %+v", c.addr, req)
+		c.handleMessage(req)
 	}
+}
+
+func (c *Client) handleMessage(req *Request) {
+	c.state.Lock()
+	queue := c.accept(req)
+	c.state.Unlock()
+	if queue {
+		c.enqueue(req) // queue to send
+	}
+}
+
+// checks the echo tag of [req] against the window, and caches the request if
+// it is to be committed. Returns true if it is to be queued
+func (c *Client) accept(req *Request) (queue bool) {
+	echo := req.Echo
 
 	// check echo tag
 	switch {
 	// this is a duplicate message, so we resend? TODO
 	case echo < c.window:
-		log.Debug("received duplicate Echo %v. Window starts at %v", echo, c.window)
+		c.log.Debug("received duplicate Echo %v. Window starts at %v", echo, c.window)
 	// within the window, so we queue to process
 	case echo >= c.window && echo < c.window+c.windowSize:
-		log.Debug("Received echo %v within window starting at %v", echo, c.window)
-		c.cached[echo] = msg // cache the message
-		c.queue <- msg       // queue to send
+		c.log.Debug("Received echo %v within window starting at %v", echo, c.window)
+		c.cached[echo] = req // cache the message
+		queue = true
 	// beyond the window and we've alrady processed it on this side. Check if we can
 	// update the window
 	case echo >= c.window+c.windowSize:
 		diff := echo - (c.window + c.windowSize - 1)
 		if diff <= (c.lastCommitted - c.window + 1) { // advance window by diff
 			c.window += diff
-			c.cached[echo] = msg
-			c.queue <- msg
+			c.cached[echo] = req
+			queue = true
 			// throw out ACK'd responses below our window
 			for prevecho, _ := range c.cachedResp {
 				if prevecho < c.window {
 					delete(c.cachedResp, prevecho)
 				}
 			}
-			log.Debug("advanced window by %v to %v", diff, c.window)
+			c.log.Debug("advanced window by %v to %v", diff, c.window)
 		}
-		log.Debug("Received echo %v outside of window starting at %v", echo, c.window)
+		c.log.Debug("Received echo %v outside of window starting at %v", echo, c.window)
 	}
+	return
 }
 
-func (c *Client) commitAndReply(msg map[string]interface{}) {
+// hands [req] to the loop, unless the client was stopped
+func (c *Client) enqueue(req *Request) {
+	select {
+	case c.queue <- req:
+	case <-c.ctx.Done():
+		c.log.Debug("dropping echo %v for stopped client %v", req.Echo, c.addr)
+	}
+}
+
+func (c *Client) commitAndReply(req *Request) {
+	var echo = req.Echo
+
+	c.log.Debug("COMMIT oper %v echo %v", req.Oper, echo)
+	ret, ok, err := c.server.execute(&c.peer, req)
+
+	// delete entry in cache if it exists and update state variables
+	if ok {
+		c.lastCommitted = echo
+		if _, found := c.cached[echo]; found {
+			delete(c.cached, echo)
+		}
+	}
+
+	resp := c.encodeResponse(response(req.Nodeid, echo, ret, err))
+	c.outbox = append(c.outbox, resp)
+
+	// cache the response
+	c.cachedResp[echo] = resp
+
+	// check for new messages we can process
+	tmpecho := c.lastCommitted
+	for {
+		tmpecho += 1
+		if req, found := c.cached[tmpecho]; found {
+			c.log.Debug("found and executing %v for tag %v", tmpecho, req)
+			if tmpecho == c.lastCommitted+1 { // next in line to be processed
+				c.commitAndReply(req)
+			}
+		} else if tmpecho > c.window+c.windowSize {
+			break
+		}
+	}
+
+}
+
+// executes [req] on behalf of [p] and returns its result. [ok] is false if
+// the operation is not known
+func (s *Server) execute(p *peer, req *Request) (ret map[string]interface{}, ok bool, err error) {
 	var (
+		nodeid     = req.Nodeid
+		oper       = req.Oper
+		nodeidstr  = strconv.FormatUint(nodeid, 10)
 		data       map[string]interface{}
 		keys       []string
 		bucketname string
-		nodeid     uint64
-		echo       uint64
-		oper       string
-		ok         bool
 	)
+	ok = true
+	// changes are recorded as written by the node the request came from,
+	// whatever nodeid it claims
+	writer := strconv.FormatUint(p.nodeid, 10)
 
-	// retrieve nodeid
-	if _nodeid, found := msg["nodeid"]; !found {
-		log.Debug("Msg did not have key 'nodeid' (%v)", msg)
+	// expand dictionary indexes. Which of data, keys and collection are used
+	// depends on the operation
+	if err = req.expand(&expander{db: s.db, nodeid: p.nodeid}); err != nil {
 		return
-	} else {
-		nodeid = getUint64(_nodeid)
 	}
-
-	// retrieve operation
-	if _oper, found := msg["oper"]; !found {
-		log.Debug("Msg did not have key 'oper' (%v)", msg)
+	data, keys, bucketname = req.Data, req.Keys, req.Collection
+	if err = s.checkAccess(p, oper, keys, data, bucketname); err != nil {
+		s.log.Warning("Denied oper %v echo %v (%v)", oper, req.Echo, err)
 		return
-	} else {
-		oper = _oper.(string)
 	}
-
-	echo = getUint64(msg["echo"])
-
-	ok = true
-	var (
-		err error
-		ret map[string]interface{}
-	)
-	log.Debug("COMMIT oper %v echo %v", oper, echo)
 	switch oper {
 	case "PERSIST":
-		if nodeid != c.nodeid {
-			err = fmt.Errorf("Node %v cannot access data with nodeid %v", c.nodeid, nodeid)
+		if nodeid != p.nodeid {
+			err = fmt.Errorf("Node %v cannot access data with nodeid %v", p.nodeid, nodeid)
 		} else {
-			err = db.Persist(string(nodeid), data)
+			err = s.db.Persist(nodeidstr, data)
 		}
 	case "GETPERSIST":
-		if nodeid != c.nodeid {
-			err = fmt.Errorf("Node %v cannot access data with nodeid %v", c.nodeid, nodeid)
+		if nodeid != p.nodeid {
+			err = fmt.Errorf("Node %v cannot access data with nodeid %v", p.nodeid, nodeid)
 		} else {
-			ret, err = db.GetPersist(string(nodeid), keys)
+			ret, err = s.db.GetPersist(nodeidstr, keys)
 		}
 	case "INSERT":
-		err = db.Insert(data)
+		err = s.db.InsertFrom(writer, data)
 	case "GET":
-		ret, err = db.Get(keys)
+		if !req.Asof.IsZero() {
+			ret, err = s.db.GetAsOf(keys, req.Asof)
+		} else if req.Meta {
+			var entries map[string]*Entry
+			if entries, err = s.db.GetWithMeta(keys); err == nil {
+				ret = entriesToMap(entries)
+			}
+		} else {
+			ret, err = s.db.Get(keys)
+		}
+	case "GETHISTORY":
+		var history map[string][]Version
+		if history, err = s.db.GetHistory(keys); err == nil {
+			ret = historyToMap(history)
+		}
+	case "SETVERSIONING":
+		err = s.db.SetVersioning(bucketname, VersionPolicy{
+			MaxVersions: int(req.Versions),
+			MaxAge:      time.Duration(req.Maxage) * time.Second,
+		})
 	case "GETBUCKET":
-		ret, err = db.GetBucket(bucketname)
+		if req.Where != nil || req.Project != "" {
+			var entries map[string]*Entry
+			if entries, err = s.db.GetBucketFiltered(bucketname, req.Where); err == nil {
+				ret, err = projectEntries(entries, req.Project, req.Meta)
+			}
+		} else if req.Meta {
+			var entries map[string]*Entry
+			if entries, err = s.db.GetBucketWithMeta(bucketname); err == nil {
+				ret = entriesToMap(entries)
+			}
+		} else {
+			ret, err = s.db.GetBucket(bucketname)
+		}
+	case "SETACL":
+		err = s.db.SetACL(bucketname, req.ACL)
+	case "GETACL":
+		var entries []ACLEntry
+		if entries, err = s.db.GetACL(bucketname); err == nil {
+			ret = map[string]interface{}{bucketname: aclToList(entries)}
+		}
+	case "REGISTER":
+		var registered uint64
+		if req.Eui64 != 0 && !autoconfiguredFrom(p.ip, req.Eui64) {
+			// the address of the node does not show that the EUI-64 is its own
+			if err = s.checkAccess(p, "BINDEUI64", nil, nil, ""); err != nil {
+				s.log.Warning("Denied oper %v echo %v (%v)", oper, req.Echo, err)
+				return
+			}
+		}
+		if registered, err = s.db.RegisterNode(p.ip, req.Eui64, req.Name); err == nil {
+			p.nodeid, p.identityErr = registered, nil
+			ret = map[string]interface{}{"nodeid": registered}
+		}
+	case "LISTNODES":
+		var nodes []NodeInfo
+		if nodes, err = s.db.ListNodes(); err == nil {
+			ret = nodesToMap(nodes)
+		}
+	case "RENAMENODE":
+		err = s.db.RenameNode(req.Node, req.Name)
+	case "RETIRENODE":
+		err = s.db.RetireNode(req.Node)
+	case "SETDICT":
+		err = s.db.SetDictionary(p.nodeid, req.Dict)
+	case "GETDICT":
+		var entries []string
+		if entries, err = s.db.GetDictionary(p.nodeid); err == nil {
+			ret = map[string]interface{}{"dict": entries}
+		}
 	case "DELETE":
-		fallthrough
+		err = s.db.DeleteFrom(writer, keys)
+	case "TXN", "CAS", "INCR":
+		ret, err = s.executeTxn(p, req)
+	case "SETINDEX":
+		err = s.db.SetIndexes(bucketname, req.Fields)
+	case "FIND":
+		min, max := req.Min, req.Max
+		if req.hasValue {
+			min, max = req.Value, req.Value
+		}
+		if req.hasValue && req.Value == nil {
+			err = fmt.Errorf("FIND cannot look up nil")
+		} else {
+			ret, err = s.db.Find(bucketname, req.Field, min, max)
+		}
 	case "SUBSCRIBE":
 		fallthrough
 	default:
 		ok = false
-		log.Error("Unrecognized operation %v", oper)
+		s.log.Error("Unrecognized operation %v", oper)
 	}
+	return
+}
 
-	// delete entry in cache if it exists and update state variables
-	if ok {
-		c.lastCommitted = echo
-		if _, found := c.cached[echo]; found {
-			delete(c.cached, echo)
+// executes a TXN on behalf of [p], checking access for each of its
+// operations. The result holds the results of the operations in order under
+// "results". A CAS or INCR sent on its own runs as a TXN of one operation, and
+// its result is that of the operation
+func (s *Server) executeTxn(p *peer, req *Request) (map[string]interface{}, error) {
+	ops := req.Ops
+	if req.Oper != "TXN" {
+		ops = []*Request{req}
+	}
+	var txnOps = make([]TxnOp, len(ops))
+	for idx, op := range ops {
+		if op.Oper == "PERSIST" && req.Nodeid != p.nodeid {
+			return nil, fmt.Errorf("Node %v cannot access data with nodeid %v", p.nodeid, req.Nodeid)
+		}
+		keys := op.Keys
+		for k := range op.Expect {
+			keys = append(keys, k)
 		}
+		if err := s.checkAccess(p, op.Oper, keys, op.Data, ""); err != nil {
+			s.log.Warning("Denied operation %v of oper %v echo %v (%v)", idx, req.Oper, req.Echo, err)
+			return nil, err
+		}
+		txnOps[idx] = TxnOp{Oper: op.Oper, Keys: op.Keys, Data: op.Data, Expect: op.Expect}
+	}
+	// PERSIST operations were checked to be for the sender, so the writer is
+	// its nodeid either way
+	results, err := s.db.Txn(strconv.FormatUint(p.nodeid, 10), txnOps)
+	if err != nil {
+		return nil, err
 	}
+	if req.Oper != "TXN" {
+		return results[0], nil
+	}
+	var list = make([]interface{}, len(results))
+	for idx, result := range results {
+		if result != nil {
+			list[idx] = result
+		}
+	}
+	return map[string]interface{}{"results": list}, nil
+}
 
-	// create response
+// returns the RESPONSE to the request with [nodeid] and [echo]
+func response(nodeid, echo uint64, ret map[string]interface{}, err error) map[string]interface{} {
 	packet := map[string]interface{}{
 		"oper":   "RESPONSE",
 		"nodeid": nodeid,
@@ -201,45 +483,180 @@ func (c *Client) commitAndReply(msg map[string]interface{}) {
 	} else {
 		packet["err"] = nil
 	}
+	return packet
+}
 
-	c.doSend(packet)
-
-	// cache the response
-	c.cachedResp[echo] = packet
-
-	// check for new messages we can process
-	tmpecho := c.lastCommitted
-	for {
-		tmpecho += 1
-		if msg, found := c.cached[tmpecho]; found {
-			log.Debug("found and executing %v for tag %v", tmpecho, msg)
-			if tmpecho == c.lastCommitted+1 { // next in line to be processed
-				c.commitAndReply(msg)
-			}
-		} else if tmpecho > c.window+c.windowSize {
-			break
+// checks that [p] has the rights [oper] needs on every collection it touches.
+// PERSIST and GETPERSIST are not covered by ACLs: persist buckets live outside
+// of the namespace of collections, and execute only lets a node reach its own.
+// Managing the node registry, and registering an EUI-64 the address of the
+// node was not autoconfigured from (BINDEUI64), needs admin rights on the
+// default ACL
+func (s *Server) checkAccess(p *peer, oper string, keys []string, data map[string]interface{}, bucketname string) error {
+	if p.identityErr != nil && oper != "REGISTER" {
+		return p.identityErr
+	}
+	var need = make(map[string]Rights)
+	switch oper {
+	case "INSERT":
+		for k := range data {
+			collection, _ := splitKey(k)
+			need[collection] |= RightWrite
+		}
+	case "DELETE":
+		for _, k := range keys {
+			collection, _ := splitKey(k)
+			need[collection] |= RightWrite
+		}
+	case "GET", "GETHISTORY":
+		for _, k := range keys {
+			collection, _ := splitKey(k)
+			need[collection] |= RightRead
+		}
+	case "CAS", "INCR":
+		// both depend on the values they replace. The keys of a CAS are those
+		// it compares
+		for _, k := range keys {
+			collection, _ := splitKey(k)
+			need[collection] |= RightRead
+		}
+		for k := range data {
+			collection, _ := splitKey(k)
+			need[collection] |= RightRead | RightWrite
+		}
+	case "GETBUCKET", "FIND":
+		need[bucketname] |= RightRead
+	case "SETVERSIONING", "SETACL", "GETACL", "SETINDEX":
+		need[bucketname] |= RightAdmin
+	case "LISTNODES", "RENAMENODE", "RETIRENODE", "BINDEUI64":
+		need[DefaultACL] |= RightAdmin
+	}
+	for collection, rights := range need {
+		has, err := s.db.Rights(collection, p.nodeid)
+		if err != nil {
+			return err
+		}
+		if missing := rights &^ has; missing != 0 {
+			return fmt.Errorf("Access denied: node %v does not have %v rights on collection %v", p.nodeid, missing, collection)
 		}
 	}
+	return nil
+}
 
+// tells a node that sent an authenticated request with a stale epoch to start
+// a new session. The response is not cached, as it is not part of any session
+func (c *Client) rejectStale(payload []byte) {
+	req, _, err := decodeRequest(&payload, 0)
+	if err != nil {
+		return
+	}
+	c.log.Warning("Node %v sent request with stale epoch", c.nodeid)
+	c.compact = isCompact(&payload, 0)
+	// this response is sent in the clear, because its nonce could collide with
+	// one used by the current session
+	resp := c.encodeResponse(response(req.Nodeid, req.Echo, nil,
+		fmt.Errorf("Stale epoch: start a new session with a greater epoch")))
+	c.write(resp.msg)
 }
 
+// sends [msg] to the client, in the envelope of the current session if there
+// is one
 func (c *Client) doSend(msg map[string]interface{}) {
-	// dial back client
-	conn, err := net.DialUDP("udp6", nil, c.addr)
+	c.sendResponses([]*cachedResponse{c.encodeResponse(msg)})
+}
+
+// sends the responses waiting in the outbox
+func (c *Client) flush() {
+	c.sendResponses(c.outbox)
+	c.outbox = nil
+}
+
+// encodes [msg] in the mode of the last datagram from the client. A response
+// whose result cannot be encoded is replaced by an error response
+func (c *Client) encodeResponse(msg map[string]interface{}) *cachedResponse {
+	var buf []byte
+	c.log.Debug("writing back %v", msg)
+	err := encodeMessage(&buf, msg, c.compact)
 	if err != nil {
-		log.Error("could not create connection back to %v (%v)", c.addr, err)
-		return
+		c.log.Error("Could not encode response to %v (%v)", c.addr, err)
+		buf = buf[:0]
+		err = encodeMessage(&buf, response(getUint64(msg["nodeid"]), getUint64(msg["echo"]), nil,
+			fmt.Errorf("Could not encode result (%s)", err)), c.compact)
 	}
-	// and write message
-	buf := []byte{}
-	log.Debug("writing back %v", msg)
-	encoder := codec.NewEncoderBytes(&buf, &mh)
-	encoder.Encode(msg)
-	_, err = conn.Write(buf)
 	if err != nil {
-		log.Error("Error writing to client %v (%v)", c.addr, err)
+		c.log.Error("Could not encode error response to %v (%v)", c.addr, err)
+	}
+	return &cachedResponse{msg: buf}
+}
+
+// sends [resps] to the client, in the envelope of the current session if there
+// is one. Responses are packed back to back into datagrams of at most
+// MaxDatagramSize bytes; a response that is larger on its own is sent in its
+// own datagram. In encrypted sessions, each response is sealed into a datagram
+// of its own the first time it is sent, and resent as is
+func (c *Client) sendResponses(resps []*cachedResponse) {
+	if c.key != nil && c.mode == envelopeEncrypt {
+		for _, resp := range resps {
+			if resp.sealed == nil {
+				sealed, err := c.seal(resp.msg)
+				if err != nil {
+					c.log.Error("Could not seal response to %v (%v)", c.addr, err)
+					continue
+				}
+				resp.sealed = sealed
+			}
+			c.write(resp.sealed)
+		}
+		return
+	}
+	maxDatagramSize := c.server.options().MaxDatagramSize
+	pooled := getBuffer()
+	defer putBuffer(pooled)
+	for _, resp := range resps {
+		if len(*pooled) > 0 && len(*pooled)+len(resp.msg) > maxDatagramSize {
+			c.writeSealed(*pooled)
+			*pooled = (*pooled)[:0]
+		}
+		*pooled = append(*pooled, resp.msg...)
+	}
+	if len(*pooled) > 0 {
+		c.writeSealed(*pooled)
+	}
+}
+
+// writes a datagram to the client, in the envelope of the current session if
+// there is one
+func (c *Client) writeSealed(buf []byte) {
+	if c.key != nil {
+		var err error
+		if buf, err = c.seal(buf); err != nil {
+			c.log.Error("Could not seal response to %v (%v)", c.addr, err)
+			return
+		}
 	}
+	c.write(buf)
+}
 
+// wraps [payload] in the envelope of the current session. Every encrypted
+// envelope takes the next sequence number of the session for its nonce, so
+// that no two datagrams are sealed with the same nonce
+func (c *Client) seal(payload []byte) ([]byte, error) {
+	var seq uint64
+	if c.mode == envelopeEncrypt {
+		if c.seq >= math.MaxUint32 {
+			return nil, fmt.Errorf("Sequence numbers of epoch %v are exhausted", c.epoch)
+		}
+		c.seq++
+		seq = c.seq
+	}
+	return sealEnvelope(c.key, c.mode, fromServer, c.epoch, seq, payload)
+}
+
+// writes a single datagram to the client
+func (c *Client) write(buf []byte) {
+	if _, err := c.conn.WriteToUDP(buf, c.addr); err != nil {
+		c.log.Error("Error writing to client %v (%v)", c.addr, err)
+	}
 }
 
 func getUint64(i interface{}) uint64 {
@@ -252,3 +669,105 @@ func getUint64(i interface{}) uint64 {
 		return 0
 	}
 }
+
+// converts the result of DB.GetHistory into a form that can be encoded in a
+// RESPONSE. Each version is a map with keys "time" (unix seconds), "nodeid"
+// and "value"
+func historyToMap(history map[string][]Version) map[string]interface{} {
+	var res = make(map[string]interface{}, len(history))
+	for key, versions := range history {
+		list := make([]interface{}, len(versions))
+		for idx, version := range versions {
+			list[idx] = map[string]interface{}{
+				"time":   version.Time.Unix(),
+				"nodeid": version.Writer,
+				"value":  version.Value,
+			}
+		}
+		res[key] = list
+	}
+	return res
+}
+
+// converts the result of DB.GetWithMeta or DB.GetBucketWithMeta into a form
+// that can be encoded in a RESPONSE. Each value is a map with keys "value",
+// "time" (unix seconds), "nodeid" and "rev"
+func entriesToMap(entries map[string]*Entry) map[string]interface{} {
+	var res = make(map[string]interface{}, len(entries))
+	for key, entry := range entries {
+		if entry == nil {
+			res[key] = nil
+			continue
+		}
+		res[key] = map[string]interface{}{
+			"value":  entry.Value,
+			"time":   entry.Modified.Unix(),
+			"nodeid": entry.Writer,
+			"rev":    entry.Revision,
+		}
+	}
+	return res
+}
+
+// converts the entries returned by a GETBUCKET into the form given by
+// [project]: "" for a map from key to value (or to the metadata if [meta] is
+// set, see entriesToMap), "keys" for {"keys": [...]} and "values" for
+// {"values": [...]}, both in key order, and "count" for {"count": n}
+func projectEntries(entries map[string]*Entry, project string, meta bool) (map[string]interface{}, error) {
+	switch project {
+	case "":
+		if meta {
+			return entriesToMap(entries), nil
+		}
+		var res = make(map[string]interface{}, len(entries))
+		for key, entry := range entries {
+			res[key] = entry.Value
+		}
+		return res, nil
+	case "count":
+		return map[string]interface{}{"count": uint64(len(entries))}, nil
+	case "keys", "values":
+		var keys = make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var list = make([]interface{}, len(keys))
+		for idx, key := range keys {
+			if list[idx] = key; project == "values" {
+				list[idx] = entries[key].Value
+			}
+		}
+		return map[string]interface{}{project: list}, nil
+	}
+	return nil, fmt.Errorf("Unknown projection %s", project)
+}
+
+// the inverse of decodeACLField
+func aclToList(entries []ACLEntry) []interface{} {
+	var list = make([]interface{}, len(entries))
+	for idx, entry := range entries {
+		list[idx] = map[string]interface{}{
+			"first":  entry.First,
+			"last":   entry.Last,
+			"rights": entry.Rights.String(),
+		}
+	}
+	return list
+}
+
+// converts the result of DB.ListNodes into a form that can be encoded in a
+// RESPONSE: a map from nodeid to a map with keys "name", "identities",
+// "registered" (unix seconds) and "retired"
+func nodesToMap(nodes []NodeInfo) map[string]interface{} {
+	var res = make(map[string]interface{}, len(nodes))
+	for _, info := range nodes {
+		res[strconv.FormatUint(info.Nodeid, 10)] = map[string]interface{}{
+			"name":       info.Name,
+			"identities": info.Identities,
+			"registered": info.Registered.Unix(),
+			"retired":    info.Retired,
+		}
+	}
+	return res
+}
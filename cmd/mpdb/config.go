@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gtfierro/mpdb"
+	"github.com/op/go-logging"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the settings of the server. They are read from an optional
+// JSON config file, and command-line flags override the values from the file.
+// On SIGHUP, the file is read again and the settings marked as reloadable are
+// applied; the others only take effect on restart
+type Config struct {
+	// path of the database file
+	DB string `json:"db"`
+	// UDP addresses to listen on. IPv6 link-local addresses need a zone, e.g.
+	// "[fe80::1%eth0]:7000". An address without a host, e.g. ":7000",
+	// listens on all IPv4 and IPv6 addresses with a single socket
+	Listen []string `json:"listen"`
+	// TCP addresses to listen on, in the same form as Listen
+	ListenTCP []string `json:"listen_tcp"`
+	// TCP addresses to serve the HTTP gateway on
+	ListenHTTP []string `json:"listen_http"`
+	// UDP addresses to serve the CoAP front-end on
+	ListenCoAP []string `json:"listen_coap"`
+	// how long a client waits before resending responses that were not
+	// acknowledged (reloadable, applies to new clients)
+	Timeout Duration `json:"timeout"`
+	// number of echo tags in the window of each client (reloadable, applies
+	// to new sessions)
+	WindowSize uint64 `json:"window_size"`
+	// one of CRITICAL, ERROR, WARNING, NOTICE, INFO and DEBUG (reloadable)
+	LogLevel string `json:"log_level"`
+	// file to append the log to, or "" for stderr. The file is reopened on
+	// every reload, so it can be rotated (reloadable)
+	LogFile string `json:"log_file"`
+	// go-logging format string (reloadable)
+	LogFormat string `json:"log_format"`
+	// largest datagram MPDB packs responses into (reloadable)
+	MaxDatagramSize int `json:"max_datagram_size"`
+	// largest datagram MPDB reads (reloadable)
+	MaxRequestSize int `json:"max_request_size"`
+	// largest frame MPDB reads from TCP connections (reloadable)
+	MaxFrameSize int `json:"max_frame_size"`
+	// maximum number of clients with a session, or 0 for no limit. Datagrams
+	// from new clients beyond the limit are dropped (reloadable)
+	MaxClients int `json:"max_clients"`
+	// how long to wait for clients to send their last responses on shutdown
+	// before exiting anyway (reloadable)
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// TCP address of the MQTT broker to bridge the database to, or "" for no
+	// bridge
+	MQTTBroker string `json:"mqtt_broker"`
+	// client identifier of the bridge, which also names its outbox
+	MQTTClientID string `json:"mqtt_client_id"`
+	// credentials of the bridge, if the broker requires them
+	MQTTUsername string `json:"mqtt_username"`
+	MQTTPassword string `json:"mqtt_password"`
+	// prefix of the topics inserted values are published under
+	MQTTTopic string `json:"mqtt_topic"`
+	// prefix of the topics the bridge reads values to insert from
+	MQTTCommandTopic string `json:"mqtt_command_topic"`
+	// nodeid the bridge inserts values as, whose rights the ACLs decide
+	MQTTNodeid uint64 `json:"mqtt_nodeid"`
+	// pre-shared keys and HTTP tokens of nodes. If set, they replace the keys
+	// and tokens stored in the database on start and on every reload, so
+	// nodes left out lose theirs (reloadable)
+	Nodes []NodeConfig `json:"nodes"`
+}
+
+// NodeConfig holds the credentials of a node
+type NodeConfig struct {
+	Nodeid uint64 `json:"nodeid"`
+	// pre-shared key in hex, at least 16 bytes, or "" for no key
+	Key string `json:"key"`
+	// "authenticate" (the default) to accept authenticated or encrypted
+	// requests, or "encrypt" to only accept encrypted ones
+	Policy string `json:"policy"`
+	// bearer tokens for the HTTP gateway, at least 16 bytes each
+	Tokens []string `json:"tokens"`
+}
+
+// Duration is a time.Duration that is written as a string like "2s" in the
+// config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Duration %s is not a string (%s)", b, err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultConfig returns the settings used when neither the config file nor
+// the flags set a value
+func DefaultConfig() *Config {
+	return &Config{
+		DB:              "mpdb.db",
+		Listen:          []string{"[::]:7000"},
+		Timeout:         Duration(2 * time.Second),
+		WindowSize:      5,
+		LogLevel:        "INFO",
+		LogFormat:       "%{color}%{level} %{time:Jan 02 15:04:05} %{shortfile}%{color:reset} ▶ %{message}",
+		MaxDatagramSize: 1024,
+		MaxRequestSize:  4096,
+		MaxFrameSize:    1 << 20,
+		ShutdownTimeout: Duration(5 * time.Second),
+	}
+}
+
+// the settings in use. Holds a *Config, which is replaced as a whole on
+// reload so that client goroutines can read it without locking
+var currentConfig atomic.Value
+
+// returns the settings in use
+func getConfig() *Config {
+	if cfg, ok := currentConfig.Load().(*Config); ok {
+		return cfg
+	}
+	return DefaultConfig()
+}
+
+// LoadConfig reads the config file at [path] on top of the defaults. An empty
+// path only returns the defaults
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open config file (%s)", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("Could not parse config file %s (%s)", path, err)
+	}
+	return cfg, nil
+}
+
+// checks that the settings make sense
+func (cfg *Config) Validate() error {
+	if cfg.DB == "" {
+		return fmt.Errorf("No database file")
+	}
+	if len(cfg.Listen) == 0 {
+		return fmt.Errorf("No listen addresses")
+	}
+	if cfg.Timeout <= 0 {
+		return fmt.Errorf("Timeout must be positive")
+	}
+	if cfg.WindowSize == 0 {
+		return fmt.Errorf("Window size must be at least 1")
+	}
+	if _, err := logging.LogLevel(cfg.LogLevel); err != nil {
+		return fmt.Errorf("Invalid log level %s", cfg.LogLevel)
+	}
+	if cfg.MaxDatagramSize < 64 || cfg.MaxRequestSize < 64 {
+		return fmt.Errorf("Datagram sizes must be at least 64 bytes")
+	}
+	if cfg.MaxFrameSize < 64 {
+		return fmt.Errorf("Frame size must be at least 64 bytes")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return fmt.Errorf("Shutdown timeout must be positive")
+	}
+	if cfg.MaxClients < 0 {
+		return fmt.Errorf("Maximum number of clients cannot be negative")
+	}
+	if _, err := cfg.Credentials(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// returns the credentials of the nodes of [cfg], or nil if the config file
+// does not list any
+func (cfg *Config) Credentials() (map[uint64]mpdb.NodeCredentials, error) {
+	if cfg.Nodes == nil {
+		return nil, nil
+	}
+	var creds = make(map[uint64]mpdb.NodeCredentials, len(cfg.Nodes))
+	for _, node := range cfg.Nodes {
+		if _, found := creds[node.Nodeid]; found {
+			return nil, fmt.Errorf("Node %v is listed twice", node.Nodeid)
+		}
+		var cred = mpdb.NodeCredentials{Tokens: node.Tokens}
+		if node.Key != "" {
+			key, err := hex.DecodeString(node.Key)
+			if err != nil {
+				return nil, fmt.Errorf("Key of node %v is not hex (%s)", node.Nodeid, err)
+			}
+			cred.Key = key
+		}
+		switch node.Policy {
+		case "", "authenticate":
+			cred.Policy = mpdb.PolicyAuthenticate
+		case "encrypt":
+			cred.Policy = mpdb.PolicyEncrypt
+		default:
+			return nil, fmt.Errorf("Unknown policy %s for node %v", node.Policy, node.Nodeid)
+		}
+		if cred.Key == nil && node.Policy != "" {
+			return nil, fmt.Errorf("Node %v has a policy but no key", node.Nodeid)
+		}
+		if cred.Key != nil && len(cred.Key) < 16 {
+			return nil, fmt.Errorf("Key of node %v must be at least 16 bytes", node.Nodeid)
+		}
+		for _, token := range node.Tokens {
+			if len(token) < 16 {
+				return nil, fmt.Errorf("Tokens of node %v must be at least 16 bytes", node.Nodeid)
+			}
+		}
+		creds[node.Nodeid] = cred
+	}
+	return creds, nil
+}
+
+// replaces the credentials stored in [db] with those of [cfg], if it lists any
+func applyCredentials(db *mpdb.DB, cfg *Config) error {
+	creds, err := cfg.Credentials()
+	if err != nil || creds == nil {
+		return err
+	}
+	if err = db.SetCredentials(creds); err != nil {
+		return err
+	}
+	log.Notice("Applied credentials of %v nodes", len(creds))
+	return nil
+}
+
+// command-line flags. Each flag overrides the matching setting of the config
+// file if it is set
+var (
+	configFile     = flag.String("config", "", "JSON config file")
+	dbFlag         = flag.String("db", "mpdb.db", "database file")
+	listenFlag     = flag.String("listen", "[::]:7000", "comma-separated UDP addresses to listen on")
+	listenTCPFlag  = flag.String("listentcp", "", "comma-separated TCP addresses to listen on")
+	listenHTTPFlag = flag.String("listenhttp", "", "comma-separated addresses to serve the HTTP gateway on")
+	listenCoAPFlag = flag.String("listencoap", "", "comma-separated UDP addresses to serve CoAP on")
+	timeoutFlag    = flag.Duration("timeout", 2*time.Second, "resend timeout of clients")
+	windowFlag     = flag.Uint64("window", 5, "window size of clients")
+	logLevelFlag   = flag.String("loglevel", "INFO", "log level")
+	logFileFlag    = flag.String("logfile", "", "file to append the log to (default stderr)")
+	maxClientsFlag = flag.Int("maxclients", 0, "maximum number of clients (default no limit)")
+	mqttBrokerFlag = flag.String("mqtt", "", "address of the MQTT broker to bridge to (default no bridge)")
+)
+
+// reads the config file given on the command line and applies the flags that
+// were set on top of it
+func configFromFlags() (*Config, error) {
+	cfg, err := LoadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "db":
+			cfg.DB = *dbFlag
+		case "listen":
+			cfg.Listen = strings.Split(*listenFlag, ",")
+		case "listentcp":
+			cfg.ListenTCP = nil
+			if *listenTCPFlag != "" {
+				cfg.ListenTCP = strings.Split(*listenTCPFlag, ",")
+			}
+		case "listenhttp":
+			cfg.ListenHTTP = nil
+			if *listenHTTPFlag != "" {
+				cfg.ListenHTTP = strings.Split(*listenHTTPFlag, ",")
+			}
+		case "listencoap":
+			cfg.ListenCoAP = nil
+			if *listenCoAPFlag != "" {
+				cfg.ListenCoAP = strings.Split(*listenCoAPFlag, ",")
+			}
+		case "timeout":
+			cfg.Timeout = Duration(*timeoutFlag)
+		case "window":
+			cfg.WindowSize = *windowFlag
+		case "loglevel":
+			cfg.LogLevel = *logLevelFlag
+		case "logfile":
+			cfg.LogFile = *logFileFlag
+		case "maxclients":
+			cfg.MaxClients = *maxClientsFlag
+		case "mqtt":
+			cfg.MQTTBroker = *mqttBrokerFlag
+		}
+	})
+	return cfg, cfg.Validate()
+}
+
+// the log file currently open, if any
+var logFile *os.File
+
+// points the logger at the output, format and level of [cfg]
+func applyLogging(cfg *Config) error {
+	level, err := logging.LogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	formatter, err := logging.NewStringFormatter(cfg.LogFormat)
+	if err != nil {
+		return fmt.Errorf("Invalid log format (%s)", err)
+	}
+	var (
+		out io.Writer = os.Stderr
+		f   *os.File
+	)
+	if cfg.LogFile != "" {
+		if f, err = os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			return fmt.Errorf("Could not open log file (%s)", err)
+		}
+		out = f
+	}
+	backend := logging.AddModuleLevel(logging.NewBackendFormatter(logging.NewLogBackend(out, "", 0), formatter))
+	backend.SetLevel(level, "")
+	logging.SetBackend(backend)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
+}
+
+// returns the server options for serving [db] with the settings of [cfg]
+func (cfg *Config) Options(db *mpdb.DB) mpdb.Options {
+	return mpdb.Options{
+		DB:              db,
+		Listen:          cfg.Listen,
+		ListenTCP:       cfg.ListenTCP,
+		ListenHTTP:      cfg.ListenHTTP,
+		ListenCoAP:      cfg.ListenCoAP,
+		Timeout:         time.Duration(cfg.Timeout),
+		WindowSize:      cfg.WindowSize,
+		MaxDatagramSize: cfg.MaxDatagramSize,
+		MaxRequestSize:  cfg.MaxRequestSize,
+		MaxFrameSize:    cfg.MaxFrameSize,
+		MaxClients:      cfg.MaxClients,
+	}
+}
+
+// returns the options of the MQTT bridge of [db] with the settings of [cfg]
+func (cfg *Config) MQTTOptions(db *mpdb.DB) mpdb.MQTTOptions {
+	return mpdb.MQTTOptions{
+		DB:           db,
+		Broker:       cfg.MQTTBroker,
+		ClientID:     cfg.MQTTClientID,
+		Username:     cfg.MQTTUsername,
+		Password:     cfg.MQTTPassword,
+		Topic:        cfg.MQTTTopic,
+		CommandTopic: cfg.MQTTCommandTopic,
+		Nodeid:       cfg.MQTTNodeid,
+	}
+}
+
+// makes [cfg] the settings in use, passing them on to the server if it is
+// running
+func applyConfig(cfg *Config) error {
+	if err := applyLogging(cfg); err != nil {
+		return err
+	}
+	if server != nil {
+		if err := server.SetOptions(cfg.Options(nil)); err != nil {
+			return err
+		}
+	}
+	currentConfig.Store(cfg)
+	return nil
+}
+
+// reads the config file and flags again, and applies the settings that can
+// change at runtime. The previous settings stay in use if the new ones are
+// invalid
+func reloadConfig() {
+	cfg, err := configFromFlags()
+	if err != nil {
+		log.Error("Could not reload config (%v)", err)
+		return
+	}
+	old := getConfig()
+	if cfg.DB != old.DB || strings.Join(cfg.Listen, ",") != strings.Join(old.Listen, ",") ||
+		strings.Join(cfg.ListenTCP, ",") != strings.Join(old.ListenTCP, ",") ||
+		strings.Join(cfg.ListenHTTP, ",") != strings.Join(old.ListenHTTP, ",") ||
+		strings.Join(cfg.ListenCoAP, ",") != strings.Join(old.ListenCoAP, ",") {
+		log.Warning("Database and listen addresses cannot change at runtime; restart to apply them")
+		cfg.DB, cfg.Listen, cfg.ListenTCP, cfg.ListenHTTP = old.DB, old.Listen, old.ListenTCP, old.ListenHTTP
+		cfg.ListenCoAP = old.ListenCoAP
+	}
+	if cfg.MQTTOptions(nil) != old.MQTTOptions(nil) {
+		log.Warning("MQTT settings cannot change at runtime; restart to apply them")
+		cfg.MQTTBroker, cfg.MQTTClientID, cfg.MQTTUsername = old.MQTTBroker, old.MQTTClientID, old.MQTTUsername
+		cfg.MQTTPassword, cfg.MQTTTopic, cfg.MQTTCommandTopic = old.MQTTPassword, old.MQTTTopic, old.MQTTCommandTopic
+		cfg.MQTTNodeid = old.MQTTNodeid
+	}
+	if err = applyConfig(cfg); err != nil {
+		log.Error("Could not reload config (%v)", err)
+		return
+	}
+	if err = applyCredentials(database, cfg); err != nil {
+		log.Error("Could not apply credentials (%v)", err)
+		return
+	}
+	log.Notice("Reloaded config")
+}
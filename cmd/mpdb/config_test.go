@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/gtfierro/mpdb"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "mpdb-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"db": "other.db", "timeout": "500ms", "window_size": 8, "log_level": "DEBUG"}`)
+	f.Close()
+
+	cfg, err := LoadConfig(f.Name())
+	if err != nil {
+		t.Fatal("Could not load config", err)
+	}
+	if cfg.DB != "other.db" || time.Duration(cfg.Timeout) != 500*time.Millisecond || cfg.WindowSize != 8 || cfg.LogLevel != "DEBUG" {
+		t.Errorf("Settings from file were not applied: %+v", cfg)
+	}
+	if len(cfg.Listen) != 1 || cfg.Listen[0] != DefaultConfig().Listen[0] || cfg.MaxDatagramSize != DefaultConfig().MaxDatagramSize {
+		t.Errorf("Settings missing from file did not keep their defaults: %+v", cfg)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Error("Expected valid config but got", err)
+	}
+
+	for _, invalid := range []func(cfg *Config){
+		func(cfg *Config) { cfg.WindowSize = 0 },
+		func(cfg *Config) { cfg.Timeout = 0 },
+		func(cfg *Config) { cfg.LogLevel = "LOUD" },
+		func(cfg *Config) { cfg.MaxDatagramSize = 10 },
+		func(cfg *Config) { cfg.MaxFrameSize = 0 },
+		func(cfg *Config) { cfg.Nodes = []NodeConfig{{Nodeid: 1, Key: "not hex"}} },
+		func(cfg *Config) { cfg.Nodes = []NodeConfig{{Nodeid: 1, Key: "0011"}} },
+		func(cfg *Config) { cfg.Nodes = []NodeConfig{{Nodeid: 1, Policy: "encrypt"}} },
+		func(cfg *Config) { cfg.Nodes = []NodeConfig{{Nodeid: 1, Tokens: []string{"short"}}} },
+		func(cfg *Config) { cfg.Nodes = []NodeConfig{{Nodeid: 1}, {Nodeid: 1}} },
+	} {
+		cfg := DefaultConfig()
+		invalid(cfg)
+		if err = cfg.Validate(); err == nil {
+			t.Errorf("Expected error validating %+v", cfg)
+		}
+	}
+
+	f, _ = os.Create(f.Name())
+	f.WriteString(`{"nodes": [{"nodeid": 7, "key": "000102030405060708090a0b0c0d0e0f", "policy": "encrypt"},
+		{"nodeid": 8, "tokens": ["0123456789abcdef"]}]}`)
+	f.Close()
+	if cfg, err = LoadConfig(f.Name()); err != nil {
+		t.Fatal("Could not load config", err)
+	}
+	creds, err := cfg.Credentials()
+	if err != nil || len(creds) != 2 || len(creds[7].Key) != 16 || creds[7].Policy != mpdb.PolicyEncrypt ||
+		creds[8].Key != nil || len(creds[8].Tokens) != 1 {
+		t.Errorf("Unexpected credentials %v (%v)", creds, err)
+	}
+	if creds, err = DefaultConfig().Credentials(); err != nil || creds != nil {
+		t.Errorf("Expected no credentials without nodes, got %v (%v)", creds, err)
+	}
+
+	f, _ = os.Create(f.Name())
+	f.WriteString(`{"windowsize": 8}`)
+	f.Close()
+	if _, err = LoadConfig(f.Name()); err == nil {
+		t.Error("Expected error loading config with an unknown setting")
+	}
+}
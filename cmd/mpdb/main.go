@@ -0,0 +1,102 @@
+// License stuff
+
+// Command mpdb serves an MPDB database over UDP
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/gtfierro/mpdb"
+	"github.com/op/go-logging"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var log = logging.MustGetLogger("mpdb")
+
+// the running server and its database, which reloads pass the new settings
+// to
+var (
+	server   *mpdb.Server
+	database *mpdb.DB
+)
+
+func main() {
+	flag.Parse()
+	cfg, err := configFromFlags()
+	if err != nil {
+		log.Critical("Invalid configuration (%v)", err)
+		os.Exit(1)
+	}
+	if err = applyConfig(cfg); err != nil {
+		log.Critical("Invalid configuration (%v)", err)
+		os.Exit(1)
+	}
+
+	db := mpdb.NewDB(cfg.DB)
+	if db == nil {
+		os.Exit(1)
+	}
+	database = db
+	if err = applyCredentials(db, cfg); err != nil {
+		log.Critical("Could not apply credentials (%v)", err)
+		os.Exit(1)
+	}
+	if server, err = mpdb.NewServer(cfg.Options(db)); err != nil {
+		log.Critical("Could not create server (%v)", err)
+		os.Exit(1)
+	}
+	if err = server.Start(); err != nil {
+		log.Critical("Could not start server (%v)", err)
+		os.Exit(1)
+	}
+	var bridge *mpdb.MQTTBridge
+	if cfg.MQTTBroker != "" {
+		if bridge, err = mpdb.NewMQTTBridge(cfg.MQTTOptions(db)); err != nil {
+			log.Critical("Could not create MQTT bridge (%v)", err)
+			os.Exit(1)
+		}
+		if err = bridge.Start(); err != nil {
+			log.Critical("Could not start MQTT bridge (%v)", err)
+			os.Exit(1)
+		}
+	}
+
+	// reload the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig()
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Notice("Received %v, shutting down", <-sig)
+
+	// stop accepting datagrams, let the clients send their last responses and
+	// close the database. A second signal or the shutdown timeout forces the
+	// exit
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(getConfig().ShutdownTimeout))
+	defer cancel()
+	go func() {
+		s := <-sig
+		log.Critical("Received %v, exiting without draining", s)
+		os.Exit(1)
+	}()
+	if err = server.Stop(ctx); err != nil {
+		log.Critical("Shutdown timed out, exiting without draining")
+		os.Exit(1)
+	}
+	if bridge != nil {
+		if err = bridge.Stop(ctx); err != nil {
+			log.Critical("Shutdown timed out, exiting without draining")
+			os.Exit(1)
+		}
+	}
+	db.Close()
+	log.Notice("Shut down")
+}
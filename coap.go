@@ -0,0 +1,924 @@
+package mpdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The CoAP front-end (RFC 7252) lets constrained clients read and write keys
+// with standard CoAP libraries. It maps these resources onto the database:
+//
+//	/c/{collection}        GET the whole collection
+//	/c/{collection}/{key}  GET, PUT (or POST) and DELETE a key
+//	/p                     GET the persist bucket of the node
+//	/p/{key}               GET and PUT (or POST) a key in the persist bucket
+//
+// Payloads are CBOR (content format 60) or msgpack (65000, from the range
+// for experimental use), as chosen with the Content-Format and Accept
+// options. Keys can be observed (RFC 7641), and large responses are sent in
+// blocks (RFC 7959)
+
+// CoAP message types
+const (
+	coapCON = 0
+	coapNON = 1
+	coapACK = 2
+	coapRST = 3
+)
+
+// CoAP codes, with the class in the upper 3 bits and the detail in the lower 5
+const (
+	coapEmpty                    = 0x00
+	coapGET                      = 0x01
+	coapPOST                     = 0x02
+	coapPUT                      = 0x03
+	coapDELETE                   = 0x04
+	coapDeleted                  = 0x42 // 2.02
+	coapChanged                  = 0x44 // 2.04
+	coapContent                  = 0x45 // 2.05
+	coapBadRequest               = 0x80 // 4.00
+	coapUnauthorized             = 0x81 // 4.01
+	coapBadOption                = 0x82 // 4.02
+	coapForbidden                = 0x83 // 4.03
+	coapNotFound                 = 0x84 // 4.04
+	coapMethodNotAllowed         = 0x85 // 4.05
+	coapNotAcceptable            = 0x86 // 4.06
+	coapUnsupportedContentFormat = 0x8f // 4.15
+	coapInternalServerError      = 0xa0 // 5.00
+)
+
+// CoAP option numbers
+const (
+	coapOptUriHost       = 3
+	coapOptETag          = 4
+	coapOptObserve       = 6
+	coapOptUriPort       = 7
+	coapOptUriPath       = 11
+	coapOptContentFormat = 12
+	coapOptUriQuery      = 15
+	coapOptAccept        = 17
+	coapOptBlock2        = 23
+	coapOptSize2         = 28
+)
+
+// CoAP content formats
+const (
+	coapFormatCBOR    = 60
+	coapFormatMsgpack = 65000
+)
+
+const (
+	// how long the response to a request is kept, so that it can be resent if
+	// the request is retransmitted (EXCHANGE_LIFETIME)
+	coapExchangeLifetime = 247 * time.Second
+	// the size exponent of the blocks responses are split into, unless the
+	// client asks for smaller ones: 16 << 5 = 512 bytes
+	coapBlockSZX = 5
+	// the maximum number of observations, beyond which GET requests are
+	// served without registering the client
+	maxCoAPObservers = 1024
+)
+
+// a CoAP message
+type coapMessage struct {
+	Type      byte
+	Code      byte
+	MessageID uint16
+	Token     []byte
+	// sorted by number
+	Options []coapOption
+	Payload []byte
+}
+
+type coapOption struct {
+	Number uint16
+	Value  []byte
+}
+
+// an error with the response code it is reported with
+type coapError struct {
+	code byte
+	err  error
+}
+
+func (e *coapError) Error() string {
+	return e.err.Error()
+}
+
+func coapErrorf(code byte, format string, args ...interface{}) error {
+	return &coapError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// formats [code] as c.dd, e.g. 2.05
+func coapCodeString(code byte) string {
+	return fmt.Sprintf("%d.%02d", code>>5, code&0x1f)
+}
+
+// parses the CoAP message in [buf]
+func parseCoAP(buf []byte) (*coapMessage, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("CoAP message of %v bytes is shorter than its header", len(buf))
+	}
+	if version := buf[0] >> 6; version != 1 {
+		return nil, fmt.Errorf("Unsupported CoAP version %v", version)
+	}
+	msg := &coapMessage{Type: buf[0] >> 4 & 3, Code: buf[1], MessageID: binary.BigEndian.Uint16(buf[2:])}
+	tkl := int(buf[0] & 0xf)
+	if tkl > 8 || 4+tkl > len(buf) {
+		return nil, fmt.Errorf("Invalid CoAP token length %v", tkl)
+	}
+	msg.Token = buf[4 : 4+tkl]
+	if msg.Code == coapEmpty && len(buf) > 4 {
+		return nil, fmt.Errorf("Empty CoAP message with a token, options or payload")
+	}
+	var (
+		offset = 4 + tkl
+		number int
+	)
+	for offset < len(buf) {
+		if buf[offset] == 0xff {
+			msg.Payload = buf[offset+1:]
+			if len(msg.Payload) == 0 {
+				return nil, fmt.Errorf("CoAP payload marker without a payload")
+			}
+			break
+		}
+		delta, length := int(buf[offset]>>4), int(buf[offset]&0xf)
+		var err error
+		offset++
+		if delta, offset, err = parseCoAPNibble(buf, offset, delta); err != nil {
+			return nil, err
+		}
+		if length, offset, err = parseCoAPNibble(buf, offset, length); err != nil {
+			return nil, err
+		}
+		if number += delta; number > 0xffff {
+			return nil, fmt.Errorf("Invalid CoAP option number %v", number)
+		}
+		if offset+length > len(buf) {
+			return nil, fmt.Errorf("CoAP option %v is truncated", number)
+		}
+		msg.Options = append(msg.Options, coapOption{Number: uint16(number), Value: buf[offset : offset+length]})
+		offset += length
+	}
+	return msg, nil
+}
+
+// returns the option delta or length encoded by [nibble] and the bytes
+// following it at [offset], along with the offset after them
+func parseCoAPNibble(buf []byte, offset, nibble int) (int, int, error) {
+	switch nibble {
+	case 13:
+		if offset+1 > len(buf) {
+			return 0, 0, fmt.Errorf("CoAP option header is truncated")
+		}
+		return int(buf[offset]) + 13, offset + 1, nil
+	case 14:
+		if offset+2 > len(buf) {
+			return 0, 0, fmt.Errorf("CoAP option header is truncated")
+		}
+		return int(binary.BigEndian.Uint16(buf[offset:])) + 269, offset + 2, nil
+	case 15:
+		return 0, 0, fmt.Errorf("Invalid CoAP option header")
+	default:
+		return nibble, offset, nil
+	}
+}
+
+// appends the encoding of [msg] to [output]
+func (msg *coapMessage) marshal(output *[]byte) {
+	*output = append(*output, 1<<6|msg.Type<<4|byte(len(msg.Token)), msg.Code,
+		byte(msg.MessageID>>8), byte(msg.MessageID))
+	*output = append(*output, msg.Token...)
+	sort.SliceStable(msg.Options, func(i, j int) bool { return msg.Options[i].Number < msg.Options[j].Number })
+	var last int
+	for _, opt := range msg.Options {
+		head := len(*output)
+		*output = append(*output, 0)
+		delta := appendCoAPNibble(output, int(opt.Number)-last)
+		length := appendCoAPNibble(output, len(opt.Value))
+		(*output)[head] = delta<<4 | length
+		*output = append(*output, opt.Value...)
+		last = int(opt.Number)
+	}
+	if len(msg.Payload) > 0 {
+		*output = append(*output, 0xff)
+		*output = append(*output, msg.Payload...)
+	}
+}
+
+// the inverse of parseCoAPNibble: appends the extended bytes for [value] to
+// [output] and returns the nibble
+func appendCoAPNibble(output *[]byte, value int) byte {
+	switch {
+	case value < 13:
+		return byte(value)
+	case value < 269:
+		*output = append(*output, byte(value-13))
+		return 13
+	default:
+		*output = append(*output, byte((value-269)>>8), byte(value-269))
+		return 14
+	}
+}
+
+// returns the first value of option [number]
+func (msg *coapMessage) option(number uint16) ([]byte, bool) {
+	for _, opt := range msg.Options {
+		if opt.Number == number {
+			return opt.Value, true
+		}
+	}
+	return nil, false
+}
+
+// returns the first value of option [number], which holds an unsigned integer
+func (msg *coapMessage) optionUint(number uint16) (uint32, bool) {
+	value, found := msg.option(number)
+	if !found || len(value) > 4 {
+		return 0, false
+	}
+	var u uint32
+	for _, b := range value {
+		u = u<<8 | uint32(b)
+	}
+	return u, true
+}
+
+func (msg *coapMessage) addOption(number uint16, value []byte) {
+	msg.Options = append(msg.Options, coapOption{Number: number, Value: value})
+}
+
+// adds option [number] holding [value] in as few bytes as possible
+func (msg *coapMessage) addOptionUint(number uint16, value uint32) {
+	var buf []byte
+	for ; value > 0; value >>= 8 {
+		buf = append([]byte{byte(value)}, buf...)
+	}
+	msg.addOption(number, buf)
+}
+
+// returns the segments of the Uri-Path options
+func (msg *coapMessage) path() []string {
+	var segments []string
+	for _, opt := range msg.Options {
+		if opt.Number == coapOptUriPath {
+			segments = append(segments, string(opt.Value))
+		}
+	}
+	return segments
+}
+
+// the response to a request, kept so that it can be resent if the request is
+// retransmitted
+type coapExchange struct {
+	// nil while the request is executed
+	response []byte
+	expires  time.Time
+}
+
+// a resource that can be observed: a key in a collection or in the persist
+// bucket of a node
+type coapResource struct {
+	// set for keys in the persist bucket of a node
+	persist bool
+	// the collection of the key, or the nodeid for persist keys
+	collection string
+	key        string
+}
+
+// returns true if [change] is a change to [res]
+func (res coapResource) match(change Change) bool {
+	if change.Persist != res.persist || change.Collection != res.collection {
+		return false
+	}
+	if res.persist {
+		return change.Key == res.key
+	}
+	return change.Key == joinKey(res.collection, res.key)
+}
+
+// a client observing a resource
+type coapObserver struct {
+	conn   *net.UDPConn
+	addr   *net.UDPAddr
+	token  []byte
+	res    coapResource
+	format uint16
+	// message id of the last notification, which the client can reject to
+	// cancel the observation. Guarded by observersLock
+	msgID uint16
+}
+
+// the state of the CoAP listeners of a server
+type coapState struct {
+	// message id of the last message the server sent on its own, i.e. NON
+	// responses and notifications
+	msgID uint32
+	// responses to recent requests, keyed by address and message id
+	exchanges     map[string]*coapExchange
+	lastPrune     time.Time
+	exchangesLock sync.Mutex
+	// keyed by address and token
+	observers     map[string]*coapObserver
+	observersLock sync.Mutex
+}
+
+// returns a message id for a message the server sends on its own
+func (s *Server) nextCoAPMessageID() uint16 {
+	return uint16(atomic.AddUint32(&s.coap.msgID, 1))
+}
+
+// handles the CoAP messages arriving on [conn] until the server stops
+// listening
+func (s *Server) serveCoAP(conn *net.UDPConn) {
+	s.log.Notice("Serving CoAP on %v", conn.LocalAddr())
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-s.listenCtx.Done():
+			// unblock the read below
+			conn.SetReadDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
+
+	for {
+		buf := make([]byte, s.options().MaxRequestSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if s.listenCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.log.Error("Problem reading connection %v", err)
+			continue
+		}
+		s.handleCoAP(conn, addr, buf[:n])
+	}
+}
+
+// handles the CoAP message in [buf] from [addr]. Requests are answered with a
+// piggybacked ACK if they are confirmable, and with a NON response otherwise
+func (s *Server) handleCoAP(conn *net.UDPConn, addr *net.UDPAddr, buf []byte) {
+	msg, err := parseCoAP(buf)
+	if err != nil {
+		s.log.Warning("Could not decode CoAP message from %v (%v)", addr, err)
+		// malformed confirmable messages are rejected
+		if len(buf) >= 4 && buf[0]>>6 == 1 && buf[0]>>4&3 == coapCON {
+			s.writeCoAP(conn, addr, &coapMessage{Type: coapRST, MessageID: binary.BigEndian.Uint16(buf[2:])})
+		}
+		return
+	}
+	switch {
+	case msg.Type == coapRST:
+		s.cancelCoAPObserver(addr, msg.MessageID)
+		return
+	case msg.Type == coapACK:
+		return
+	case msg.Code == coapEmpty || msg.Code>>5 != 0:
+		// pings, and responses we did not ask for
+		if msg.Type == coapCON {
+			s.writeCoAP(conn, addr, &coapMessage{Type: coapRST, MessageID: msg.MessageID})
+		}
+		return
+	}
+
+	exchange := addr.String() + "/" + strconv.Itoa(int(msg.MessageID))
+	if !s.beginCoAPExchange(conn, addr, exchange) {
+		return
+	}
+	resp := s.coapRequest(conn, addr, msg)
+	resp.Token = msg.Token
+	if msg.Type == coapCON {
+		resp.Type, resp.MessageID = coapACK, msg.MessageID
+	} else {
+		resp.Type, resp.MessageID = coapNON, s.nextCoAPMessageID()
+	}
+	response := s.writeCoAP(conn, addr, resp)
+	s.coap.exchangesLock.Lock()
+	if ex, found := s.coap.exchanges[exchange]; found {
+		ex.response = response
+	}
+	s.coap.exchangesLock.Unlock()
+}
+
+// records the start of [exchange]. Returns false if the request was already
+// received, in which case its response is resent if it was already sent
+func (s *Server) beginCoAPExchange(conn *net.UDPConn, addr *net.UDPAddr, exchange string) bool {
+	s.coap.exchangesLock.Lock()
+	defer s.coap.exchangesLock.Unlock()
+	now := time.Now()
+	if now.Sub(s.coap.lastPrune) > time.Minute {
+		for key, ex := range s.coap.exchanges {
+			if now.After(ex.expires) {
+				delete(s.coap.exchanges, key)
+			}
+		}
+		s.coap.lastPrune = now
+	}
+	if ex, found := s.coap.exchanges[exchange]; found && now.Before(ex.expires) {
+		s.log.Debug("received duplicate CoAP message %v", exchange)
+		if ex.response != nil {
+			if _, err := conn.WriteToUDP(ex.response, addr); err != nil {
+				s.log.Error("Error writing to client %v (%v)", addr, err)
+			}
+		}
+		return false
+	}
+	s.coap.exchanges[exchange] = &coapExchange{expires: now.Add(coapExchangeLifetime)}
+	return true
+}
+
+// sends [msg] to [addr] and returns its encoding
+func (s *Server) writeCoAP(conn *net.UDPConn, addr *net.UDPAddr, msg *coapMessage) []byte {
+	var buf []byte
+	msg.marshal(&buf)
+	if _, err := conn.WriteToUDP(buf, addr); err != nil {
+		s.log.Error("Error writing to client %v (%v)", addr, err)
+	}
+	return buf
+}
+
+// executes [req] from [addr] and returns the response, without its type,
+// message id and token
+func (s *Server) coapRequest(conn *net.UDPConn, addr *net.UDPAddr, req *coapMessage) *coapMessage {
+	resp := &coapMessage{}
+	code, value, err := s.coapExecute(conn, addr, req, resp)
+	if err == nil && code == coapContent {
+		format, _ := coapFormat(req, coapOptAccept)
+		var payload []byte
+		if payload, err = encodeCoAPValue(format, value); err == nil {
+			resp.addOptionUint(coapOptContentFormat, uint32(format))
+			err = s.coapBlock(req, resp, payload)
+		}
+	}
+	if err != nil {
+		code = coapInternalServerError
+		if cerr, ok := err.(*coapError); ok {
+			code = cerr.code
+		}
+		s.log.Warning("CoAP %v /%v from %v failed with %v (%v)", coapCodeString(req.Code),
+			strings.Join(req.path(), "/"), addr, coapCodeString(code), err)
+		// the response carries a diagnostic message instead
+		resp.Options, resp.Payload = nil, []byte(err.Error())
+	}
+	resp.Code = code
+	return resp
+}
+
+// routes [req] to its resource and executes it. Returns the response code and
+// the value to send for 2.05 responses. Options can be added to [resp]
+func (s *Server) coapExecute(conn *net.UDPConn, addr *net.UDPAddr, req *coapMessage, resp *coapMessage) (byte, interface{}, error) {
+	for _, opt := range req.Options {
+		switch opt.Number {
+		case coapOptUriHost, coapOptUriPort, coapOptUriPath, coapOptUriQuery, coapOptAccept, coapOptBlock2:
+		default:
+			// unknown critical options have odd numbers
+			if opt.Number&1 == 1 {
+				return 0, nil, coapErrorf(coapBadOption, "Unsupported option %v", opt.Number)
+			}
+		}
+	}
+	if _, err := coapFormat(req, coapOptAccept); err != nil {
+		return 0, nil, err
+	}
+	if _, err := coapFormat(req, coapOptContentFormat); err != nil {
+		return 0, nil, err
+	}
+	p, err := s.coapPeer(addr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		segments = req.path()
+		res      coapResource
+	)
+	switch {
+	case len(segments) == 2 && segments[0] == "c":
+		if req.Code != coapGET {
+			return 0, nil, coapErrorf(coapMethodNotAllowed, "Method %v not allowed", coapCodeString(req.Code))
+		}
+		return s.coapCollection(p, segments[1])
+	case len(segments) == 1 && segments[0] == "p":
+		if req.Code != coapGET {
+			return 0, nil, coapErrorf(coapMethodNotAllowed, "Method %v not allowed", coapCodeString(req.Code))
+		}
+		if err = s.checkAccess(p, "GETPERSIST", nil, nil, ""); err != nil {
+			return 0, nil, &coapError{code: coapForbidden, err: err}
+		}
+		values, err := s.db.GetPersist(strconv.FormatUint(p.nodeid, 10), nil)
+		if err != nil {
+			// the node has not persisted anything yet
+			values = make(map[string]interface{})
+		}
+		return coapContent, values, nil
+	case len(segments) == 3 && segments[0] == "c":
+		if !validCollectionName(segments[1]) {
+			return 0, nil, coapErrorf(coapBadRequest, "Invalid collection name %s", segments[1])
+		}
+		res = coapResource{collection: segments[1], key: segments[2]}
+	case len(segments) == 2 && segments[0] == "p":
+		res = coapResource{persist: true, collection: strconv.FormatUint(p.nodeid, 10), key: segments[1]}
+	default:
+		return 0, nil, coapErrorf(coapNotFound, "No resource at /%s", strings.Join(segments, "/"))
+	}
+
+	switch req.Code {
+	case coapGET:
+		return s.coapGet(conn, addr, p, req, resp, res)
+	case coapPUT, coapPOST:
+		value, err := decodeCoAPValue(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		if res.persist {
+			err = s.checkAccess(p, "PERSIST", nil, nil, "")
+			if err == nil {
+				return coapChanged, nil, s.db.Persist(res.collection, map[string]interface{}{res.key: value})
+			}
+		} else {
+			// the collection is always spelled out, so that keys in the global
+			// collection can contain periods
+			data := map[string]interface{}{res.collection + "." + res.key: value}
+			err = s.checkAccess(p, "INSERT", nil, data, "")
+			if err == nil {
+				return coapChanged, nil, s.db.InsertFrom(strconv.FormatUint(p.nodeid, 10), data)
+			}
+		}
+		return 0, nil, &coapError{code: coapForbidden, err: err}
+	case coapDELETE:
+		if res.persist {
+			return 0, nil, coapErrorf(coapMethodNotAllowed, "Keys cannot be deleted from persist buckets")
+		}
+		keys := []string{res.collection + "." + res.key}
+		if err = s.checkAccess(p, "DELETE", keys, nil, ""); err != nil {
+			return 0, nil, &coapError{code: coapForbidden, err: err}
+		}
+		return coapDeleted, nil, s.db.DeleteFrom(strconv.FormatUint(p.nodeid, 10), keys)
+	default:
+		return 0, nil, coapErrorf(coapMethodNotAllowed, "Method %v not allowed", coapCodeString(req.Code))
+	}
+}
+
+// returns the node that requests from [addr] are made on behalf of
+func (s *Server) coapPeer(addr *net.UDPAddr) (*peer, error) {
+	p := &peer{ip: addr.IP}
+	s.resolve(p)
+	// CoAP requests carry no envelopes, so nodes with a key have to use the
+	// msgpack protocol
+	nk, err := s.db.getNodeKey(p.nodeid)
+	if err != nil {
+		return nil, err
+	}
+	if p.identityErr == nil && nk != nil {
+		return nil, coapErrorf(coapUnauthorized, "Node %v requires authenticated requests", p.nodeid)
+	}
+	return p, nil
+}
+
+// GET /c/{collection}. The keys of the returned map are not prefixed with the
+// collection
+func (s *Server) coapCollection(p *peer, collection string) (byte, interface{}, error) {
+	if !validCollectionName(collection) {
+		return 0, nil, coapErrorf(coapBadRequest, "Invalid collection name %s", collection)
+	}
+	if err := s.checkAccess(p, "GETBUCKET", nil, nil, collection); err != nil {
+		return 0, nil, &coapError{code: coapForbidden, err: err}
+	}
+	values, err := s.db.GetBucket(collection)
+	if err != nil {
+		return 0, nil, coapErrorf(coapNotFound, "Collection %s does not exist", collection)
+	}
+	if collection == "global" {
+		return coapContent, values, nil
+	}
+	res := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		res[strings.TrimPrefix(k, collection+".")] = v
+	}
+	return coapContent, res, nil
+}
+
+// GET of a key, which registers the client as an observer of the key if the
+// request has an Observe option of 0, and deregisters it if it is 1
+func (s *Server) coapGet(conn *net.UDPConn, addr *net.UDPAddr, p *peer, req *coapMessage, resp *coapMessage, res coapResource) (byte, interface{}, error) {
+	observe, observing := req.optionUint(coapOptObserve)
+	observerKey := addr.String() + "/" + string(req.Token)
+	if observing && observe == 1 {
+		s.removeCoAPObserver(observerKey, nil)
+		observing = false
+	}
+	var o *coapObserver
+	if observing && observe == 0 {
+		format, _ := coapFormat(req, coapOptAccept)
+		o = &coapObserver{conn: conn, addr: addr, token: append([]byte(nil), req.Token...), res: res, format: format}
+		if !s.addCoAPObserver(observerKey, o) {
+			s.log.Warning("Not registering observer %v: already serving %v observers", addr, maxCoAPObservers)
+			o = nil
+		}
+	}
+	// the observer is registered before the value is read, so that it is
+	// notified of any change made after the read
+	revision, err := s.db.Revision()
+	var (
+		value interface{}
+		found bool
+	)
+	if err == nil {
+		value, found, err = s.coapRead(p, res)
+	}
+	if err == nil && !found {
+		err = coapErrorf(coapNotFound, "Key %s does not exist", res.key)
+	}
+	if err != nil {
+		if o != nil {
+			s.removeCoAPObserver(observerKey, o)
+		}
+		return 0, nil, err
+	}
+	if o != nil {
+		resp.addOptionUint(coapOptObserve, uint32(revision&0xffffff))
+	}
+	return coapContent, value, nil
+}
+
+// reads the value of [res] on behalf of [p]. [found] is false if it does not
+// have a value
+func (s *Server) coapRead(p *peer, res coapResource) (value interface{}, found bool, err error) {
+	if res.persist {
+		if err = s.checkAccess(p, "GETPERSIST", nil, nil, ""); err == nil && strconv.FormatUint(p.nodeid, 10) != res.collection {
+			err = fmt.Errorf("Node %v cannot access data with nodeid %v", p.nodeid, res.collection)
+		}
+		if err != nil {
+			return nil, false, &coapError{code: coapForbidden, err: err}
+		}
+		values, err := s.db.GetPersist(res.collection, []string{res.key})
+		if err != nil || values[res.key] == nil {
+			return nil, false, nil
+		}
+		return values[res.key], true, nil
+	}
+	fullkey := res.collection + "." + res.key
+	if err = s.checkAccess(p, "GET", []string{fullkey}, nil, ""); err != nil {
+		return nil, false, &coapError{code: coapForbidden, err: err}
+	}
+	values, err := s.db.Get([]string{fullkey})
+	value = values[joinKey(res.collection, res.key)]
+	if err != nil || value == nil {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+// sets the payload of [resp] to [payload], or to the block of it that [req]
+// asks for if it is too long for a single datagram
+func (s *Server) coapBlock(req *coapMessage, resp *coapMessage, payload []byte) error {
+	szx := uint32(coapBlockSZX)
+	// leave room for the header and options
+	for szx > 0 && 16<<szx+64 > s.options().MaxDatagramSize {
+		szx--
+	}
+	var num uint32
+	block2, found := req.optionUint(coapOptBlock2)
+	if found {
+		if block2&7 == 7 {
+			return coapErrorf(coapBadRequest, "Invalid block size")
+		}
+		num = block2 >> 4
+		if block2&7 < szx {
+			szx = block2 & 7
+		}
+	}
+	size := 16 << szx
+	if !found && len(payload) <= size {
+		resp.Payload = payload
+		return nil
+	}
+	start := int(num) * size
+	if start >= len(payload) && num > 0 {
+		return coapErrorf(coapBadOption, "Block %v is past the end of the response", num)
+	}
+	end := start + size
+	var more uint32
+	if end < len(payload) {
+		more = 1
+	} else {
+		end = len(payload)
+	}
+	resp.addOptionUint(coapOptBlock2, num<<4|more<<3|szx)
+	resp.addOptionUint(coapOptSize2, uint32(len(payload)))
+	// lets the client check that all blocks are of the same representation
+	h := fnv.New64a()
+	h.Write(payload)
+	resp.addOption(coapOptETag, h.Sum(nil))
+	resp.Payload = payload[start:end]
+	return nil
+}
+
+// returns the content format named by option [number] of [req], which
+// defaults to CBOR
+func coapFormat(req *coapMessage, number uint16) (uint16, error) {
+	format, found := req.optionUint(number)
+	switch {
+	case !found:
+		return coapFormatCBOR, nil
+	case format == coapFormatCBOR || format == coapFormatMsgpack:
+		return uint16(format), nil
+	case number == coapOptAccept:
+		return 0, coapErrorf(coapNotAcceptable, "Unsupported content format %v", format)
+	default:
+		return 0, coapErrorf(coapUnsupportedContentFormat, "Unsupported content format %v", format)
+	}
+}
+
+// encodes [value] in content format [format]
+func encodeCoAPValue(format uint16, value interface{}) ([]byte, error) {
+	var buf []byte
+	if format == coapFormatMsgpack {
+		return buf, encode(&buf, value)
+	}
+	return buf, encodeCBOR(&buf, value)
+}
+
+// decodes the value in the payload of [req], which has to be a single
+// integer or string
+func decodeCoAPValue(req *coapMessage) (interface{}, error) {
+	if len(req.Payload) == 0 {
+		return nil, coapErrorf(coapBadRequest, "Missing value")
+	}
+	var (
+		value    interface{}
+		consumed int
+		err      error
+	)
+	if format, _ := coapFormat(req, coapOptContentFormat); format == coapFormatMsgpack {
+		value, consumed, err = decode(&req.Payload, 0)
+	} else {
+		value, consumed, err = decodeCBOR(req.Payload, 0)
+	}
+	if err != nil {
+		return nil, &coapError{code: coapBadRequest, err: err}
+	}
+	if consumed != len(req.Payload) {
+		return nil, coapErrorf(coapBadRequest, "Payload must hold a single value")
+	}
+	switch value.(type) {
+	case uint64, int64, string:
+		return value, nil
+	default:
+		return nil, coapErrorf(coapBadRequest, "Unsupported value type %T", value)
+	}
+}
+
+// registers [o] under [key], replacing any observation with the same address
+// and token. Returns false if there are too many observers
+func (s *Server) addCoAPObserver(key string, o *coapObserver) bool {
+	s.coap.observersLock.Lock()
+	defer s.coap.observersLock.Unlock()
+	if _, found := s.coap.observers[key]; !found && len(s.coap.observers) >= maxCoAPObservers {
+		return false
+	}
+	s.coap.observers[key] = o
+	return true
+}
+
+// removes the observer registered under [key], if it is [o] or [o] is nil
+func (s *Server) removeCoAPObserver(key string, o *coapObserver) {
+	s.coap.observersLock.Lock()
+	defer s.coap.observersLock.Unlock()
+	if current, found := s.coap.observers[key]; found && (o == nil || current == o) {
+		delete(s.coap.observers, key)
+	}
+}
+
+// removes the observer at [addr] that was sent the notification with message
+// id [msgID], which the client rejected
+func (s *Server) cancelCoAPObserver(addr *net.UDPAddr, msgID uint16) {
+	s.coap.observersLock.Lock()
+	defer s.coap.observersLock.Unlock()
+	for key, o := range s.coap.observers {
+		if o.msgID == msgID && o.addr.String() == addr.String() {
+			s.log.Debug("client %v cancelled observation of %v", addr, o.res.key)
+			delete(s.coap.observers, key)
+		}
+	}
+}
+
+// sends notifications to the observers of the keys changed by each commit,
+// until the server stops listening
+func (s *Server) notifyCoAPObservers() {
+	revision, err := s.db.Revision()
+	if err != nil {
+		s.log.Error("Could not read revision for CoAP observers (%v)", err)
+	}
+	for {
+		changed := s.db.Changed()
+		sets, err := s.db.ChangesSince(revision, streamPageSize)
+		if err == ErrChangesPruned {
+			// some changes were missed, so every observer is sent the current
+			// value of its key
+			if revision, err = s.db.Revision(); err == nil {
+				s.notifyCoAPObserversOf(revision, func(coapResource) bool { return true })
+				continue
+			}
+		}
+		if err != nil {
+			s.log.Error("Could not read changes for CoAP observers (%v)", err)
+		}
+		for _, set := range sets {
+			changes := set.Changes
+			s.notifyCoAPObserversOf(set.Revision, func(res coapResource) bool {
+				for _, change := range changes {
+					if res.match(change) {
+						return true
+					}
+				}
+				return false
+			})
+			revision = set.Revision
+		}
+		if len(sets) == streamPageSize {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-s.listenCtx.Done():
+			return
+		}
+	}
+}
+
+// notifies the observers of the resources selected by [match] of their value
+// as of [revision]
+func (s *Server) notifyCoAPObserversOf(revision uint64, match func(coapResource) bool) {
+	var selected = make(map[string]*coapObserver)
+	s.coap.observersLock.Lock()
+	for key, o := range s.coap.observers {
+		if match(o.res) {
+			selected[key] = o
+		}
+	}
+	s.coap.observersLock.Unlock()
+	for key, o := range selected {
+		s.notifyCoAPObserver(key, o, revision)
+	}
+}
+
+// sends [o] the current value of the resource it observes. Access is checked
+// again, as the ACLs or the identity of the client may have changed. An
+// error ends the observation
+func (s *Server) notifyCoAPObserver(key string, o *coapObserver, revision uint64) {
+	msg := &coapMessage{Type: coapNON, Code: coapContent, Token: o.token}
+	p, err := s.coapPeer(o.addr)
+	var (
+		value interface{}
+		found bool
+	)
+	if err == nil {
+		value, found, err = s.coapRead(p, o.res)
+	}
+	if err == nil && !found {
+		err = coapErrorf(coapNotFound, "Key %s was deleted", o.res.key)
+	}
+	if err == nil {
+		var payload []byte
+		if payload, err = encodeCoAPValue(o.format, value); err == nil {
+			msg.addOptionUint(coapOptObserve, uint32(revision&0xffffff))
+			msg.addOptionUint(coapOptContentFormat, uint32(o.format))
+			// notifications too long for one datagram carry the first block,
+			// and the client fetches the rest with GET
+			err = s.coapBlock(&coapMessage{}, msg, payload)
+		}
+	}
+	if err != nil {
+		msg.Code = coapInternalServerError
+		if cerr, ok := err.(*coapError); ok {
+			msg.Code = cerr.code
+		}
+		msg.Options, msg.Payload = nil, []byte(err.Error())
+		s.removeCoAPObserver(key, o)
+	}
+	s.coap.observersLock.Lock()
+	msg.MessageID = s.nextCoAPMessageID()
+	o.msgID = msg.MessageID
+	s.coap.observersLock.Unlock()
+	s.writeCoAP(o.conn, o.addr, msg)
+}
+
+// starts the message ids of a server at a random value, so that they do not
+// collide with the ones used before a restart
+func newCoAPState() *coapState {
+	return &coapState{msgID: rand.Uint32(), exchanges: make(map[string]*coapExchange),
+		observers: make(map[string]*coapObserver)}
+}
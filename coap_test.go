@@ -0,0 +1,304 @@
+package mpdb
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCBOR(t *testing.T) {
+	for _, vector := range []struct {
+		value   interface{}
+		encoded []byte
+	}{
+		{uint64(0), []byte{0x00}},
+		{uint64(23), []byte{0x17}},
+		{uint64(24), []byte{0x18, 0x18}},
+		{uint64(1000), []byte{0x19, 0x03, 0xe8}},
+		{uint64(1000000), []byte{0x1a, 0x00, 0x0f, 0x42, 0x40}},
+		{uint64(1 << 40), []byte{0x1b, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{int64(-1), []byte{0x20}},
+		{int64(-1000), []byte{0x39, 0x03, 0xe7}},
+		{"", []byte{0x60}},
+		{"IETF", []byte{0x64, 0x49, 0x45, 0x54, 0x46}},
+	} {
+		var buf []byte
+		if err := encodeCBOR(&buf, vector.value); err != nil || !bytes.Equal(buf, vector.encoded) {
+			t.Errorf("Encoded %#v as %x (%v), expected %x", vector.value, buf, err, vector.encoded)
+		}
+		value, consumed, err := decodeCBOR(vector.encoded, 0)
+		if err != nil || value != vector.value || consumed != len(vector.encoded) {
+			t.Errorf("Decoded %x as %#v using %v bytes (%v)", vector.encoded, value, consumed, err)
+		}
+	}
+
+	var buf []byte
+	encodeCBOR(&buf, map[string]interface{}{"b": int(-2), "a": nil, "c": []string{"x"}})
+	if expected := []byte{0xa3, 0x61, 'a', 0xf6, 0x61, 'b', 0x21, 0x61, 'c', 0x81, 0x61, 'x'}; !bytes.Equal(buf, expected) {
+		t.Errorf("Encoded map as %x, expected %x", buf, expected)
+	}
+	for _, input := range [][]byte{{}, {0x18}, {0x64, 0x49}, {0xa0}, {0xf9, 0x00, 0x00}, {0x1c}} {
+		if value, _, err := decodeCBOR(input, 0); err == nil {
+			t.Errorf("Expected error decoding %x, got %#v", input, value)
+		}
+	}
+}
+
+func TestCoAPMessage(t *testing.T) {
+	msg := &coapMessage{Type: coapCON, Code: coapPUT, MessageID: 0x1234, Token: []byte{1, 2}}
+	msg.addOption(coapOptUriPath, []byte("c"))
+	msg.addOption(coapOptUriPath, []byte("a long segment that needs an extended length"))
+	msg.addOptionUint(coapOptContentFormat, coapFormatMsgpack)
+	msg.addOption(300, []byte{7})
+	msg.addOptionUint(coapOptObserve, 0)
+	msg.Payload = []byte{0x01}
+	var buf []byte
+	msg.marshal(&buf)
+
+	parsed, err := parseCoAP(buf)
+	if err != nil {
+		t.Fatal("Could not parse message", err)
+	}
+	if parsed.Type != coapCON || parsed.Code != coapPUT || parsed.MessageID != 0x1234 ||
+		!bytes.Equal(parsed.Token, msg.Token) || !bytes.Equal(parsed.Payload, msg.Payload) {
+		t.Errorf("Unexpected message %+v", parsed)
+	}
+	if path := parsed.path(); len(path) != 2 || path[1] != "a long segment that needs an extended length" {
+		t.Errorf("Unexpected path %v", path)
+	}
+	if format, _ := parsed.optionUint(coapOptContentFormat); format != coapFormatMsgpack {
+		t.Errorf("Unexpected content format %v", format)
+	}
+	if observe, found := parsed.optionUint(coapOptObserve); !found || observe != 0 {
+		t.Errorf("Unexpected observe option %v", observe)
+	}
+	if value, _ := parsed.option(300); !bytes.Equal(value, []byte{7}) {
+		t.Errorf("Unexpected value %v of option 300", value)
+	}
+
+	for _, input := range [][]byte{{0x40, 0x01}, {0x80, 0x01, 0, 0}, {0x49, 0x01, 0, 0}, {0x40, 0x01, 0, 0, 0xff},
+		{0x40, 0x01, 0, 0, 0xf0}, {0x40, 0x01, 0, 0, 0xb3, 'c'}, {0x41, 0x00, 0, 0, 1}} {
+		if _, err := parseCoAP(input); err == nil {
+			t.Errorf("Expected error parsing %x", input)
+		}
+	}
+}
+
+// sends [req] to [conn] and returns the response
+func coapExchangeTest(t *testing.T, conn net.Conn, req *coapMessage) *coapMessage {
+	var buf []byte
+	req.marshal(&buf)
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	return readCoAP(t, conn)
+}
+
+// reads the next message from [conn]
+func readCoAP(t *testing.T, conn net.Conn) *coapMessage {
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal("Did not receive CoAP message", err)
+	}
+	msg, err := parseCoAP(buf[:n])
+	if err != nil {
+		t.Fatal("Could not parse CoAP message", err)
+	}
+	return msg
+}
+
+// returns a request for [path] with the next message id
+func coapTestRequest(typ, code byte, id *uint16, path string, payload []byte) *coapMessage {
+	*id++
+	req := &coapMessage{Type: typ, Code: code, MessageID: *id, Token: []byte{byte(*id)}, Payload: payload}
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		req.addOption(coapOptUriPath, []byte(segment))
+	}
+	return req
+}
+
+func TestServeCoAP(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db, Listen: []string{"127.0.0.1:0"}, ListenCoAP: []string{"127.0.0.1:0"},
+		MaxDatagramSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal("Could not start server", err)
+	}
+	addrs := s.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Expected a UDP and a CoAP listener, got %v", addrs)
+	}
+	conn, err := net.Dial("udp", addrs[1].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var id uint16
+
+	// PUT in CBOR and msgpack
+	var value []byte
+	encodeCBOR(&value, int64(-5))
+	if resp := coapExchangeTest(t, conn, coapTestRequest(coapCON, coapPUT, &id, "/c/coap/a", value)); resp.Type != coapACK || resp.Code != coapChanged || resp.MessageID != id {
+		t.Errorf("Unexpected response %+v to PUT", resp)
+	}
+	value = nil
+	encode(&value, "text")
+	req := coapTestRequest(coapNON, coapPUT, &id, "/c/coap/b", value)
+	req.addOptionUint(coapOptContentFormat, coapFormatMsgpack)
+	if resp := coapExchangeTest(t, conn, req); resp.Type != coapNON || resp.Code != coapChanged || !bytes.Equal(resp.Token, req.Token) {
+		t.Errorf("Unexpected response %+v to PUT", resp)
+	}
+	if values, _ := db.Get([]string{"coap.a", "coap.b"}); values["coap.a"] != int64(-5) || values["coap.b"] != "text" {
+		t.Errorf("Values were not stored: %v", values)
+	}
+
+	// GET in both formats
+	resp := coapExchangeTest(t, conn, coapTestRequest(coapCON, coapGET, &id, "/c/coap/b", nil))
+	if got, _, err := decodeCBOR(resp.Payload, 0); resp.Code != coapContent || got != "text" || err != nil {
+		t.Errorf("Unexpected response %+v to GET", resp)
+	}
+	req = coapTestRequest(coapCON, coapGET, &id, "/c/coap/a", nil)
+	req.addOptionUint(coapOptAccept, coapFormatMsgpack)
+	resp = coapExchangeTest(t, conn, req)
+	if got, _, err := decode(&resp.Payload, 0); resp.Code != coapContent || got != int64(-5) || err != nil {
+		t.Errorf("Unexpected response %+v to GET", resp)
+	}
+	if resp = coapExchangeTest(t, conn, coapTestRequest(coapCON, coapGET, &id, "/c/coap/missing", nil)); resp.Code != coapNotFound {
+		t.Errorf("Expected 4.04 for a missing key, got %v", coapCodeString(resp.Code))
+	}
+	req = coapTestRequest(coapCON, coapGET, &id, "/c/coap/a", nil)
+	req.addOptionUint(coapOptAccept, 50)
+	if resp = coapExchangeTest(t, conn, req); resp.Code != coapNotAcceptable {
+		t.Errorf("Expected 4.06 for JSON, got %v", coapCodeString(resp.Code))
+	}
+	req = coapTestRequest(coapCON, coapGET, &id, "/c/coap/a", nil)
+	req.addOption(1, []byte{1})
+	if resp = coapExchangeTest(t, conn, req); resp.Code != coapBadOption {
+		t.Errorf("Expected 4.02 for If-Match, got %v", coapCodeString(resp.Code))
+	}
+
+	// a retransmitted request is answered with the same response, without
+	// executing it again
+	req = coapTestRequest(coapCON, coapDELETE, &id, "/c/coap/b", nil)
+	if resp = coapExchangeTest(t, conn, req); resp.Code != coapDeleted {
+		t.Errorf("Unexpected response %+v to DELETE", resp)
+	}
+	revision, _ := db.Revision()
+	if resp = coapExchangeTest(t, conn, req); resp.Code != coapDeleted || resp.MessageID != req.MessageID {
+		t.Errorf("Unexpected response %+v to retransmitted DELETE", resp)
+	}
+	if current, _ := db.Revision(); current != revision {
+		t.Errorf("Retransmitted DELETE was executed again")
+	}
+
+	// a collection longer than a block is sent in several
+	long := strings.Repeat("x", 300)
+	db.Insert(map[string]interface{}{"coapblock.a": long, "coapblock.b": long})
+	var (
+		payload []byte
+		etag    []byte
+		szx     = uint32(coapBlockSZX)
+	)
+	for num := uint32(0); ; num++ {
+		req = coapTestRequest(coapCON, coapGET, &id, "/c/coapblock", nil)
+		req.addOptionUint(coapOptBlock2, num<<4|szx)
+		resp = coapExchangeTest(t, conn, req)
+		block2, found := resp.optionUint(coapOptBlock2)
+		if resp.Code != coapContent || !found || block2>>4 != num {
+			t.Fatalf("Unexpected response %+v to GET of block %v", resp, num)
+		}
+		if tag, _ := resp.option(coapOptETag); etag != nil && !bytes.Equal(tag, etag) {
+			t.Errorf("ETag of block %v changed", num)
+		} else {
+			etag = tag
+		}
+		// blocks are smaller than the datagrams the server sends
+		if szx = block2 & 7; 16<<szx > 256 {
+			t.Errorf("Block size %v is larger than the maximum datagram size", 16<<(block2&7))
+		}
+		payload = append(payload, resp.Payload...)
+		if block2&8 == 0 {
+			break
+		}
+	}
+	var expected []byte
+	encodeCBOR(&expected, map[string]interface{}{"a": long, "b": long})
+	if !bytes.Equal(payload, expected) {
+		t.Errorf("Reassembled collection %x, expected %x", payload, expected)
+	}
+
+	// observe a persist key
+	value = nil
+	encodeCBOR(&value, uint64(1))
+	if resp = coapExchangeTest(t, conn, coapTestRequest(coapCON, coapPUT, &id, "/p/counter", value)); resp.Code != coapChanged {
+		t.Errorf("Unexpected response %+v to persist PUT", resp)
+	}
+	observe := coapTestRequest(coapCON, coapGET, &id, "/p/counter", nil)
+	observe.addOptionUint(coapOptObserve, 0)
+	resp = coapExchangeTest(t, conn, observe)
+	if _, found := resp.optionUint(coapOptObserve); !found || resp.Code != coapContent {
+		t.Fatalf("Observation was not registered: %+v", resp)
+	}
+	// the notification can arrive before or after the response
+	value = nil
+	encodeCBOR(&value, uint64(2))
+	resp = coapExchangeTest(t, conn, coapTestRequest(coapCON, coapPUT, &id, "/p/counter", value))
+	notification := readCoAP(t, conn)
+	if resp.Type == coapNON {
+		resp, notification = notification, resp
+	}
+	if resp.Code != coapChanged {
+		t.Errorf("Unexpected response %+v to persist PUT", resp)
+	}
+	if got, _, _ := decodeCBOR(notification.Payload, 0); notification.Type != coapNON ||
+		!bytes.Equal(notification.Token, observe.Token) || got != uint64(2) {
+		t.Errorf("Unexpected notification %+v", notification)
+	}
+	if seq, found := notification.optionUint(coapOptObserve); !found || seq == 0 {
+		t.Errorf("Notification has no sequence number")
+	}
+	// rejecting the notification cancels the observation
+	var rst []byte
+	(&coapMessage{Type: coapRST, MessageID: notification.MessageID}).marshal(&rst)
+	conn.Write(rst)
+	value = nil
+	encodeCBOR(&value, uint64(3))
+	if resp = coapExchangeTest(t, conn, coapTestRequest(coapCON, coapPUT, &id, "/p/counter", value)); resp.Code != coapChanged {
+		t.Errorf("Unexpected response %+v to persist PUT after cancelling, expected no notification", resp)
+	}
+
+	// deleting an observed key ends the observation with a 4.04
+	observe = coapTestRequest(coapCON, coapGET, &id, "/c/coap/a", nil)
+	observe.addOptionUint(coapOptObserve, 0)
+	if resp = coapExchangeTest(t, conn, observe); resp.Code != coapContent {
+		t.Fatalf("Unexpected response %+v to observe", resp)
+	}
+	db.Delete([]string{"coap.a"})
+	if notification = readCoAP(t, conn); notification.Code != coapNotFound || !bytes.Equal(notification.Token, observe.Token) {
+		t.Errorf("Unexpected notification %+v after deletion", notification)
+	}
+
+	// pings are answered with a reset
+	var ping []byte
+	id++
+	(&coapMessage{Type: coapCON, MessageID: id}).marshal(&ping)
+	conn.Write(ping)
+	if resp = readCoAP(t, conn); resp.Type != coapRST || resp.MessageID != id {
+		t.Errorf("Unexpected response %+v to ping", resp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Stop(ctx); err != nil {
+		t.Error("Could not stop server", err)
+	}
+}
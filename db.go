@@ -1,12 +1,14 @@
-package main
+package mpdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"github.com/boltdb/bolt"
-	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Our database currently only supports uint64, int64, uint, int and string
@@ -21,6 +23,72 @@ type Record struct {
 	I     int
 	S     string
 	Which int // 0 = U64, 1 = I64, etc. Max is 4 = S
+	// metadata about the last write of this value
+	Modified int64  // unix nanoseconds
+	Writer   string // nodeid
+	Revision uint64
+}
+
+// An Entry is a stored value along with the metadata MPDB records on every
+// write: when the value was last modified, the nodeid that wrote it, and the
+// revision of the commit that wrote it. Revisions increase monotonically
+// across the whole database, and every value written by the same operation
+// shares the same revision
+type Entry struct {
+	Value    interface{}
+	Modified time.Time
+	Writer   string
+	Revision uint64
+}
+
+// Names of the buckets MPDB uses for its own bookkeeping. Collection names are
+// everything before the first period of a key, so they can never collide with
+// a bucket name that starts with a period
+var (
+	revisionBucket   = []byte(".revision")
+	versioningBucket = []byte(".versioning")
+	historyBucket    = []byte(".history")
+	// holds the persist bucket of each node, named by its nodeid. Keeping them
+	// out of the namespace of collections means that no key or collection name
+	// can reach the persist bucket of a node
+	persistBucket = []byte(".persist")
+)
+
+// A VersionPolicy describes how much history MPDB keeps for the keys of a
+// collection. MaxVersions is the number of most recent values kept for each
+// key, and MaxAge drops values older than the given duration (the latest value
+// of a key is always kept). A zero value for either disables that bound
+type VersionPolicy struct {
+	MaxVersions int
+	MaxAge      time.Duration
+}
+
+// A Version is a single historical value of a key, along with the time it was
+// written and the nodeid that wrote it. The Value of a version recording the
+// deletion of the key is nil
+type Version struct {
+	Time   time.Time
+	Writer string
+	Value  interface{}
+}
+
+// on-disk representation of a Version
+type versionRecord struct {
+	Time   int64 // unix nanoseconds
+	Writer string
+	Value  Record
+	// set if the key was deleted, in which case Value is empty
+	Deleted bool
+}
+
+// state shared by all writes made within a single write transaction
+type commit struct {
+	tx       *bolt.Tx
+	writer   string
+	time     time.Time
+	revision uint64
+	// the writes and deletions made so far, for the change log
+	changes []changeRecord
 }
 
 // Represents an instance to the Bolt instance that represents
@@ -29,6 +97,9 @@ type DB struct {
 	filename    string
 	db          *bolt.DB
 	nodebuckets map[string]struct{} // keep track of which nodes have buckets
+	// closed and replaced after every commit, see Changed
+	changed     chan struct{}
+	changedLock sync.Mutex
 }
 
 // The DB struct provides some convenience functions for the mpdb instance
@@ -40,7 +111,8 @@ func NewDB(filename string) *DB {
 	}
 	gob.Register(Record{})
 	return &DB{filename: filename, db: db,
-		nodebuckets: make(map[string]struct{})}
+		nodebuckets: make(map[string]struct{}),
+		changed:     make(chan struct{})}
 }
 
 // Closes connection to the database
@@ -53,25 +125,9 @@ func (db *DB) Close() {
 // that created them. Keys that already exist in the persist bucket for this
 // node will be overwritten
 func (db *DB) Persist(nodeid string, data map[string]interface{}) error {
-	err := db.db.Update(func(tx *bolt.Tx) error {
-		b, err := db.getBucket(tx, nodeid)
-		if err != nil {
-			return err
-		}
-		// insert data
-		for k, v := range data {
-			v_bytes, err := db.encodeInterface(v)
-			if err != nil {
-				return fmt.Errorf("Could not encode value %s as bytes (%s)", v, err)
-			}
-			err = b.Put([]byte(k), v_bytes)
-			if err != nil {
-				return fmt.Errorf("Could not insert key %s value %s for nodeid %s (%s)", k, v, nodeid, err)
-			}
-		}
-		return nil
+	return db.update(nodeid, func(cm *commit) error {
+		return db.putPersist(cm, nodeid, data)
 	})
-	return err
 }
 
 // GetPersist returns a map[string]interface{} for all keys of the input list
@@ -81,7 +137,7 @@ func (db *DB) Persist(nodeid string, data map[string]interface{}) error {
 func (db *DB) GetPersist(nodeid string, keys []string) (map[string]interface{}, error) {
 	var result = make(map[string]interface{})
 	err := db.db.View(func(tx *bolt.Tx) error {
-		b, err := db.getBucket(tx, nodeid)
+		b, err := db.getPersistBucket(tx, nodeid)
 		if err != nil {
 			return err
 		}
@@ -115,39 +171,44 @@ func (db *DB) GetPersist(nodeid string, keys []string) (map[string]interface{},
 // There is no collision detection, so any keys that already exist in the
 // bucket will be overwritten
 func (db *DB) Insert(data map[string]interface{}) error {
-	err := db.db.Update(func(tx *bolt.Tx) error {
-		var (
-			parts      []string
-			bucketname string
-			key        string
-		)
+	return db.InsertFrom("", data)
+}
+
+// InsertFrom behaves like Insert, but records [nodeid] as the writer of each
+// value
+func (db *DB) InsertFrom(nodeid string, data map[string]interface{}) error {
+	return db.update(nodeid, func(cm *commit) error {
 		// insert data
 		for k, v := range data {
-			if strings.Contains(k, ".") { // has prefix
-				parts = strings.SplitN(k, ".", 2)
-				bucketname = parts[0]
-				key = parts[1]
-			} else {
-				bucketname = "global"
-				key = k
-			}
-			b, err := db.getBucket(tx, bucketname)
-			if err != nil {
+			bucketname, key := splitKey(k)
+			if err := db.put(cm, bucketname, key, v); err != nil {
 				return err
 			}
-			v_bytes, err := db.encodeInterface(v)
-			if err != nil {
-				return fmt.Errorf("Could not encode value %s as bytes (%s)", v, err)
-			}
-			err = b.Put([]byte(key), v_bytes)
-			if err != nil {
-				return fmt.Errorf("Could not insert key %s value %s for nodeid %s (%s)", k, v, bucketname, err)
-			}
+		}
+		return nil
+	})
+}
+
+// Delete removes the given keys, which are prefixed with their collection in
+// the same way as for Insert. Keys that do not have a value are ignored. In
+// versioned collections, the deletion is recorded as a version with a nil
+// value
+func (db *DB) Delete(keys []string) error {
+	return db.DeleteFrom("", keys)
+}
 
+// DeleteFrom behaves like Delete, but records [nodeid] as the writer of the
+// deletions
+func (db *DB) DeleteFrom(nodeid string, keys []string) error {
+	return db.update(nodeid, func(cm *commit) error {
+		for _, k := range keys {
+			bucketname, key := splitKey(k)
+			if err := db.remove(cm, bucketname, key); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-	return err
 }
 
 // Returns a k/v map for each of the provided list of keys [keys]. Each key can be
@@ -157,87 +218,546 @@ func (db *DB) Insert(data map[string]interface{}) error {
 // all key/value pairs for a given bucket, use the GetBucket method. All keys not in the global
 // collection will be prefixed with their collection name
 func (db *DB) Get(keys []string) (map[string]interface{}, error) {
+	var result = make(map[string]interface{})
+	err := db.getRecords(keys, func(key string, rec *Record) error {
+		if rec == nil {
+			result[key] = nil
+			return nil
+		}
+		val, err := rec.value()
+		result[key] = val
+		return err
+	})
+	return result, err
+}
+
+// GetWithMeta behaves like Get, but returns an Entry for each key so that the
+// caller can tell who last wrote the value and when. Keys that do not have
+// corresponding values will have a nil Entry
+func (db *DB) GetWithMeta(keys []string) (map[string]*Entry, error) {
+	var result = make(map[string]*Entry)
+	err := db.getRecords(keys, func(key string, rec *Record) error {
+		if rec == nil {
+			result[key] = nil
+			return nil
+		}
+		entry, err := rec.entry()
+		result[key] = entry
+		return err
+	})
+	return result, err
+}
+
+// GetAsOf behaves like Get, but returns the value each key held at time [t].
+// Values are drawn from the history of versioned collections (see
+// SetVersioning), so keys without a recorded version at or before [t] will
+// have nil as their value
+func (db *DB) GetAsOf(keys []string, t time.Time) (map[string]interface{}, error) {
 	var result = make(map[string]interface{})
 	err := db.db.View(func(tx *bolt.Tx) error {
-		var (
-			parts      []string
-			bucketname string
-			key        string
-		)
 		for _, k := range keys {
-			if strings.Contains(k, ".") { // has prefix
-				parts = strings.SplitN(k, ".", 2)
-				bucketname = parts[0]
-				key = parts[1]
-			} else {
-				bucketname = "global"
-				key = k
+			bucketname, key := splitKey(k)
+			result[joinKey(bucketname, key)] = nil
+			kb := db.getHistoryBucket(tx, bucketname, key)
+			if kb == nil {
+				continue
 			}
-			b, err := db.getBucket(tx, bucketname)
-			if err != nil {
-				return err
-			}
-			val, err := db.decodeInterface(b.Get([]byte(key)))
-			if err != nil {
-				return fmt.Errorf("Could not decode bytes for value (%s)", err)
+			c := kb.Cursor()
+			for hk, hv := c.Last(); hk != nil; hk, hv = c.Prev() {
+				version, err := db.decodeVersion(hv)
+				if err != nil {
+					return err
+				}
+				if !version.Time.After(t) {
+					result[joinKey(bucketname, key)] = version.Value
+					break
+				}
 			}
-			if bucketname == "global" {
-				result[key] = val
-			} else {
-				result[bucketname+"."+key] = val
+		}
+		return nil
+	})
+	return result, err
+}
+
+// GetHistory returns the recorded versions of each of the provided keys,
+// oldest first. Keys are prefixed with their collection in the same way as for
+// Get. Keys in collections without versioning enabled will have no versions
+func (db *DB) GetHistory(keys []string) (map[string][]Version, error) {
+	var result = make(map[string][]Version)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		for _, k := range keys {
+			var versions []Version
+			bucketname, key := splitKey(k)
+			if kb := db.getHistoryBucket(tx, bucketname, key); kb != nil {
+				err := kb.ForEach(func(hk, hv []byte) error {
+					version, err := db.decodeVersion(hv)
+					if err != nil {
+						return err
+					}
+					versions = append(versions, version)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
 			}
+			result[joinKey(bucketname, key)] = versions
 		}
 		return nil
 	})
 	return result, err
 }
 
+// SetVersioning configures how much history is kept for the keys of
+// [collection]. Versions are only recorded for writes made after versioning
+// is enabled. A zero VersionPolicy disables versioning for the collection and
+// discards its history
+func (db *DB) SetVersioning(collection string, policy VersionPolicy) error {
+	if collection == "" || isSystemBucket(collection) || strings.Contains(collection, ".") {
+		return fmt.Errorf("Invalid collection name %s", collection)
+	}
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(versioningBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create versioning bucket (%s)", err)
+		}
+		if policy.MaxVersions <= 0 && policy.MaxAge <= 0 {
+			if hb := tx.Bucket(historyBucket); hb != nil && hb.Bucket([]byte(collection)) != nil {
+				if err := hb.DeleteBucket([]byte(collection)); err != nil {
+					return fmt.Errorf("Could not remove history for collection %s (%s)", collection, err)
+				}
+			}
+			return b.Delete([]byte(collection))
+		}
+		var buf = new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(policy); err != nil {
+			return err
+		}
+		return b.Put([]byte(collection), buf.Bytes())
+	})
+	return err
+}
+
 // Returns a k/v map of all values in the collection with the provided name.
 // Each key will be prefixed with the name of the collection, so in a collection
 // called "names" with keys "a", "b" and "c", the returned map will have keys
 // "names.a", "names.b", "names.c"
 func (db *DB) GetBucket(bucketname string) (map[string]interface{}, error) {
 	var result = make(map[string]interface{})
+	err := db.getBucketRecords(bucketname, nil, func(key string, rec *Record) error {
+		val, err := rec.value()
+		result[key] = val
+		return err
+	})
+	return result, err
+}
+
+// GetBucketWithMeta behaves like GetBucket, but returns an Entry for each key
+// in the collection
+func (db *DB) GetBucketWithMeta(bucketname string) (map[string]*Entry, error) {
+	return db.GetBucketFiltered(bucketname, nil)
+}
+
+// GetBucketFiltered behaves like GetBucketWithMeta, but only returns the
+// entries that match [filter], or all of them if it is nil. The filter is
+// evaluated while reading the collection, so entries that do not match are
+// never returned
+func (db *DB) GetBucketFiltered(bucketname string, filter *Filter) (map[string]*Entry, error) {
+	if filter != nil {
+		if err := filter.validate(); err != nil {
+			return nil, err
+		}
+	}
+	var result = make(map[string]*Entry)
+	err := db.getBucketRecords(bucketname, filter, func(key string, rec *Record) error {
+		entry, err := rec.entry()
+		result[key] = entry
+		return err
+	})
+	return result, err
+}
+
+// GetBucketPage behaves like GetBucketWithMeta, but returns at most [limit]
+// entries of the collection in key order, starting after [after] (a key
+// without the collection prefix, or "" to start at the first key). [keys]
+// lists the full keys of the returned entries in order, and [more] is set if
+// the collection has more keys after them
+func (db *DB) GetBucketPage(bucketname, after string, limit int) (keys []string, entries map[string]*Entry, more bool, err error) {
+	if isSystemBucket(bucketname) {
+		return nil, nil, false, fmt.Errorf("Bucket does not exist")
+	}
+	entries = make(map[string]*Entry)
+	err = db.db.View(func(tx *bolt.Tx) error {
+		b, err := db.getBucket(tx, bucketname)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && after != "" && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil; k, v = c.Next() {
+			if len(keys) == limit {
+				more = true
+				break
+			}
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			entry, err := rec.entry()
+			if err != nil {
+				return err
+			}
+			key := bucketname + "." + string(k)
+			keys = append(keys, key)
+			entries[key] = entry
+		}
+		return nil
+	})
+	return keys, entries, more, err
+}
+
+// Revision returns the revision of the most recent commit to the database
+func (db *DB) Revision() (uint64, error) {
+	var revision uint64
 	err := db.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(revisionBucket); b != nil {
+			revision = b.Sequence()
+		}
+		return nil
+	})
+	return revision, err
+}
+
+// calls [fn] with the full key and decoded Record for each of [keys]. [rec]
+// is nil for keys that do not have a value
+func (db *DB) getRecords(keys []string, fn func(key string, rec *Record) error) error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		for _, k := range keys {
+			bucketname, key := splitKey(k)
+			b, err := db.getBucket(tx, bucketname)
+			if err != nil {
+				return err
+			}
+			var rec *Record
+			if v := b.Get([]byte(key)); v != nil {
+				if rec, err = decodeRecord(v); err != nil {
+					return err
+				}
+			}
+			if err = fn(joinKey(bucketname, key), rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// calls [fn] with the full key and decoded Record for each key in the given
+// collection that matches [filter], or for every key if it is nil
+func (db *DB) getBucketRecords(bucketname string, filter *Filter, fn func(key string, rec *Record) error) error {
+	if isSystemBucket(bucketname) {
+		return fmt.Errorf("Bucket does not exist")
+	}
+	return db.db.View(func(tx *bolt.Tx) error {
 		b, err := db.getBucket(tx, bucketname)
 		if err != nil {
 			return err
 		}
+		var prefix []byte
+		if filter != nil {
+			prefix = []byte(filter.Prefix)
+		}
 		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			val, err := db.decodeInterface(v)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rec, err := decodeRecord(v)
 			if err != nil {
-				return fmt.Errorf("Could not decode bytes for value (%s)", err)
+				return err
+			}
+			if filter != nil {
+				matched, err := filter.match(string(k), rec)
+				if err != nil {
+					return err
+				}
+				if !matched {
+					continue
+				}
+			}
+			if err = fn(bucketname+"."+string(k), rec); err != nil {
+				return err
 			}
-			result[bucketname+"."+string(k)] = val
 		}
 		return nil
 	})
-	return result, err
+}
+
+// runs [fn] as a new commit by [writer] within a write transaction. The
+// changes made by [fn] are added to the change log, and Changed is signalled
+// once the transaction has committed
+func (db *DB) update(writer string, fn func(cm *commit) error) error {
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		cm, err := db.newCommit(tx, writer)
+		if err != nil {
+			return err
+		}
+		if err = fn(cm); err != nil {
+			return err
+		}
+		return db.logChanges(cm)
+	})
+	if err == nil {
+		db.notifyChanged()
+	}
+	return err
+}
+
+// starts a new commit within the write transaction [tx] by allocating the next
+// revision
+func (db *DB) newCommit(tx *bolt.Tx, writer string) (*commit, error) {
+	b, err := tx.CreateBucketIfNotExists(revisionBucket)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create revision bucket (%s)", err)
+	}
+	revision, err := b.NextSequence()
+	if err != nil {
+		return nil, fmt.Errorf("Could not allocate revision (%s)", err)
+	}
+	return &commit{tx: tx, writer: writer, time: time.Now(), revision: revision}, nil
+}
+
+// stores [value] under [key] in bucket [bucketname] as part of commit [cm],
+// recording a new version if the collection is versioned
+func (db *DB) put(cm *commit, bucketname, key string, value interface{}) error {
+	b, err := db.getBucket(cm.tx, bucketname)
+	if err != nil {
+		return err
+	}
+	rec, v_bytes, err := cm.record(value)
+	if err != nil {
+		return err
+	}
+	if err = db.reindex(cm.tx, bucketname, key, b.Get([]byte(key)), value); err != nil {
+		return err
+	}
+	err = b.Put([]byte(key), v_bytes)
+	if err != nil {
+		return fmt.Errorf("Could not insert key %s value %s for bucket %s (%s)", key, value, bucketname, err)
+	}
+	cm.changes = append(cm.changes, changeRecord{Bucket: bucketname, Key: key, Value: rec})
+	return db.recordVersion(cm, bucketname, key, versionRecord{Value: rec})
+}
+
+// stores [data] in the persist bucket of [nodeid] as part of commit [cm].
+// Persist buckets are neither indexed nor versioned
+func (db *DB) putPersist(cm *commit, nodeid string, data map[string]interface{}) error {
+	b, err := db.getPersistBucket(cm.tx, nodeid)
+	if err != nil {
+		return err
+	}
+	for k, v := range data {
+		rec, v_bytes, err := cm.record(v)
+		if err != nil {
+			return err
+		}
+		if err = b.Put([]byte(k), v_bytes); err != nil {
+			return fmt.Errorf("Could not insert key %s value %s for nodeid %s (%s)", k, v, nodeid, err)
+		}
+		cm.changes = append(cm.changes, changeRecord{Bucket: nodeid, Key: k, Value: rec, Persist: true})
+	}
+	return nil
+}
+
+// wraps [value] in a Record written by commit [cm], and encodes it
+func (cm *commit) record(value interface{}) (Record, []byte, error) {
+	rec, err := toRecord(value)
+	if err != nil {
+		return rec, nil, err
+	}
+	rec.Modified = cm.time.UnixNano()
+	rec.Writer = cm.writer
+	rec.Revision = cm.revision
+	v_bytes, err := encodeRecord(rec)
+	if err != nil {
+		return rec, nil, fmt.Errorf("Could not encode value %s as bytes (%s)", value, err)
+	}
+	return rec, v_bytes, nil
+}
+
+// removes [key] from bucket [bucketname] as part of commit [cm], recording the
+// deletion if the collection is versioned and the key had a value
+func (db *DB) remove(cm *commit, bucketname, key string) error {
+	b := cm.tx.Bucket([]byte(bucketname))
+	if b == nil || b.Get([]byte(key)) == nil {
+		return nil
+	}
+	if err := db.reindex(cm.tx, bucketname, key, b.Get([]byte(key)), nil); err != nil {
+		return err
+	}
+	if err := b.Delete([]byte(key)); err != nil {
+		return fmt.Errorf("Could not delete key %s from bucket %s (%s)", key, bucketname, err)
+	}
+	cm.changes = append(cm.changes, changeRecord{Bucket: bucketname, Key: key, Deleted: true})
+	return db.recordVersion(cm, bucketname, key, versionRecord{Deleted: true})
+}
+
+// appends [vr] to the history of the given key if its collection has a
+// VersionPolicy, and then drops versions that fall outside of that policy. The
+// time and writer of [vr] are taken from the commit
+func (db *DB) recordVersion(cm *commit, bucketname, key string, vr versionRecord) error {
+	tx := cm.tx
+	policy, found, err := db.getVersionPolicy(tx, bucketname)
+	if err != nil || !found {
+		return err
+	}
+	hb, err := tx.CreateBucketIfNotExists(historyBucket)
+	if err != nil {
+		return fmt.Errorf("Could not create history bucket (%s)", err)
+	}
+	cb, err := hb.CreateBucketIfNotExists([]byte(bucketname))
+	if err != nil {
+		return fmt.Errorf("Could not create history for collection %s (%s)", bucketname, err)
+	}
+	kb, err := cb.CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return fmt.Errorf("Could not create history for key %s (%s)", key, err)
+	}
+	var buf = new(bytes.Buffer)
+	vr.Time, vr.Writer = cm.time.UnixNano(), cm.writer
+	err = gob.NewEncoder(buf).Encode(vr)
+	if err != nil {
+		return err
+	}
+	// versions are keyed by sequence number, so they are ordered by write
+	seq, err := kb.NextSequence()
+	if err != nil {
+		return err
+	}
+	if err = kb.Put(itob(seq), buf.Bytes()); err != nil {
+		return fmt.Errorf("Could not record version of key %s (%s)", key, err)
+	}
+
+	// prune old versions
+	var (
+		expired [][]byte
+		count   int
+		cutoff  = cm.time.Add(-policy.MaxAge).UnixNano()
+	)
+	c := kb.Cursor()
+	for hk, _ := c.First(); hk != nil; hk, _ = c.Next() {
+		count++
+	}
+	for hk, hv := c.First(); hk != nil && count > 1; hk, hv = c.Next() {
+		if policy.MaxVersions > 0 && count > policy.MaxVersions {
+			expired = append(expired, hk)
+			count--
+			continue
+		}
+		if policy.MaxAge <= 0 {
+			break
+		}
+		var old versionRecord
+		if err := gob.NewDecoder(bytes.NewBuffer(hv)).Decode(&old); err != nil {
+			return err
+		}
+		if old.Time >= cutoff {
+			break
+		}
+		expired = append(expired, hk)
+		count--
+	}
+	for _, hk := range expired {
+		if err := kb.Delete(hk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the VersionPolicy for the given collection, if it has one
+func (db *DB) getVersionPolicy(tx *bolt.Tx, collection string) (VersionPolicy, bool, error) {
+	var policy VersionPolicy
+	b := tx.Bucket(versioningBucket)
+	if b == nil {
+		return policy, false, nil
+	}
+	v := b.Get([]byte(collection))
+	if v == nil {
+		return policy, false, nil
+	}
+	err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&policy)
+	return policy, err == nil, err
+}
+
+// returns the bucket holding the history for the given key, or nil if there
+// is no history
+func (db *DB) getHistoryBucket(tx *bolt.Tx, bucketname, key string) *bolt.Bucket {
+	hb := tx.Bucket(historyBucket)
+	if hb == nil {
+		return nil
+	}
+	cb := hb.Bucket([]byte(bucketname))
+	if cb == nil {
+		return nil
+	}
+	return cb.Bucket([]byte(key))
+}
+
+// decodes a stored versionRecord into a Version
+func (db *DB) decodeVersion(value []byte) (Version, error) {
+	var vr versionRecord
+	if err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&vr); err != nil {
+		return Version{}, fmt.Errorf("Could not decode bytes for version (%s)", err)
+	}
+	if vr.Deleted {
+		return Version{Time: time.Unix(0, vr.Time), Writer: vr.Writer}, nil
+	}
+	val, err := vr.Value.value()
+	if err != nil {
+		return Version{}, err
+	}
+	return Version{Time: time.Unix(0, vr.Time), Writer: vr.Writer, Value: val}, nil
 }
 
 // encodes arbitrary interface as bytes for safe storage in bolt
 func (db *DB) encodeInterface(value interface{}) ([]byte, error) {
-	var buf = new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
+	rec, err := toRecord(value)
+	if err != nil {
+		return nil, err
+	}
+	return encodeRecord(rec)
+}
+
+// wraps a primitive value in a Record. Fails if the Record cannot hold the
+// type of [value]
+func toRecord(value interface{}) (Record, error) {
 	rec := Record{}
-	switch reflect.TypeOf(value).Kind() {
-	case reflect.Uint64:
-		rec.U64 = value.(uint64)
+	switch value := value.(type) {
+	case uint64:
+		rec.U64 = value
 		rec.Which = 0
-	case reflect.Int64:
-		rec.I64 = value.(int64)
+	case int64:
+		rec.I64 = value
 		rec.Which = 1
-	case reflect.Int:
-		rec.I = value.(int)
+	case int:
+		rec.I = value
 		rec.Which = 2
-	case reflect.Uint:
-		rec.U = value.(uint)
+	case uint:
+		rec.U = value
 		rec.Which = 3
-	case reflect.String:
-		rec.S = value.(string)
+	case string:
+		rec.S = value
 		rec.Which = 4
+	default:
+		return rec, fmt.Errorf("Cannot store value %v of type %T", value, value)
 	}
+	return rec, nil
+}
+
+func encodeRecord(rec Record) ([]byte, error) {
+	var buf = new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
 	err := enc.Encode(rec)
 	if err != nil {
 		return nil, err
@@ -247,13 +767,35 @@ func (db *DB) encodeInterface(value interface{}) ([]byte, error) {
 
 // Decodes the value and returns the primitive
 func (db *DB) decodeInterface(value []byte) (interface{}, error) {
+	rec, err := decodeRecord(value)
+	if err != nil {
+		return nil, err
+	}
+	return rec.value()
+}
+
+func decodeRecord(value []byte) (*Record, error) {
 	var rec Record
 	buf := bytes.NewBuffer(value)
 	dec := gob.NewDecoder(buf)
 	err := dec.Decode(&rec)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode bytes for value (%s)", err)
+	}
+	return &rec, nil
+}
+
+// returns the value stored in the Record along with its metadata
+func (rec Record) entry() (*Entry, error) {
+	val, err := rec.value()
 	if err != nil {
 		return nil, err
 	}
+	return &Entry{Value: val, Modified: time.Unix(0, rec.Modified), Writer: rec.Writer, Revision: rec.Revision}, nil
+}
+
+// returns the primitive stored in the Record
+func (rec Record) value() (interface{}, error) {
 	switch rec.Which {
 	case 0:
 		return rec.U64, nil
@@ -268,7 +810,6 @@ func (db *DB) decodeInterface(value []byte) (interface{}, error) {
 	default:
 		return nil, fmt.Errorf("no valid value")
 	}
-	return rec, nil
 }
 
 // fetches or creates bucket with name [name] for the duration of transaction [tx]
@@ -289,3 +830,55 @@ func (db *DB) getBucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
 	}
 	return b, nil
 }
+
+// fetches or creates the persist bucket of [nodeid] for the duration of
+// transaction [tx]
+func (db *DB) getPersistBucket(tx *bolt.Tx, nodeid string) (*bolt.Bucket, error) {
+	if !tx.Writable() {
+		if pb := tx.Bucket(persistBucket); pb != nil {
+			if b := pb.Bucket([]byte(nodeid)); b != nil {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("Bucket does not exist")
+	}
+	pb, err := tx.CreateBucketIfNotExists(persistBucket)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create persist bucket (%s)", err)
+	}
+	b, err := pb.CreateBucketIfNotExists([]byte(nodeid))
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch or create persist bucket for nodeid %s (%s)", nodeid, err)
+	}
+	return b, nil
+}
+
+// splits a full key into its collection and key within that collection.
+// Non-prefixed keys belong to the "global" collection
+func splitKey(k string) (string, string) {
+	if strings.Contains(k, ".") { // has prefix
+		parts := strings.SplitN(k, ".", 2)
+		return parts[0], parts[1]
+	}
+	return "global", k
+}
+
+// the inverse of splitKey: keys in the global collection are not prefixed
+func joinKey(bucketname, key string) string {
+	if bucketname == "global" {
+		return key
+	}
+	return bucketname + "." + key
+}
+
+// buckets used internally by MPDB start with a period
+func isSystemBucket(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// big-endian representation of a uint64, so keys sort numerically
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -1,7 +1,12 @@
-package main
+package mpdb
 
 import (
+	"math"
+	"net"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCreateDB(t *testing.T) {
@@ -120,6 +125,27 @@ func TestGetPersistSubset(t *testing.T) {
 	}
 }
 
+func TestPersistIsolated(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	if err := db.Persist("4321", map[string]interface{}{"secret": "s3cr3t"}); err != nil {
+		t.Fatal(err)
+	}
+	// a collection named like the node is a different bucket
+	if err := db.InsertFrom("999", map[string]interface{}{"4321.secret": "overwritten"}); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := db.GetBucket("4321"); err != nil || values["4321.secret"] != "overwritten" {
+		t.Errorf("Unexpected collection %v (%v)", values, err)
+	}
+	if res, err := db.GetPersist("4321", []string{"secret"}); err != nil || res["secret"] != "s3cr3t" {
+		t.Errorf("Persist bucket was reached through a collection: %v (%v)", res, err)
+	}
+	if _, err := db.GetBucket(".persist"); err == nil {
+		t.Error("Read the persist buckets as a collection")
+	}
+}
+
 func TestInsertGlobal(t *testing.T) {
 	var (
 		val   interface{}
@@ -136,7 +162,7 @@ func TestInsertGlobal(t *testing.T) {
 	for k, v := range vals {
 		val, found = res[k]
 		if !found {
-			t.Error("Did not get key %v for global collection", k)
+			t.Errorf("Did not get key %v for global collection", k)
 		}
 		if val != v {
 			t.Errorf("Fetched value %v did not match %v", val, v)
@@ -144,6 +170,19 @@ func TestInsertGlobal(t *testing.T) {
 	}
 }
 
+func TestInsertUnsupported(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	for _, value := range []interface{}{nil, true, 1.5, []interface{}{1}, map[string]interface{}{}} {
+		if err := db.Insert(map[string]interface{}{"unsupported.a": value}); err == nil {
+			t.Errorf("Expected error inserting value %v of type %T", value, value)
+		}
+		if err := db.Persist("1", map[string]interface{}{"unsupported": value}); err == nil {
+			t.Errorf("Expected error persisting value %v of type %T", value, value)
+		}
+	}
+}
+
 func TestInsertCollection(t *testing.T) {
 	var (
 		val   interface{}
@@ -224,3 +263,720 @@ func TestGetBucket(t *testing.T) {
 		}
 	}
 }
+
+func TestHistory(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	err := db.SetVersioning("hist", VersionPolicy{MaxVersions: 3})
+	if err != nil {
+		t.Error("Could not enable versioning", err)
+	}
+	for i := 1; i <= 5; i++ {
+		err = db.InsertFrom("1234", map[string]interface{}{"hist.a": i})
+		if err != nil {
+			t.Error("Could not insert", err)
+		}
+	}
+	res, err := db.GetHistory([]string{"hist.a"})
+	if err != nil {
+		t.Error("Could not get history", err)
+	}
+	versions := res["hist.a"]
+	if len(versions) != 3 {
+		t.Fatalf("Expected 3 versions but got %v", len(versions))
+	}
+	for idx, v := range []interface{}{3, 4, 5} {
+		if versions[idx].Value != v {
+			t.Errorf("Version %v value %v did not match %v", idx, versions[idx].Value, v)
+		}
+		if versions[idx].Writer != "1234" {
+			t.Errorf("Version %v writer %v did not match 1234", idx, versions[idx].Writer)
+		}
+	}
+	for _, invalid := range []string{"", "hist.a", ".history"} {
+		if err = db.SetVersioning(invalid, VersionPolicy{MaxVersions: 3}); err == nil {
+			t.Errorf("Expected error enabling versioning for collection %q", invalid)
+		}
+	}
+	if err = db.SetVersioning("hist", VersionPolicy{}); err != nil {
+		t.Error("Could not disable versioning", err)
+	}
+	res, err = db.GetHistory([]string{"hist.a"})
+	if err != nil {
+		t.Error("Could not get history", err)
+	}
+	if len(res["hist.a"]) != 0 {
+		t.Errorf("Expected no versions after disabling versioning but got %v", res["hist.a"])
+	}
+}
+
+func TestGetAsOf(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	err := db.SetVersioning("asof", VersionPolicy{MaxAge: time.Hour})
+	if err != nil {
+		t.Error("Could not enable versioning", err)
+	}
+	before := time.Now()
+	if err = db.Insert(map[string]interface{}{"asof.a": "old"}); err != nil {
+		t.Error("Could not insert", err)
+	}
+	middle := time.Now()
+	if err = db.Insert(map[string]interface{}{"asof.a": "new"}); err != nil {
+		t.Error("Could not insert", err)
+	}
+	for when, v := range map[time.Time]interface{}{before.Add(-time.Second): nil, middle: "old", time.Now(): "new"} {
+		res, err := db.GetAsOf([]string{"asof.a"}, when)
+		if err != nil {
+			t.Error("Could not get as of", when, err)
+		}
+		if res["asof.a"] != v {
+			t.Errorf("Fetched value %v as of %v did not match %v", res["asof.a"], when, v)
+		}
+	}
+	if err = db.SetVersioning("asof", VersionPolicy{}); err != nil {
+		t.Error("Could not disable versioning", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	err := db.SetVersioning("del", VersionPolicy{MaxVersions: 5})
+	if err != nil {
+		t.Error("Could not enable versioning", err)
+	}
+	if err = db.Insert(map[string]interface{}{"del.a": "gone", "del.b": "kept"}); err != nil {
+		t.Error("Could not insert", err)
+	}
+	beforeDelete := time.Now()
+	if err = db.DeleteFrom("1234", []string{"del.a", "del.missing"}); err != nil {
+		t.Error("Could not delete", err)
+	}
+	res, err := db.Get([]string{"del.a", "del.b"})
+	if err != nil {
+		t.Error("Could not get", err)
+	}
+	if res["del.a"] != nil || res["del.b"] != "kept" {
+		t.Errorf("Unexpected values after delete %v", res)
+	}
+	history, err := db.GetHistory([]string{"del.a"})
+	if err != nil {
+		t.Error("Could not get history", err)
+	}
+	if versions := history["del.a"]; len(versions) != 2 || versions[1].Value != nil || versions[1].Writer != "1234" {
+		t.Errorf("Expected a version recording the delete but got %v", versions)
+	}
+	if res, _ = db.GetAsOf([]string{"del.a"}, beforeDelete); res["del.a"] != "gone" {
+		t.Errorf("Expected value before delete but got %v", res["del.a"])
+	}
+	if res, _ = db.GetAsOf([]string{"del.a"}, time.Now()); res["del.a"] != nil {
+		t.Errorf("Expected no value after delete but got %v", res["del.a"])
+	}
+	if err = db.SetVersioning("del", VersionPolicy{}); err != nil {
+		t.Error("Could not disable versioning", err)
+	}
+}
+
+func TestGetBucketPage(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	if err := db.Insert(map[string]interface{}{"page.a": 1, "page.b": 2, "page.c": 3}); err != nil {
+		t.Error("Could not insert", err)
+	}
+	var (
+		all   []string
+		after string
+	)
+	for {
+		keys, entries, more, err := db.GetBucketPage("page", after, 2)
+		if err != nil {
+			t.Fatal("Could not get page", err)
+		}
+		for _, key := range keys {
+			if entries[key] == nil {
+				t.Errorf("Page is missing entry for %v", key)
+			}
+		}
+		all = append(all, keys...)
+		if !more {
+			break
+		}
+		_, after = splitKey(keys[len(keys)-1])
+	}
+	if strings.Join(all, ",") != "page.a,page.b,page.c" {
+		t.Errorf("Unexpected keys from pages %v", all)
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	before, err := db.Revision()
+	if err != nil {
+		t.Fatal("Could not get revision", err)
+	}
+	changed := db.Changed()
+	if err = db.InsertFrom("5", map[string]interface{}{"chg.a": int64(-1)}); err != nil {
+		t.Error("Could not insert", err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("Changed was not signalled by a commit")
+	}
+	if err = db.Persist("5", map[string]interface{}{"p": "private"}); err != nil {
+		t.Error("Could not persist", err)
+	}
+	if err = db.Delete([]string{"chg.a"}); err != nil {
+		t.Error("Could not delete", err)
+	}
+
+	sets, err := db.ChangesSince(before, 2)
+	if err != nil {
+		t.Fatal("Could not get changes", err)
+	}
+	if len(sets) != 2 || sets[0].Revision != before+1 || sets[1].Revision != before+2 {
+		t.Fatalf("Expected the first 2 commits after %v but got %+v", before, sets)
+	}
+	if c := sets[0].Changes; len(c) != 1 || c[0].Key != "chg.a" || c[0].Collection != "chg" || c[0].Value != int64(-1) || sets[0].Writer != "5" {
+		t.Errorf("Unexpected insert changes %+v", sets[0])
+	}
+	if c := sets[1].Changes; len(c) != 1 || c[0].Key != "p" || c[0].Collection != "5" || !c[0].Persist {
+		t.Errorf("Unexpected persist changes %+v", sets[1])
+	}
+	sets, err = db.ChangesSince(before+2, 10)
+	if err != nil || len(sets) != 1 {
+		t.Fatalf("Expected the last commit but got %+v (%v)", sets, err)
+	}
+	if c := sets[0].Changes; len(c) != 1 || !c[0].Deleted || c[0].Value != nil {
+		t.Errorf("Unexpected delete changes %+v", sets[0])
+	}
+	if sets, err = db.ChangesSince(before+3, 10); err != nil || len(sets) != 0 {
+		t.Errorf("Expected no changes after the last commit but got %+v (%v)", sets, err)
+	}
+}
+
+func TestGetWithMeta(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	start, err := db.Revision()
+	if err != nil {
+		t.Error("Could not get revision", err)
+	}
+	if err = db.InsertFrom("1234", map[string]interface{}{"meta.a": 1, "meta.b": "x"}); err != nil {
+		t.Error("Could not insert", err)
+	}
+	if err = db.InsertFrom("5678", map[string]interface{}{"meta.b": "y"}); err != nil {
+		t.Error("Could not insert", err)
+	}
+	res, err := db.GetWithMeta([]string{"meta.a", "meta.b", "meta.missing"})
+	if err != nil {
+		t.Error("Could not get with meta", err)
+	}
+	if res["meta.missing"] != nil {
+		t.Errorf("Expected nil entry for missing key but got %v", res["meta.missing"])
+	}
+	a, b := res["meta.a"], res["meta.b"]
+	if a == nil || b == nil {
+		t.Fatalf("Missing entries in %v", res)
+	}
+	if a.Value != 1 || a.Writer != "1234" || a.Revision != start+1 {
+		t.Errorf("Entry %+v did not match value 1 writer 1234 revision %v", a, start+1)
+	}
+	if b.Value != "y" || b.Writer != "5678" || b.Revision != start+2 {
+		t.Errorf("Entry %+v did not match value y writer 5678 revision %v", b, start+2)
+	}
+	if a.Modified.After(b.Modified) {
+		t.Errorf("Modified time %v of first write is after %v of second", a.Modified, b.Modified)
+	}
+	bucket, err := db.GetBucketWithMeta("meta")
+	if err != nil {
+		t.Error("Could not get bucket with meta", err)
+	}
+	if entry := bucket["meta.b"]; entry == nil || entry.Revision != b.Revision {
+		t.Errorf("Bucket entry %+v did not match %+v", entry, b)
+	}
+}
+
+func TestACL(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	err := db.SetACL("acl", []ACLEntry{
+		{First: 1, Last: 10, Rights: RightRead},
+		{First: 5, Last: 5, Rights: RightWrite},
+		{First: 42, Last: 42, Rights: RightAdmin},
+	})
+	if err != nil {
+		t.Error("Could not set ACL", err)
+	}
+	for nodeid, expected := range map[uint64]Rights{1: RightRead, 5: RightRead | RightWrite, 11: 0, 42: RightAll} {
+		rights, err := db.Rights("acl", nodeid)
+		if err != nil {
+			t.Error("Could not get rights", err)
+		}
+		if rights != expected {
+			t.Errorf("Rights %v for node %v did not match %v", rights, nodeid, expected)
+		}
+	}
+	rights, err := db.Rights("noacl", 11)
+	if err != nil {
+		t.Error("Could not get rights", err)
+	}
+	if rights != RightAll {
+		t.Errorf("Rights %v for collection without ACL did not match %v", rights, RightAll)
+	}
+	if err = db.SetACL("acl", nil); err != nil {
+		t.Error("Could not remove ACL", err)
+	}
+	if rights, _ = db.Rights("acl", 11); rights != RightAll {
+		t.Errorf("Rights %v after removing ACL did not match %v", rights, RightAll)
+	}
+}
+
+func TestNodeKey(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	if err := db.SetNodeKey(99, []byte("short"), PolicyAuthenticate); err == nil {
+		t.Error("Expected error setting a short key")
+	}
+	key := []byte("0123456789abcdef")
+	if err := db.SetNodeKey(99, key, PolicyEncrypt); err != nil {
+		t.Error("Could not set key", err)
+	}
+	nk, err := db.getNodeKey(99)
+	if err != nil || nk == nil {
+		t.Fatal("Could not get key", err)
+	}
+	if string(nk.Key) != string(key) || nk.Policy != PolicyEncrypt {
+		t.Errorf("Fetched key %v policy %v did not match %v %v", nk.Key, nk.Policy, key, PolicyEncrypt)
+	}
+	for _, epoch := range []uint32{1, 2} {
+		if err = db.advanceNodeEpoch(99, epoch); err != nil {
+			t.Errorf("Could not advance to epoch %v (%v)", epoch, err)
+		}
+	}
+	if err = db.advanceNodeEpoch(99, 2); err != errStaleEpoch {
+		t.Errorf("Expected stale epoch error but got %v", err)
+	}
+	if err = db.SetNodeKey(99, nil, PolicyAuthenticate); err != nil {
+		t.Error("Could not remove key", err)
+	}
+	if nk, _ = db.getNodeKey(99); nk != nil {
+		t.Errorf("Expected no key after removing it but got %v", nk)
+	}
+}
+
+func TestSetCredentials(t *testing.T) {
+	// replacing the credentials removes those of every other node, so use a
+	// fresh database
+	os.Remove("credentials_test.db")
+	db := NewDB("credentials_test.db")
+	defer os.Remove("credentials_test.db")
+	defer db.Close()
+	key := []byte("0123456789abcdef")
+	if err := db.SetNodeKey(1, key, PolicyAuthenticate); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddNodeToken(1, "token-of-node-one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetNodeKey(2, key, PolicyAuthenticate); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.advanceNodeEpoch(2, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetCredentials(map[uint64]NodeCredentials{3: {Tokens: []string{"short"}}}); err == nil {
+		t.Error("Expected error setting a short token")
+	}
+	err := db.SetCredentials(map[uint64]NodeCredentials{
+		2: {Key: key, Policy: PolicyEncrypt, Tokens: []string{"token-of-node-two"}},
+		3: {Tokens: []string{"token-of-node-three"}},
+	})
+	if err != nil {
+		t.Fatal("Could not set credentials", err)
+	}
+	if nk, _ := db.getNodeKey(1); nk != nil {
+		t.Errorf("Node 1 kept its key %v", nk)
+	}
+	// the epoch is kept, so earlier sessions cannot be replayed
+	if nk, _ := db.getNodeKey(2); nk == nil || nk.Policy != PolicyEncrypt || nk.Epoch != 5 {
+		t.Errorf("Unexpected key %+v of node 2", nk)
+	}
+	if nk, _ := db.getNodeKey(3); nk != nil {
+		t.Errorf("Node 3 got key %v", nk)
+	}
+	for token, nodeid := range map[string]uint64{"token-of-node-one": 0, "token-of-node-two": 2, "token-of-node-three": 3} {
+		if got, found, err := db.tokenNode(token); err != nil || got != nodeid || found != (nodeid != 0) {
+			t.Errorf("Token %s resolved to %v %v (%v), expected %v", token, got, found, err, nodeid)
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	for _, mode := range []byte{envelopeAuth, envelopeEncrypt} {
+		sealed, err := sealEnvelope(key, mode, toServer, 2, 7, []byte{0x81, 0xa1, 'a', 0x01})
+		if err != nil {
+			t.Error("Could not seal envelope", err)
+		}
+		tampered := append([]byte{}, sealed...)
+		tampered[len(tampered)-1] ^= 0xff
+		if _, _, _, err = verifyEnvelope(key, toServer, tampered); err == nil {
+			t.Errorf("Expected error verifying tampered envelope with mode %v", mode)
+		}
+		if _, _, _, err = verifyEnvelope(key, fromServer, append([]byte{}, sealed...)); mode == envelopeEncrypt && err == nil {
+			t.Error("Expected error opening encrypted envelope with the wrong direction")
+		}
+		m, epoch, payload, err := verifyEnvelope(key, toServer, sealed)
+		if err != nil {
+			t.Errorf("Could not verify envelope with mode %v (%v)", mode, err)
+		}
+		if m != mode || epoch != 2 || string(payload) != "\x81\xa1a\x01" {
+			t.Errorf("Envelope mode %v epoch %v payload %v did not match %v 2", m, epoch, payload, mode)
+		}
+	}
+}
+
+func TestRegisterNode(t *testing.T) {
+	// registering and retiring nodes cannot be undone, so use a fresh database
+	os.Remove("registry_test.db")
+	db := NewDB("registry_test.db")
+	defer os.Remove("registry_test.db")
+	defer db.Close()
+	// these addresses collided with the old nodeid derivation
+	a, b := net.ParseIP("2001:db8::1:1020"), net.ParseIP("2001:db8::1:1100")
+	ida, err := db.ResolveNode(a)
+	if err != nil {
+		t.Error("Could not resolve node", err)
+	}
+	idb, err := db.ResolveNode(b)
+	if err != nil {
+		t.Error("Could not resolve node", err)
+	}
+	if ida == idb {
+		t.Errorf("Nodes %v and %v resolved to the same nodeid %v", a, b, ida)
+	}
+
+	if nodes, err := db.ListNodes(); err != nil || len(nodes) != 0 {
+		t.Errorf("Resolving nodes registered %v (%v)", nodes, err)
+	}
+
+	// c has the same interface identifier as a on another prefix, so they
+	// share a nodeid until one registers. The other then has to register to
+	// get a newly allocated nodeid
+	c := net.ParseIP("2001:db8:1::1:1020")
+	if idc, err := db.ResolveNode(c); err != nil || idc != ida {
+		t.Errorf("Resolved nodeid %v (%v) did not match %v", idc, err, ida)
+	}
+	idc, err := db.RegisterNode(c, 0, "c")
+	if err != nil || idc != ida {
+		t.Errorf("Registered nodeid %v (%v) did not match resolved %v", idc, err, ida)
+	}
+	if _, err = db.ResolveNode(a); err == nil {
+		t.Error("Expected error resolving node with a registered nodeid")
+	}
+	if ida, err = db.RegisterNode(a, 0, "a"); err != nil || ida&allocatedNodeids == 0 {
+		t.Errorf("Registered nodeid %x (%v) was not allocated", ida, err)
+	}
+	if again, err := db.ResolveNode(a); err != nil || again != ida {
+		t.Errorf("Resolved nodeid %v (%v) did not match registered %v", again, err, ida)
+	}
+
+	// a node registered under its EUI-64 keeps its nodeid on other prefixes,
+	// and nobody else can take the EUI-64
+	const eui64 = 0x0211223344556677
+	d := net.ParseIP("2001:db8::11:2233:4455:6677")
+	idd, err := db.RegisterNode(d, eui64, "d")
+	if err != nil || idd != 0x0011223344556677 {
+		t.Errorf("Registered nodeid %x (%v) did not match the EUI-64", idd, err)
+	}
+	if moved, err := db.ResolveNode(net.ParseIP("2001:db8:1::11:2233:4455:6677")); err != nil || moved != idd {
+		t.Errorf("Resolved nodeid %v (%v) did not match registered %v", moved, err, idd)
+	}
+	if _, err = db.RegisterNode(a, eui64, ""); err == nil {
+		t.Error("Expected error registering the EUI-64 of another node")
+	}
+	if _, err = db.RegisterNode(net.ParseIP("2001:db8::99"), eui64, ""); err == nil {
+		t.Error("Expected error joining the node of an EUI-64 the address was not autoconfigured from")
+	}
+
+	if err = db.RenameNode(ida, "renamed"); err != nil {
+		t.Error("Could not rename node", err)
+	}
+	if err = db.RetireNode(ida); err != nil {
+		t.Error("Could not retire node", err)
+	}
+	if _, err = db.ResolveNode(a); err == nil {
+		t.Error("Expected error resolving retired node")
+	}
+	nodes, err := db.ListNodes()
+	if err != nil {
+		t.Error("Could not list nodes", err)
+	}
+	for _, info := range nodes {
+		if info.Nodeid == ida && (info.Name != "renamed" || !info.Retired) {
+			t.Errorf("Node info %+v did not match name renamed and retired", info)
+		}
+	}
+}
+
+func TestDeriveNodeidIPv4(t *testing.T) {
+	v4 := net.IPv4(192, 0, 2, 1).To4()
+	mapped := net.ParseIP("::ffff:192.0.2.1")
+	if id := deriveNodeid(v4); id != 0xffffc0000201 {
+		t.Errorf("Unexpected nodeid %x for %v", id, v4)
+	}
+	if deriveNodeid(v4) != deriveNodeid(mapped) {
+		t.Errorf("IPv4 address %v and mapped address %v have different nodeids", v4, mapped)
+	}
+	if identities := nodeIdentities(mapped); len(identities) != 1 || identities[0] != "addr:192.0.2.1" {
+		t.Errorf("Unexpected identities %v for %v", identities, mapped)
+	}
+	linklocal := net.ParseIP("fe80::0211:22ff:fe33:4455")
+	if id := deriveNodeid(linklocal); id != 0x021122fffe334455 {
+		t.Errorf("Unexpected nodeid %x for %v", id, linklocal)
+	}
+	// the high bit is reserved for allocated nodeids
+	if high := net.ParseIP("fe80::8000:0:0:1"); deriveNodeid(high) != 1 {
+		t.Errorf("Unexpected nodeid %x for %v", deriveNodeid(high), high)
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	if err := db.SetDictionary(42, []string{"temp", ""}); err == nil {
+		t.Error("Expected error setting a dictionary with an empty entry")
+	}
+	if err := db.SetDictionary(42, []string{"temp", "room.hum", "room"}); err != nil {
+		t.Fatal("Could not set dictionary", err)
+	}
+	req := &Request{
+		keys:          []dictKey{{index: 0, indexed: true}, {name: "abc"}, {index: 1, indexed: true}},
+		data:          []dataItem{{key: dictKey{index: 1, indexed: true}, value: int64(3)}, {key: dictKey{name: "a"}, value: "b"}},
+		collection:    dictKey{index: 2, indexed: true},
+		hasCollection: true,
+	}
+	if err := req.expand(&expander{db: db, nodeid: 42}); err != nil {
+		t.Fatal("Could not expand request", err)
+	}
+	if len(req.Keys) != 3 || req.Keys[0] != "temp" || req.Keys[1] != "abc" || req.Keys[2] != "room.hum" {
+		t.Errorf("Unexpected expanded keys %v", req.Keys)
+	}
+	if len(req.Data) != 2 || req.Data["room.hum"] != int64(3) || req.Data["a"] != "b" {
+		t.Errorf("Unexpected expanded data %v", req.Data)
+	}
+	if req.Collection != "room" {
+		t.Errorf("Unexpected expanded collection %v", req.Collection)
+	}
+	_, err := (&expander{db: db, nodeid: 42}).expand(dictKey{index: 3, indexed: true})
+	if err == nil {
+		t.Error("Expected error expanding an index beyond the dictionary")
+	}
+	if err = db.SetDictionary(42, nil); err != nil {
+		t.Error("Could not remove dictionary", err)
+	}
+	if dict, _ := db.GetDictionary(42); len(dict) != 0 {
+		t.Errorf("Expected no dictionary after removing it but got %v", dict)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	if err := db.Delete([]string{"txn.count", "txn.state", "txn.big"}); err != nil {
+		t.Fatal(err)
+	}
+	revision, _ := db.Revision()
+	results, err := db.Txn("7", []TxnOp{
+		{Oper: "CAS", Data: map[string]interface{}{"txn.state": "on"}, Expect: map[string]interface{}{"txn.state": nil}},
+		{Oper: "INCR", Data: map[string]interface{}{"txn.count": int64(2)}},
+		{Oper: "INCR", Data: map[string]interface{}{"txn.count": uint64(3)}},
+		{Oper: "PERSIST", Data: map[string]interface{}{"txn": "yes"}},
+		{Oper: "GET", Keys: []string{"txn.state", "txn.missing"}},
+	})
+	if err != nil {
+		t.Fatal("Could not run transaction", err)
+	}
+	if len(results) != 5 || results[0] != nil || results[2]["txn.count"] != int64(5) ||
+		results[4]["txn.state"] != "on" || results[4]["txn.missing"] != nil {
+		t.Errorf("Unexpected results %v", results)
+	}
+	sets, err := db.ChangesSince(revision, 10)
+	if err != nil || len(sets) != 1 || len(sets[0].Changes) != 4 || sets[0].Writer != "7" {
+		t.Fatalf("Expected the transaction to be a single commit, got %+v (%v)", sets, err)
+	}
+	if change := sets[0].Changes[3]; !change.Persist || change.Key != "txn" || change.Collection != "7" || sets[0].Changes[0].Persist {
+		t.Errorf("Unexpected changes %+v", sets[0].Changes)
+	}
+
+	// a failing operation rolls back the whole transaction
+	for _, ops := range [][]TxnOp{
+		{{Oper: "INSERT", Data: map[string]interface{}{"txn.state": "off"}},
+			{Oper: "CAS", Data: map[string]interface{}{"txn.state": "idle"}, Expect: map[string]interface{}{"txn.state": "on"}}},
+		{{Oper: "DELETE", Keys: []string{"txn.count"}},
+			{Oper: "INCR", Data: map[string]interface{}{"txn.state": 1}}},
+		{{Oper: "INCR", Data: map[string]interface{}{"txn.count": int64(math.MaxInt64)}}},
+		{{Oper: "INCR", Data: map[string]interface{}{"txn.count": "1"}}},
+		{{Oper: "INSERT", Data: map[string]interface{}{"txn.state": 1.5}}},
+		{{Oper: "SETACL"}},
+	} {
+		if _, err = db.Txn("7", ops); err == nil {
+			t.Errorf("Expected error running %+v", ops)
+		}
+	}
+	if values, _ := db.Get([]string{"txn.state", "txn.count"}); values["txn.state"] != "on" || values["txn.count"] != int64(5) {
+		t.Errorf("Failed transactions were not rolled back: %v", values)
+	}
+	if _, err = db.Txn("", []TxnOp{{Oper: "INCR", Data: map[string]interface{}{"txn.big": uint64(1)}},
+		{Oper: "INCR", Data: map[string]interface{}{"txn.big": int64(-2)}}}); err == nil {
+		t.Error("Expected error decrementing an unsigned integer below 0")
+	}
+
+	// reading does not make a commit
+	revision, _ = db.Revision()
+	if results, err = db.Txn("", []TxnOp{{Oper: "GET", Keys: []string{"txn.count"}}}); err != nil || results[0]["txn.count"] != int64(5) {
+		t.Errorf("Unexpected results %v (%v)", results, err)
+	}
+	if current, _ := db.Revision(); current != revision {
+		t.Errorf("Read-only transaction moved the revision from %v to %v", revision, current)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	if err := db.SetIndexes("rooms", nil); err != nil {
+		t.Fatal(err)
+	}
+	existing, _ := db.GetBucket("rooms")
+	var keys []string
+	for k := range existing {
+		keys = append(keys, k)
+	}
+	if err := db.Delete(keys); err != nil {
+		t.Fatal(err)
+	}
+	// values stored before the index is set are indexed as well
+	err := db.Insert(map[string]interface{}{"rooms.r1.temp": int64(-3), "rooms.r1.name": "lab", "rooms.r2.temp": uint64(21)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Find("rooms", "temp", nil, nil); err == nil {
+		t.Error("Expected error looking up a field without an index")
+	}
+	if err = db.SetIndexes("rooms", []string{"temp", "temp"}); err == nil {
+		t.Error("Expected error indexing a field twice")
+	}
+	for _, invalid := range []string{"", "rooms.kitchen", ".index"} {
+		if err = db.SetIndexes(invalid, []string{"temp"}); err == nil {
+			t.Errorf("Expected error indexing collection %q", invalid)
+		}
+	}
+	if err = db.SetIndexes("rooms", []string{"temp", ""}); err != nil {
+		t.Fatal("Could not set indexes", err)
+	}
+	if fields, _ := db.GetIndexes("rooms"); len(fields) != 2 || fields[0] != "temp" || fields[1] != "" {
+		t.Errorf("Unexpected indexes %v", fields)
+	}
+	err = db.Insert(map[string]interface{}{"rooms.r3.temp": int64(21), "rooms.r4.temp": "broken", "rooms.r1.temp": int64(-5), "rooms.r3.name": "lab\x00b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Txn("", []TxnOp{{Oper: "DELETE", Keys: []string{"rooms.r4.temp"}}, {Oper: "INCR", Data: map[string]interface{}{"rooms.r5.temp": 30}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lookup := range []struct {
+		field    string
+		min, max interface{}
+		keys     []string
+	}{
+		{"temp", int64(21), int64(21), []string{"rooms.r2.temp", "rooms.r3.temp"}},
+		{"temp", uint64(0), nil, []string{"rooms.r2.temp", "rooms.r3.temp", "rooms.r5.temp"}},
+		{"temp", nil, int64(0), []string{"rooms.r1.temp"}},
+		{"temp", int64(-4), int64(-3), nil},
+		{"", "lab", "lab", []string{"rooms.r1.name"}},
+		{"", "lab", "lac", []string{"rooms.r1.name", "rooms.r3.name"}},
+		{"", "", nil, []string{"rooms.r1.name", "rooms.r3.name"}},
+	} {
+		found, err := db.Find("rooms", lookup.field, lookup.min, lookup.max)
+		if err != nil {
+			t.Errorf("Could not find %+v (%v)", lookup, err)
+			continue
+		}
+		if len(found) != len(lookup.keys) {
+			t.Errorf("Expected keys %v for %+v, got %v", lookup.keys, lookup, found)
+		}
+		for _, k := range lookup.keys {
+			if _, ok := found[k]; !ok || found[k] != existingValue(t, db, k) {
+				t.Errorf("Expected keys %v for %+v, got %v", lookup.keys, lookup, found)
+			}
+		}
+	}
+
+	// dropped indexes no longer answer lookups
+	if err = db.SetIndexes("rooms", []string{""}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Find("rooms", "temp", nil, nil); err == nil {
+		t.Error("Expected error looking up a dropped index")
+	}
+}
+
+func TestGetBucketFiltered(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	err := db.Insert(map[string]interface{}{"sensors.r1.temp": int64(-3), "sensors.r1.name": "lab", "sensors.r2.temp": uint64(21),
+		"sensors.r2.name": "office", "sensors.r3.temp": 30, "sensors.r3.name": "hall"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []struct {
+		filter Filter
+		keys   []string
+	}{
+		{Filter{}, []string{"r1.temp", "r1.name", "r2.temp", "r2.name", "r3.temp", "r3.name"}},
+		{Filter{Prefix: "r2."}, []string{"r2.temp", "r2.name"}},
+		{Filter{Glob: "r[12].temp"}, []string{"r1.temp", "r2.temp"}},
+		{Filter{Type: "string"}, []string{"r1.name", "r2.name", "r3.name"}},
+		{Filter{Gt: 0}, []string{"r2.temp", "r3.temp"}},
+		{Filter{Ge: int64(21), Lt: uint64(30)}, []string{"r2.temp"}},
+		{Filter{Le: "lab"}, []string{"r1.name", "r3.name"}},
+		{Filter{Glob: "*.name", Ne: "lab"}, []string{"r2.name", "r3.name"}},
+		{Filter{Prefix: "r1.", Ne: int64(-3)}, []string{"r1.name"}},
+		{Filter{Eq: 21}, []string{"r2.temp"}},
+		{Filter{Prefix: "r4."}, nil},
+	} {
+		filter := query.filter
+		entries, err := db.GetBucketFiltered("sensors", &filter)
+		if err != nil {
+			t.Errorf("Could not filter with %+v (%v)", filter, err)
+			continue
+		}
+		if len(entries) != len(query.keys) {
+			t.Errorf("Expected keys %v for %+v, got %v", query.keys, filter, entries)
+		}
+		for _, k := range query.keys {
+			if entry, ok := entries["sensors."+k]; !ok || entry.Value != existingValue(t, db, "sensors."+k) {
+				t.Errorf("Expected keys %v for %+v, got %v", query.keys, filter, entries)
+			}
+		}
+	}
+	for _, filter := range []Filter{{Glob: "r["}, {Type: "float"}, {Eq: 1.5}} {
+		if _, err = db.GetBucketFiltered("sensors", &filter); err == nil {
+			t.Errorf("Expected error filtering with %+v", filter)
+		}
+	}
+}
+
+// returns the value stored under [key]
+func existingValue(t *testing.T, db *DB, key string) interface{} {
+	values, err := db.Get([]string{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values[key]
+}
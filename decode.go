@@ -1,30 +1,165 @@
-package main
+package mpdb
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math"
+	"time"
 )
 
 type MessageType uint
 
 const (
-	DATA_WRITE = iota
+	DATA_WRITE MessageType = iota
 	DATA_PREV
 	DATA_NEXT
 	DATA_RANGE
 	TAG_GET
 	TAG_SET
 	QUERY
+	OPER_PERSIST
+	OPER_GETPERSIST
+	OPER_INSERT
+	OPER_GET
+	OPER_GETHISTORY
+	OPER_SETVERSIONING
+	OPER_GETBUCKET
+	OPER_SETACL
+	OPER_GETACL
+	OPER_REGISTER
+	OPER_LISTNODES
+	OPER_RENAMENODE
+	OPER_RETIRENODE
+	OPER_DELETE
+	OPER_SUBSCRIBE
+	OPER_RESPONSE
+	OPER_SETDICT
+	OPER_GETDICT
+	OPER_TXN
+	OPER_CAS
+	OPER_INCR
+	OPER_SETINDEX
+	OPER_FIND
 )
 
 // ^^ to be continued ...
 
+// the name of the oper each MessageType stands for
+var operNames = map[MessageType]string{
+	OPER_PERSIST:       "PERSIST",
+	OPER_GETPERSIST:    "GETPERSIST",
+	OPER_INSERT:        "INSERT",
+	OPER_GET:           "GET",
+	OPER_GETHISTORY:    "GETHISTORY",
+	OPER_SETVERSIONING: "SETVERSIONING",
+	OPER_GETBUCKET:     "GETBUCKET",
+	OPER_SETACL:        "SETACL",
+	OPER_GETACL:        "GETACL",
+	OPER_REGISTER:      "REGISTER",
+	OPER_LISTNODES:     "LISTNODES",
+	OPER_RENAMENODE:    "RENAMENODE",
+	OPER_RETIRENODE:    "RETIRENODE",
+	OPER_DELETE:        "DELETE",
+	OPER_SUBSCRIBE:     "SUBSCRIBE",
+	OPER_RESPONSE:      "RESPONSE",
+	OPER_SETDICT:       "SETDICT",
+	OPER_GETDICT:       "GETDICT",
+	OPER_TXN:           "TXN",
+	OPER_CAS:           "CAS",
+	OPER_INCR:          "INCR",
+	OPER_SETINDEX:      "SETINDEX",
+	OPER_FIND:          "FIND",
+}
+
+// Returns the name of the oper, or "" for message types that do not stand for
+// one
+func (t MessageType) String() string {
+	return operNames[t]
+}
+
+// returns the MessageType of the oper with the given name
+func operType(oper string) (MessageType, bool) {
+	for t, name := range operNames {
+		if name == oper {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// Ext is a msgpack extension type we do not know how to interpret. Data
+// points into the decoded input
+type Ext struct {
+	Type int8
+	Data []byte
+}
+
+// the extension type of msgpack timestamps, which decode to time.Time
+const timestampExtType = -1
+
+// Limits on what we are willing to decode. Containers can never have more
+// elements than there are bytes left in the input, but we also cap their length
+// and how deeply they can be nested, so that a malicious datagram cannot make
+// us allocate or recurse without bound
+const (
+	maxContainerLength = 1024
+	maxNestingDepth    = 16
+)
+
+// A message in compact mode starts with a fixed binary header, followed by
+// an optional msgpack map holding the other keys of the message:
+//
+//	type (1 byte) | length (2 bytes) | echo (4 bytes) | nodeid (8 bytes) | msgpack map
+//
+// All fields are little-endian. The length covers the whole message including
+// the header, so that several messages can be packed back to back. Because
+// message types are below 0x80, the first byte of a compact message is a
+// positive fixint, which is never a valid plain message (those are maps)
+type Header struct {
+	Type   MessageType
+	Length int
+	Echo   uint32
+	Nodeid uint64
+}
+
+const headerLength = 15
+
+// returns true if the message at [offset] is in compact mode
+func isCompact(input *[]byte, offset int) bool {
+	return offset < len(*input) && (*input)[offset] < 0x80
+}
+
 // Given a reference to a byte slice (probably your incoming buffer) and an
-// offset into that slice, decode the header and return the MessageType and the
-// total packet length
-func ParseHeader(input *[]byte, offset int) (MessageType, int) {
-	packetlength := int(getUintLE(input, offset, 2))
-	return DATA_WRITE, packetlength
+// offset into that slice, decode the header of a compact message, whose
+// Length is the total message length
+func ParseHeader(input *[]byte, offset int) (Header, error) {
+	var h Header
+	if err := need(input, offset, headerLength); err != nil {
+		return h, err
+	}
+	if !isCompact(input, offset) {
+		return h, fmt.Errorf("Invalid message type 0x%x at offset %v", (*input)[offset], offset)
+	}
+	h.Type = MessageType((*input)[offset])
+	h.Length = int(getUintLE(input, offset+1, 2))
+	h.Echo = uint32(getUintLE(input, offset+3, 4))
+	h.Nodeid = getUintLE(input, offset+7, 8)
+	if h.Length < headerLength {
+		return h, fmt.Errorf("Invalid message length %v at offset %v", h.Length, offset)
+	}
+	if err := need(input, offset, h.Length); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// returns an error if there are fewer than [n] bytes left in the input at
+// [offset]
+func need(input *[]byte, offset, n int) error {
+	if offset < 0 || n < 0 || offset > len(*input)-n {
+		return fmt.Errorf("msgpack input truncated: need %v bytes at offset %v, have %v", n, offset, len(*input)-offset)
+	}
+	return nil
 }
 
 func getUintLE(input *[]byte, offset, length int) uint64 {
@@ -43,7 +178,7 @@ func getUint(input *[]byte, offset, length int) uint64 {
 	return value
 }
 
-func parseUint(input *[]byte, offset int) (uint64, int) {
+func parseUint(input *[]byte, offset int) (uint64, int, error) {
 	var (
 		value    uint64
 		consumed int
@@ -51,64 +186,56 @@ func parseUint(input *[]byte, offset int) (uint64, int) {
 	c := (*input)[offset]
 	switch {
 	case c == 0xcc:
-		value = uint64((*input)[offset+1])
 		consumed = 2
 	case c == 0xcd:
-		value = getUint(input, offset+1, 2)
 		consumed = 3
 	case c == 0xce:
-		value = getUint(input, offset+1, 4)
 		consumed = 5
 	case c == 0xcf:
-		value = getUint(input, offset+1, 8)
 		consumed = 9
+	default:
+		return 0, 0, fmt.Errorf("msgpack byte %#x at offset %v is not a uint", c, offset)
+	}
+	if err := need(input, offset, consumed); err != nil {
+		return 0, 0, err
 	}
-	return value, consumed
+	value = getUint(input, offset+1, consumed-1)
+	return value, consumed, nil
 }
 
-func parseInt(input *[]byte, offset int) (int64, int) {
+func parseInt(input *[]byte, offset int) (int64, int, error) {
 	var (
 		value    int64
 		consumed int
-		tmp      uint64 // used for zero-copy conversion
 	)
 	c := (*input)[offset]
 	switch {
 	case c <= 0x7f:
-		value = int64(c)
-		consumed = 1
-		goto ret
+		return int64(c), 1, nil
 	case 0xe0 <= c && c <= 0xff:
-		value = -int64(c & 0x1f)
-		consumed = 1
-		goto ret
+		return int64(int8(c)), 1, nil
 	case c == 0xd0:
-		tmp = uint64((*input)[offset+1])
 		consumed = 2
 	case c == 0xd1:
-		tmp = getUint(input, offset+1, 2)
 		consumed = 3
 	case c == 0xd2:
-		tmp = getUint(input, offset+1, 4)
 		consumed = 5
 	case c == 0xd3:
-		tmp = getUint(input, offset+1, 8)
 		consumed = 9
 	default:
-		log.Debug("UNKNOWN int: %v", c)
+		return 0, 0, fmt.Errorf("msgpack byte %#x at offset %v is not an int", c, offset)
 	}
-
-	value = int64(tmp >> 1)
-	if tmp&1 != 0 {
-		value = ^value
+	if err := need(input, offset, consumed); err != nil {
+		return 0, 0, err
 	}
-
-ret:
-	return value, consumed
+	// sign-extend the two's complement value
+	bits := uint((consumed - 1) * 8)
+	value = int64(getUint(input, offset+1, consumed-1)<<(64-bits)) >> (64 - bits)
+	return value, consumed, nil
 }
 
-//TODO: parsing bigendian floats is not zero copy! :(
-func parseFloat(input *[]byte, offset int) (float64, int) {
+// TODO: parsing bigendian floats is not zero copy! :(
+func parseFloat(input *[]byte, offset int) (float64, int, error) {
 	var (
 		value    float64
 		consumed int
@@ -116,113 +243,280 @@ func parseFloat(input *[]byte, offset int) (float64, int) {
 	c := (*input)[offset]
 	switch {
 	case c == 0xca:
-		bits := binary.BigEndian.Uint64((*input)[offset+1 : offset+5])
-		value = math.Float64frombits(bits)
+		if err := need(input, offset, 5); err != nil {
+			return 0, 0, err
+		}
+		bits := binary.BigEndian.Uint32((*input)[offset+1 : offset+5])
+		value = float64(math.Float32frombits(bits))
 		consumed = 5
 	case c == 0xcb:
+		if err := need(input, offset, 9); err != nil {
+			return 0, 0, err
+		}
 		bits := binary.BigEndian.Uint64((*input)[offset+1 : offset+9])
 		value = math.Float64frombits(bits)
 		consumed = 9
+	default:
+		return 0, 0, fmt.Errorf("msgpack byte %#x at offset %v is not a float", c, offset)
 	}
-	return value, consumed
+	return value, consumed, nil
 }
 
-func parseString(input *[]byte, offset int) (string, int) {
+func parseString(input *[]byte, offset int) (string, int, error) {
 	var (
-		value    string
-		consumed int
-		length   int
+		length int
+		header int // number of bytes before the string itself
 	)
 	c := (*input)[offset]
 	switch {
 	case c >= 0xa0 && c <= 0xbf:
 		length = int(c & 0x1f)
-		value = string((*input)[offset+1 : offset+1+length])
-		consumed = length + 1
+		header = 1
 	case c == 0xd9:
-		length = int((*input)[offset+1])
-		value = string((*input)[offset+2 : offset+2+length])
-		consumed = length + 2
+		header = 2
 	case c == 0xda:
-		length = int(getUint(input, offset+1, 2))
-		value = string((*input)[offset+3 : offset+3+length])
-		consumed = length + 3
+		header = 3
 	case c == 0xdb:
-		length = int(getUint(input, offset+1, 4))
-		value = string((*input)[offset+5 : offset+5+length])
-		consumed = length + 5
+		header = 5
+	default:
+		return "", 0, fmt.Errorf("msgpack byte %#x at offset %v is not a string", c, offset)
+	}
+	if err := need(input, offset, header); err != nil {
+		return "", 0, err
+	}
+	if header > 1 {
+		length = int(getUint(input, offset+1, header-1))
 	}
-	return value, consumed
+	if err := need(input, offset+header, length); err != nil {
+		return "", 0, err
+	}
+	value := string((*input)[offset+header : offset+header+length])
+	return value, header + length, nil
 }
 
-func parseMap(input *[]byte, offset int) (map[string]interface{}, int) {
+func parseBin(input *[]byte, offset int) ([]byte, int, error) {
+	var header int // number of bytes before the data itself
+	c := (*input)[offset]
+	switch {
+	case c == 0xc4:
+		header = 2
+	case c == 0xc5:
+		header = 3
+	case c == 0xc6:
+		header = 5
+	default:
+		return nil, 0, fmt.Errorf("msgpack byte %#x at offset %v is not a bin", c, offset)
+	}
+	if err := need(input, offset, header); err != nil {
+		return nil, 0, err
+	}
+	length := int(getUint(input, offset+1, header-1))
+	if err := need(input, offset+header, length); err != nil {
+		return nil, 0, err
+	}
+	start, end := offset+header, offset+header+length
+	return (*input)[start:end:end], header + length, nil
+}
+
+// parses an extension type. Timestamps are returned as time.Time, and all
+// other types as Ext
+func parseExt(input *[]byte, offset int) (interface{}, int, error) {
 	var (
-		value  map[string]interface{}
 		length int
+		header int // number of bytes before the type byte
 	)
-	initialoffset := offset
+	c := (*input)[offset]
+	switch {
+	case c == 0xd4:
+		length, header = 1, 1
+	case c == 0xd5:
+		length, header = 2, 1
+	case c == 0xd6:
+		length, header = 4, 1
+	case c == 0xd7:
+		length, header = 8, 1
+	case c == 0xd8:
+		length, header = 16, 1
+	case c == 0xc7:
+		header = 2
+	case c == 0xc8:
+		header = 3
+	case c == 0xc9:
+		header = 5
+	default:
+		return nil, 0, fmt.Errorf("msgpack byte %#x at offset %v is not an ext", c, offset)
+	}
+	if err := need(input, offset, header+1); err != nil {
+		return nil, 0, err
+	}
+	if header > 1 {
+		length = int(getUint(input, offset+1, header-1))
+	}
+	exttype := int8((*input)[offset+header])
+	start := offset + header + 1
+	if err := need(input, start, length); err != nil {
+		return nil, 0, err
+	}
+	consumed := header + 1 + length
+	if exttype != timestampExtType {
+		return Ext{Type: exttype, Data: (*input)[start : start+length : start+length]}, consumed, nil
+	}
+
+	var (
+		sec  int64
+		nsec uint64
+	)
+	switch length {
+	case 4: // 32-bit unsigned seconds
+		sec = int64(getUint(input, start, 4))
+	case 8: // 30-bit nanoseconds and 34-bit unsigned seconds
+		data := getUint(input, start, 8)
+		nsec = data >> 34
+		sec = int64(data & 0x3ffffffff)
+	case 12: // 32-bit nanoseconds and 64-bit signed seconds
+		nsec = getUint(input, start, 4)
+		sec = int64(getUint(input, start+4, 8))
+	default:
+		return nil, 0, fmt.Errorf("msgpack timestamp at offset %v has invalid length %v", offset, length)
+	}
+	if nsec > 999999999 {
+		return nil, 0, fmt.Errorf("msgpack timestamp at offset %v has invalid nanoseconds %v", offset, nsec)
+	}
+	return time.Unix(sec, int64(nsec)).UTC(), consumed, nil
+}
+
+// checks the length of a map or array with its elements starting at [offset].
+// [perElement] is the minimum number of bytes taken by each element
+func checkContainerLength(input *[]byte, offset, length, perElement int) error {
+	if length > maxContainerLength {
+		return fmt.Errorf("msgpack container at offset %v has %v elements, more than the limit of %v", offset, length, maxContainerLength)
+	}
+	if length*perElement > len(*input)-offset {
+		return fmt.Errorf("msgpack input truncated: container at offset %v has %v elements but only %v bytes are left", offset, length, len(*input)-offset)
+	}
+	return nil
+}
+
+// parses the header of a map and returns the number of key/value pairs in it
+func parseMapHeader(input *[]byte, offset int) (int, int, error) {
+	var length, header int
 	c := (*input)[offset]
 	switch {
 	case c >= 0x80 && c <= 0x8f:
-		length = int((*input)[offset] & 0xf)
-		offset += 1
+		length, header = int(c&0xf), 1
 	case c == 0xde:
-		length = int(getUint(input, offset+1, 2))
-		offset += 3
+		header = 3
 	case c == 0xdf:
-		length = int(getUint(input, offset+1, 4))
-		offset += 5
+		header = 5
+	default:
+		return 0, 0, fmt.Errorf("msgpack byte %#x at offset %v is not a map", c, offset)
+	}
+	if err := need(input, offset, header); err != nil {
+		return 0, 0, err
+	}
+	if header > 1 {
+		length = int(getUint(input, offset+1, header-1))
+	}
+	if err := checkContainerLength(input, offset+header, length, 2); err != nil {
+		return 0, 0, err
+	}
+	return length, header, nil
+}
+
+// parses the header of an array and returns the number of elements in it
+func parseArrayHeader(input *[]byte, offset int) (int, int, error) {
+	var length, header int
+	c := (*input)[offset]
+	switch {
+	case c >= 0x90 && c <= 0x9f:
+		length, header = int(c&0xf), 1
+	case c == 0xdc:
+		header = 3
+	case c == 0xdd:
+		header = 5
+	default:
+		return 0, 0, fmt.Errorf("msgpack byte %#x at offset %v is not an array", c, offset)
+	}
+	if err := need(input, offset, header); err != nil {
+		return 0, 0, err
 	}
-	value = make(map[string]interface{}, length)
+	if header > 1 {
+		length = int(getUint(input, offset+1, header-1))
+	}
+	if err := checkContainerLength(input, offset+header, length, 1); err != nil {
+		return 0, 0, err
+	}
+	return length, header, nil
+}
+
+func parseMap(input *[]byte, offset int, depth int) (map[string]interface{}, int, error) {
+	initialoffset := offset
+	length, consumed, err := parseMapHeader(input, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += consumed
+	value := make(map[string]interface{}, length)
 	// get both a key and value for [length] elements
 	for mapidx := 0; mapidx < length; mapidx++ {
 		var key string
 		var ok bool
-		newoffset, _key := decode(input, offset)
+		_key, consumed, err := decodeValue(input, offset, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
 		if key, ok = _key.(string); !ok {
-			log.Debug("have key we don't understand: %v, byte is %v, offset is %v", _key, (*input)[offset], offset)
-			return value, 0
+			return nil, 0, fmt.Errorf("msgpack map key %v at offset %v is not a string", _key, offset)
+		}
+		offset += consumed
+		_value, consumed, err := decodeValue(input, offset, depth+1)
+		if err != nil {
+			return nil, 0, err
 		}
-		offset = newoffset
-		newoffset, _value := decode(input, offset)
 		value[key] = _value
-		offset = newoffset
+		offset += consumed
 	}
-	return value, offset - initialoffset
+	return value, offset - initialoffset, nil
 }
 
-func parseArray(input *[]byte, offset int) ([]interface{}, int) {
-	var (
-		value  []interface{}
-		length int
-	)
+func parseArray(input *[]byte, offset int, depth int) ([]interface{}, int, error) {
 	initialoffset := offset
-	c := (*input)[offset]
-	switch {
-	case c >= 0x90 && c <= 0x9f:
-		length = int((*input)[offset] & 0xf)
-		offset += 1
-	case c == 0xdc:
-		length = int(getUint(input, offset+1, 2))
-		offset += 3
-	case c == 0xdd:
-		length = int(getUint(input, offset+1, 4))
-		offset += 5
+	length, consumed, err := parseArrayHeader(input, offset)
+	if err != nil {
+		return nil, 0, err
 	}
-	value = make([]interface{}, length, length)
+	offset += consumed
+	value := make([]interface{}, length, length)
 	for arridx := 0; arridx < length; arridx++ {
-		newoffset, _val := decode(input, offset)
-		offset = newoffset
+		_val, consumed, err := decodeValue(input, offset, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += consumed
 		value[arridx] = _val
 	}
-	return value, offset - initialoffset
+	return value, offset - initialoffset, nil
+}
+
+// Decodes the msgpack object at [offset] in [input] and returns it along with
+// the number of bytes it took. Malformed, truncated or unsupported input
+// results in an error rather than a panic
+func decode(input *[]byte, offset int) (interface{}, int, error) {
+	return decodeValue(input, offset, 0)
 }
 
-func decode(input *[]byte, offset int) (int, interface{}) {
+func decodeValue(input *[]byte, offset int, depth int) (interface{}, int, error) {
+	if err := need(input, offset, 1); err != nil {
+		return nil, 0, err
+	}
+	if depth > maxNestingDepth {
+		return nil, 0, fmt.Errorf("msgpack object at offset %v is nested more than %v levels deep", offset, maxNestingDepth)
+	}
 	c := (*input)[offset]
 	var (
 		value    interface{} // the decoded value
 		consumed int         // how many bytes that value used
+		err      error
 	)
 	switch {
 	// int64
@@ -232,38 +526,38 @@ func decode(input *[]byte, offset int) (int, interface{}) {
 		0xd1 == c,              //int16
 		0xd2 == c,              //int32
 		0xd3 == c:              //int64
-		value, consumed = parseInt(input, offset)
+		value, consumed, err = parseInt(input, offset)
 
 	// uint64
 	case 0xcc == c, //uint8
 		0xcd == c, //uint16
 		0xce == c, //uint32
 		0xcf == c: //uint64
-		value, consumed = parseUint(input, offset)
+		value, consumed, err = parseUint(input, offset)
 
 	// float64
 	case 0xca == c, //float32
 		0xcb == c: //float64
-		value, consumed = parseFloat(input, offset)
+		value, consumed, err = parseFloat(input, offset)
 
 	// string
 	case 0xa0 <= c && c <= 0xbf, //fixstr
 		0xd9 == c, //str8
 		0xda == c, //str16
 		0xdb == c: //str32
-		value, consumed = parseString(input, offset)
+		value, consumed, err = parseString(input, offset)
 
 	// map[string]interface{}
 	case 0x80 <= c && c <= 0x8f, //fixmap
 		0xde == c, //map 16
 		0xdf == c: //map 32
-		value, consumed = parseMap(input, offset)
+		value, consumed, err = parseMap(input, offset, depth)
 
 	// array []interface{}
 	case 0x90 <= c && c <= 0x9f, //fixarray
 		0xdc == c, //array 16
 		0xdd == c: //array 32
-		value, consumed = parseArray(input, offset)
+		value, consumed, err = parseArray(input, offset, depth)
 
 	case 0xc0 == c: //nil
 		value, consumed = nil, 1
@@ -272,34 +566,28 @@ func decode(input *[]byte, offset int) (int, interface{}) {
 	case 0xc3 == c: //true
 		value, consumed = true, 1
 
-	case 0xc4 == c: //bin8
-		fallthrough
-	case 0xc5 == c: //bin16
-		fallthrough
-	case 0xc6 == c: //bin32
-		fallthrough
-
-	case 0xc7 == c: //ext8
-		fallthrough
-	case 0xc8 == c: //ext16
-		fallthrough
-	case 0xc9 == c: //ext32
-		fallthrough
-
-	case 0xd4 == c: //fixext 1
-		fallthrough
-	case 0xd5 == c: //fixext 2
-		fallthrough
-	case 0xd6 == c: //fixext 4
-		fallthrough
-	case 0xd7 == c: //fixext 8
-		fallthrough
-	case 0xd8 == c: //fixext 16
-		fallthrough
+	// []byte
+	case 0xc4 == c, //bin8
+		0xc5 == c, //bin16
+		0xc6 == c: //bin32
+		value, consumed, err = parseBin(input, offset)
 
-	default:
-		log.Error("Unrecognized msgpack byte %v", c)
+	// Ext or time.Time
+	case 0xc7 == c, //ext8
+		0xc8 == c, //ext16
+		0xc9 == c, //ext32
+		0xd4 == c, //fixext 1
+		0xd5 == c, //fixext 2
+		0xd6 == c, //fixext 4
+		0xd7 == c, //fixext 8
+		0xd8 == c: //fixext 16
+		value, consumed, err = parseExt(input, offset)
+
+	default: // 0xc1 is never used
+		err = fmt.Errorf("Unsupported msgpack byte %#x at offset %v", c, offset)
 	}
-	offset += consumed
-	return offset, value
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, consumed, nil
 }
@@ -0,0 +1,335 @@
+package mpdb
+
+import (
+	"bytes"
+	"github.com/ugorji/go/codec"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mh codec.MsgpackHandle
+
+// encodes [v] with a general-purpose msgpack encoder
+func encodeMsgpack(t testing.TB, v interface{}) []byte {
+	buf := []byte{}
+	if err := codec.NewEncoderBytes(&buf, &mh).Encode(v); err != nil {
+		t.Fatal("Could not encode", v, err)
+	}
+	return buf
+}
+
+var decodeSamples = []interface{}{
+	map[string]interface{}{"oper": "INSERT", "nodeid": uint64(0xbeef), "echo": uint64(1),
+		"data": map[string]interface{}{"a": uint64(1), "col.b": "hello"}},
+	map[string]interface{}{"oper": "GET", "nodeid": uint64(0xbeef), "echo": uint64(300),
+		"keys": []interface{}{"a", "col.b", "a long key that does not fit in a fixstr"}},
+	[]interface{}{uint64(1 << 40), "x", nil, true, false, []interface{}{}},
+}
+
+// encoder for test vectors that uses the whole msgpack spec: str8, bin and
+// ext (including timestamps)
+var specHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// values and what they should decode to. Integers decode to int64 when encoded
+// in an int format and to uint64 when encoded in a uint format, so they are
+// compared by value
+var decodeVectors = []struct {
+	value    interface{}
+	expected interface{}
+}{
+	{int64(0), int64(0)},
+	{int64(127), int64(127)},
+	{int64(-1), int64(-1)},
+	{int64(-32), int64(-32)},
+	{int64(-33), int64(-33)},
+	{int64(math.MinInt8), int64(math.MinInt8)},
+	{int64(math.MinInt8 - 1), int64(math.MinInt8 - 1)},
+	{int64(math.MaxInt16), int64(math.MaxInt16)},
+	{int64(math.MinInt16 - 1), int64(math.MinInt16 - 1)},
+	{int64(math.MaxInt32 + 1), int64(math.MaxInt32 + 1)},
+	{int64(math.MinInt32 - 1), int64(math.MinInt32 - 1)},
+	{int64(math.MinInt64), int64(math.MinInt64)},
+	{int64(math.MaxInt64), int64(math.MaxInt64)},
+	{uint64(128), uint64(128)},
+	{uint64(math.MaxUint8 + 1), uint64(math.MaxUint8 + 1)},
+	{uint64(math.MaxUint16 + 1), uint64(math.MaxUint16 + 1)},
+	{uint64(math.MaxUint64), uint64(math.MaxUint64)},
+	{float32(1.5), float64(1.5)},
+	{float64(-2.25), float64(-2.25)},
+	{nil, nil},
+	{true, true},
+	{false, false},
+	{"", ""},
+	{strings.Repeat("a", 31), strings.Repeat("a", 31)},
+	{strings.Repeat("b", 32), strings.Repeat("b", 32)},
+	{strings.Repeat("c", 256), strings.Repeat("c", 256)},
+	{strings.Repeat("d", 65536), strings.Repeat("d", 65536)},
+	{[]byte{}, []byte{}},
+	{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+	{bytes.Repeat([]byte{4}, 256), bytes.Repeat([]byte{4}, 256)},
+	{bytes.Repeat([]byte{5}, 65536), bytes.Repeat([]byte{5}, 65536)},
+	{time.Unix(1500000000, 0), time.Unix(1500000000, 0)},
+	{time.Unix(1500000000, 123456789), time.Unix(1500000000, 123456789)},
+	{time.Unix(-1, 5), time.Unix(-1, 5)},
+	{time.Unix(1<<35, 0), time.Unix(1<<35, 0)},
+	{[]interface{}{int64(-5), "x"}, []interface{}{int64(-5), "x"}},
+	{make([]interface{}, 16), make([]interface{}, 16)},
+	{map[string]interface{}{"a": int64(-100)}, map[string]interface{}{"a": int64(-100)}},
+}
+
+// compares decoded values, treating integers of different types as equal if
+// they have the same value
+func sameValue(a, b interface{}) bool {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return a == b
+		case uint64:
+			return a >= 0 && uint64(a) == b
+		}
+		return false
+	case uint64:
+		if b, ok := b.(int64); ok {
+			return sameValue(b, a)
+		}
+	case time.Time:
+		b, ok := b.(time.Time)
+		return ok && a.Equal(b)
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for idx := range a {
+			if !sameValue(a[idx], b[idx]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k := range a {
+			if !sameValue(a[k], b[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestDecodeVectors(t *testing.T) {
+	for _, vector := range decodeVectors {
+		buf := []byte{}
+		if err := codec.NewEncoderBytes(&buf, specHandle).Encode(vector.value); err != nil {
+			t.Fatal("Could not encode", vector.value, err)
+		}
+		decoded, consumed, err := decode(&buf, 0)
+		if err != nil {
+			t.Errorf("Could not decode %T %x (%v)", vector.value, buf[:1], err)
+			continue
+		}
+		if consumed != len(buf) {
+			t.Errorf("Decoding %T consumed %v of %v bytes", vector.value, consumed, len(buf))
+		}
+		if !sameValue(decoded, vector.expected) {
+			t.Errorf("Decoded %T %v did not match %v", decoded, decoded, vector.expected)
+		}
+	}
+}
+
+func TestDecodeExt(t *testing.T) {
+	for _, vector := range []struct {
+		input    []byte
+		expected interface{}
+	}{
+		{[]byte{0xd4, 0x05, 0xaa}, Ext{Type: 5, Data: []byte{0xaa}}},
+		{[]byte{0xd5, 0x80, 0xaa, 0xbb}, Ext{Type: -128, Data: []byte{0xaa, 0xbb}}},
+		{append([]byte{0xd8, 0x01}, make([]byte, 16)...), Ext{Type: 1, Data: make([]byte, 16)}},
+		{[]byte{0xc7, 0x00, 0x02}, Ext{Type: 2, Data: []byte{}}},
+		{[]byte{0xc8, 0x00, 0x03, 0x07, 1, 2, 3}, Ext{Type: 7, Data: []byte{1, 2, 3}}},
+		{[]byte{0xc9, 0x00, 0x00, 0x00, 0x01, 0x7f, 9}, Ext{Type: 127, Data: []byte{9}}},
+		{[]byte{0xd6, 0xff, 0x00, 0x00, 0x00, 0x01}, time.Unix(1, 0).UTC()},
+	} {
+		decoded, consumed, err := decode(&vector.input, 0)
+		if err != nil {
+			t.Errorf("Could not decode %x (%v)", vector.input, err)
+			continue
+		}
+		if consumed != len(vector.input) || !reflect.DeepEqual(decoded, vector.expected) {
+			t.Errorf("Decoded %x to %v using %v bytes, expected %v", vector.input, decoded, consumed, vector.expected)
+		}
+	}
+	// timestamps with invalid lengths or nanoseconds
+	for _, input := range [][]byte{
+		{0xd4, 0xff, 0x00},
+		{0xd7, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00},
+	} {
+		if _, _, err := decode(&input, 0); err == nil {
+			t.Errorf("Expected error decoding invalid timestamp %x", input)
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, sample := range decodeSamples {
+		buf := encodeMsgpack(t, sample)
+		if _, consumed, err := decode(&buf, 0); err != nil || consumed != len(buf) {
+			t.Errorf("Could not decode %v: consumed %v of %v bytes (%v)", sample, consumed, len(buf), err)
+		}
+		for length := 0; length < len(buf); length++ {
+			truncated := buf[:length]
+			if _, _, err := decode(&truncated, 0); err == nil {
+				t.Errorf("Expected error decoding %v truncated to %v bytes", sample, length)
+			}
+		}
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	for idx, input := range [][]byte{
+		// array 32 claiming 2^32-1 elements
+		{0xdd, 0xff, 0xff, 0xff, 0xff, 0x01},
+		// map 16 claiming more elements than the limit
+		append([]byte{0xde, 0xff, 0xff}, make([]byte, 2*0xffff)...),
+		// map with a non-string key
+		{0x81, 0x01, 0x01},
+		// unsupported format
+		{0xc1},
+	} {
+		if _, _, err := decode(&input, 0); err == nil {
+			t.Errorf("Expected error decoding input %v", idx)
+		}
+	}
+	var nested []byte
+	for i := 0; i <= maxNestingDepth+1; i++ {
+		nested = append(nested, 0x91)
+	}
+	nested = append(nested, 0x01)
+	if _, _, err := decode(&nested, 0); err == nil {
+		t.Errorf("Expected error decoding arrays nested %v deep", maxNestingDepth+2)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, sample := range decodeSamples {
+		f.Add(encodeMsgpack(f, sample))
+	}
+	f.Add([]byte{0xdf, 0x00, 0x00, 0x00, 0x01, 0xa1, 'a'})
+	f.Fuzz(func(t *testing.T, input []byte) {
+		value, consumed, err := decode(&input, 0)
+		if err != nil {
+			return
+		}
+		if consumed <= 0 || consumed > len(input) {
+			t.Errorf("Decoded %v using %v of %v bytes", value, consumed, len(input))
+		}
+	})
+}
+
+func TestDecodeRequest(t *testing.T) {
+	buf := encodeMsgpack(t, map[string]interface{}{
+		"oper":       uint64(OPER_SETACL),
+		"nodeid":     int64(0xbeef),
+		"echo":       uint64(7),
+		"collection": "room",
+		"acl":        []interface{}{map[string]interface{}{"first": 1, "last": 9, "rights": "rw"}, map[string]interface{}{"first": 12, "rights": "a"}},
+		"asof":       uint64(1500000000),
+		"meta":       true,
+		"data":       []interface{}{uint64(0), 21.5, "b", "x"},
+		"unknown":    map[string]interface{}{"skipped": []interface{}{1, 2}},
+	})
+	req, consumed, err := decodeRequest(&buf, 0)
+	if err != nil || consumed != len(buf) {
+		t.Fatalf("Could not decode request: consumed %v of %v bytes (%v)", consumed, len(buf), err)
+	}
+	if req.Oper != "SETACL" || req.Nodeid != 0xbeef || req.Echo != 7 || !req.Meta || req.Asof.Unix() != 1500000000 {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	if !req.hasCollection || req.collection.name != "room" {
+		t.Errorf("Unexpected collection %+v", req.collection)
+	}
+	if len(req.ACL) != 2 || req.ACL[0] != (ACLEntry{1, 9, RightRead | RightWrite}) || req.ACL[1] != (ACLEntry{12, 12, RightAdmin}) {
+		t.Errorf("Unexpected ACL %v", req.ACL)
+	}
+	if len(req.data) != 2 || !req.data[0].key.indexed || req.data[0].value != 21.5 || req.data[1].key.name != "b" {
+		t.Errorf("Unexpected data %+v", req.data)
+	}
+	if req.invalid == nil || req.expand(&expander{}) != req.invalid {
+		t.Errorf("Expected float value to make the request invalid, got %v", req.invalid)
+	}
+
+	// nil can only be expected by a CAS, never stored
+	for _, msg := range []map[string]interface{}{
+		{"oper": "INSERT", "nodeid": 1, "echo": 1, "data": map[string]interface{}{"a.b": nil}},
+		{"oper": "PERSIST", "nodeid": 1, "echo": 1, "data": map[string]interface{}{"a": map[string]interface{}{}}},
+		{"oper": "CAS", "nodeid": 1, "echo": 1, "data": map[string]interface{}{"a.b": true}},
+		{"oper": "TXN", "nodeid": 1, "echo": 1, "ops": []interface{}{map[string]interface{}{"oper": "INSERT", "data": map[string]interface{}{"a.b": []interface{}{}}}}},
+	} {
+		buf := encodeMsgpack(t, msg)
+		req, _, err := decodeRequest(&buf, 0)
+		if err != nil {
+			t.Fatalf("Could not decode request %v (%v)", msg, err)
+		}
+		if err = req.expand(&expander{}); err == nil || !strings.Contains(err.Error(), "Cannot store") {
+			t.Errorf("Expected error expanding %v, got %v", msg, err)
+		}
+	}
+	buf = encodeMsgpack(t, map[string]interface{}{"oper": "CAS", "nodeid": 1, "echo": 1,
+		"expect": map[string]interface{}{"a.b": nil}, "data": map[string]interface{}{"a.b": 1}})
+	if req, _, err = decodeRequest(&buf, 0); err != nil || req.invalid != nil {
+		t.Errorf("Unexpected result decoding CAS expecting nil %+v (%v)", req, err)
+	}
+
+	for _, bad := range []struct {
+		request map[string]interface{}
+		field   string
+	}{
+		{map[string]interface{}{"oper": "GET", "nodeid": "beef", "echo": 1}, `"nodeid"`},
+		{map[string]interface{}{"oper": "GET", "nodeid": 1, "echo": -1}, `"echo"`},
+		{map[string]interface{}{"oper": 200, "nodeid": 1, "echo": 1}, `"oper"`},
+		{map[string]interface{}{"oper": "GET", "nodeid": 1, "echo": 1, "keys": []interface{}{"a", true}}, `"keys"`},
+		{map[string]interface{}{"oper": "GET", "nodeid": 1, "echo": 1, "meta": 1}, `"meta"`},
+		{map[string]interface{}{"oper": "INSERT", "nodeid": 1, "echo": 1, "data": []interface{}{"a"}}, `"data"`},
+		{map[string]interface{}{"oper": "SETACL", "nodeid": 1, "echo": 1, "acl": []interface{}{map[string]interface{}{"first": 1, "rights": "x"}}}, `"acl"`},
+		{map[string]interface{}{"oper": "GET", "nodeid": 1}, `"echo"`},
+		{map[string]interface{}{"oper": "TXN", "nodeid": 1, "echo": 1, "ops": []interface{}{map[string]interface{}{"keys": []interface{}{"a"}}}}, `"ops"`},
+		{map[string]interface{}{"oper": "TXN", "nodeid": 1, "echo": 1, "ops": []interface{}{map[string]interface{}{"oper": "TXN", "ops": []interface{}{}}}}, `"ops"`},
+		{map[string]interface{}{"oper": "SETINDEX", "nodeid": 1, "echo": 1, "fields": []interface{}{1}}, `"fields"`},
+		{map[string]interface{}{"oper": "FIND", "nodeid": 1, "echo": 1, "field": 1}, `"field"`},
+		{map[string]interface{}{"oper": "GETBUCKET", "nodeid": 1, "echo": 1, "where": map[string]interface{}{"prefix": 1}}, `"where"`},
+	} {
+		buf := encodeMsgpack(t, bad.request)
+		if _, _, err := decodeRequest(&buf, 0); err == nil || !strings.Contains(err.Error(), bad.field) {
+			t.Errorf("Expected error about field %v decoding %v, got %v", bad.field, bad.request, err)
+		}
+		for length := 0; length < len(buf); length++ {
+			truncated := buf[:length]
+			if _, _, err := decodeRequest(&truncated, 0); err == nil {
+				t.Errorf("Expected error decoding %v truncated to %v bytes", bad.request, length)
+			}
+		}
+	}
+}
+
+func FuzzDecodeRequest(f *testing.F) {
+	for _, sample := range decodeSamples {
+		f.Add(encodeMsgpack(f, sample))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		req, consumed, err := decodeRequest(&input, 0)
+		if err != nil {
+			return
+		}
+		if consumed <= 0 || consumed > len(input) {
+			t.Errorf("Decoded %+v using %v of %v bytes", req, consumed, len(input))
+		}
+	})
+}
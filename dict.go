@@ -0,0 +1,95 @@
+package mpdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+// A node can store a dictionary of the keys and collection names it uses most.
+// Its requests can then refer to an entry by its index in the dictionary
+// instead of spelling it out, and MPDB expands the indexes before executing
+// the request. Dictionaries are stored by nodeid, so they survive restarts of
+// both the node and the server
+var dictionariesBucket = []byte(".dictionaries")
+
+// the maximum number of entries in a dictionary
+const maxDictionaryLength = 1024
+
+// SetDictionary replaces the dictionary of [nodeid] with [entries]. An empty
+// list of entries removes the dictionary
+func (db *DB) SetDictionary(nodeid uint64, entries []string) error {
+	if len(entries) > maxDictionaryLength {
+		return fmt.Errorf("Dictionary has %v entries, the maximum is %v", len(entries), maxDictionaryLength)
+	}
+	for idx, entry := range entries {
+		if entry == "" {
+			return fmt.Errorf("Dictionary entry %v is empty", idx)
+		}
+	}
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(dictionariesBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create dictionaries bucket (%s)", err)
+		}
+		if len(entries) == 0 {
+			return b.Delete(itob(nodeid))
+		}
+		var buf = new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(entries); err != nil {
+			return err
+		}
+		return b.Put(itob(nodeid), buf.Bytes())
+	})
+	return err
+}
+
+// GetDictionary returns the dictionary of [nodeid], which is empty if the node
+// does not have one
+func (db *DB) GetDictionary(nodeid uint64) ([]string, error) {
+	var entries []string
+	err := db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dictionariesBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get(itob(nodeid))
+		if v == nil {
+			return nil
+		}
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&entries); err != nil {
+			return fmt.Errorf("Could not decode dictionary for node %v (%s)", nodeid, err)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// expands dictionary indexes in the requests of a node. The dictionary is
+// only loaded once a request uses an index
+type expander struct {
+	db     *DB
+	nodeid uint64
+	dict   []string
+	loaded bool
+}
+
+// returns the name of [k], looking it up in the dictionary if it was sent as
+// an index
+func (e *expander) expand(k dictKey) (string, error) {
+	if !k.indexed {
+		return k.name, nil
+	}
+	if !e.loaded {
+		dict, err := e.db.GetDictionary(e.nodeid)
+		if err != nil {
+			return "", err
+		}
+		e.dict, e.loaded = dict, true
+	}
+	if k.index >= uint64(len(e.dict)) {
+		return "", fmt.Errorf("Node %v does not have dictionary entry %v", e.nodeid, k.index)
+	}
+	return e.dict[k.index], nil
+}
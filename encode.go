@@ -0,0 +1,343 @@
+package mpdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Encoder counterpart to decode.go. Values are appended to the referenced byte
+// slice using the smallest msgpack representation for each integer, string and
+// container, so that responses are as small as possible on air. Non-negative
+// integers are always encoded in the unsigned formats, and maps are encoded
+// with their keys in order
+
+// buffers for encoding outgoing messages. Datagrams are small, so a buffer
+// rarely needs to grow
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// returns an empty buffer from the pool
+func getBuffer() *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+// returns a buffer to the pool. The buffer must not be used afterwards
+func putBuffer(buf *[]byte) {
+	bufferPool.Put(buf)
+}
+
+func putUint(output *[]byte, value uint64, length int) {
+	for i := 0; i < length; i++ {
+		*output = append(*output, byte(value>>uint((length-i-1)*8)))
+	}
+}
+
+func encodeUint(output *[]byte, value uint64) {
+	switch {
+	case value <= 0x7f: // positive fixint
+		*output = append(*output, byte(value))
+	case value <= math.MaxUint8:
+		*output = append(*output, 0xcc, byte(value))
+	case value <= math.MaxUint16:
+		*output = append(*output, 0xcd)
+		putUint(output, value, 2)
+	case value <= math.MaxUint32:
+		*output = append(*output, 0xce)
+		putUint(output, value, 4)
+	default:
+		*output = append(*output, 0xcf)
+		putUint(output, value, 8)
+	}
+}
+
+func encodeInt(output *[]byte, value int64) {
+	switch {
+	case value >= 0:
+		encodeUint(output, uint64(value))
+	case value >= -32: // negative fixint
+		*output = append(*output, byte(value))
+	case value >= math.MinInt8:
+		*output = append(*output, 0xd0, byte(value))
+	case value >= math.MinInt16:
+		*output = append(*output, 0xd1)
+		putUint(output, uint64(value), 2)
+	case value >= math.MinInt32:
+		*output = append(*output, 0xd2)
+		putUint(output, uint64(value), 4)
+	default:
+		*output = append(*output, 0xd3)
+		putUint(output, uint64(value), 8)
+	}
+}
+
+func encodeFloat(output *[]byte, value float64) {
+	if float64(float32(value)) == value {
+		*output = append(*output, 0xca)
+		putUint(output, uint64(math.Float32bits(float32(value))), 4)
+		return
+	}
+	*output = append(*output, 0xcb)
+	putUint(output, math.Float64bits(value), 8)
+}
+
+func encodeString(output *[]byte, value string) {
+	length := len(value)
+	switch {
+	case length <= 31: // fixstr
+		*output = append(*output, 0xa0|byte(length))
+	case length <= math.MaxUint8:
+		*output = append(*output, 0xd9, byte(length))
+	case length <= math.MaxUint16:
+		*output = append(*output, 0xda)
+		putUint(output, uint64(length), 2)
+	default:
+		*output = append(*output, 0xdb)
+		putUint(output, uint64(length), 4)
+	}
+	*output = append(*output, value...)
+}
+
+func encodeBin(output *[]byte, value []byte) {
+	length := len(value)
+	switch {
+	case length <= math.MaxUint8:
+		*output = append(*output, 0xc4, byte(length))
+	case length <= math.MaxUint16:
+		*output = append(*output, 0xc5)
+		putUint(output, uint64(length), 2)
+	default:
+		*output = append(*output, 0xc6)
+		putUint(output, uint64(length), 4)
+	}
+	*output = append(*output, value...)
+}
+
+func encodeExt(output *[]byte, exttype int8, data []byte) {
+	length := len(data)
+	switch {
+	case length == 1:
+		*output = append(*output, 0xd4)
+	case length == 2:
+		*output = append(*output, 0xd5)
+	case length == 4:
+		*output = append(*output, 0xd6)
+	case length == 8:
+		*output = append(*output, 0xd7)
+	case length == 16:
+		*output = append(*output, 0xd8)
+	case length <= math.MaxUint8:
+		*output = append(*output, 0xc7, byte(length))
+	case length <= math.MaxUint16:
+		*output = append(*output, 0xc8)
+		putUint(output, uint64(length), 2)
+	default:
+		*output = append(*output, 0xc9)
+		putUint(output, uint64(length), 4)
+	}
+	*output = append(*output, byte(exttype))
+	*output = append(*output, data...)
+}
+
+// encodes a time.Time as a msgpack timestamp, using the 32, 64 or 96-bit
+// format depending on what the time needs
+func encodeTime(output *[]byte, value time.Time) {
+	sec, nsec := value.Unix(), uint64(value.Nanosecond())
+	switch {
+	case nsec == 0 && sec >= 0 && sec <= math.MaxUint32:
+		*output = append(*output, 0xd6, 0xff)
+		putUint(output, uint64(sec), 4)
+	case sec >= 0 && sec>>34 == 0:
+		*output = append(*output, 0xd7, 0xff)
+		putUint(output, nsec<<34|uint64(sec), 8)
+	default:
+		*output = append(*output, 0xc7, 12, 0xff)
+		putUint(output, nsec, 4)
+		putUint(output, uint64(sec), 8)
+	}
+}
+
+func encodeMapHeader(output *[]byte, length int) {
+	switch {
+	case length <= 15: // fixmap
+		*output = append(*output, 0x80|byte(length))
+	case length <= math.MaxUint16:
+		*output = append(*output, 0xde)
+		putUint(output, uint64(length), 2)
+	default:
+		*output = append(*output, 0xdf)
+		putUint(output, uint64(length), 4)
+	}
+}
+
+func encodeArrayHeader(output *[]byte, length int) {
+	switch {
+	case length <= 15: // fixarray
+		*output = append(*output, 0x90|byte(length))
+	case length <= math.MaxUint16:
+		*output = append(*output, 0xdc)
+		putUint(output, uint64(length), 2)
+	default:
+		*output = append(*output, 0xdd)
+		putUint(output, uint64(length), 4)
+	}
+}
+
+// Appends the msgpack encoding of [value] to [output]. Supports all the types
+// produced by decode, along with the other integer types and []string
+func encode(output *[]byte, value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		*output = append(*output, 0xc0)
+	case bool:
+		if value {
+			*output = append(*output, 0xc3)
+		} else {
+			*output = append(*output, 0xc2)
+		}
+	case int:
+		encodeInt(output, int64(value))
+	case int8:
+		encodeInt(output, int64(value))
+	case int16:
+		encodeInt(output, int64(value))
+	case int32:
+		encodeInt(output, int64(value))
+	case int64:
+		encodeInt(output, value)
+	case uint:
+		encodeUint(output, uint64(value))
+	case uint8:
+		encodeUint(output, uint64(value))
+	case uint16:
+		encodeUint(output, uint64(value))
+	case uint32:
+		encodeUint(output, uint64(value))
+	case uint64:
+		encodeUint(output, value)
+	case float32:
+		*output = append(*output, 0xca)
+		putUint(output, uint64(math.Float32bits(value)), 4)
+	case float64:
+		encodeFloat(output, value)
+	case string:
+		encodeString(output, value)
+	case []byte:
+		encodeBin(output, value)
+	case time.Time:
+		encodeTime(output, value)
+	case Ext:
+		encodeExt(output, value.Type, value.Data)
+	case []string:
+		encodeArrayHeader(output, len(value))
+		for _, item := range value {
+			encodeString(output, item)
+		}
+	case []interface{}:
+		encodeArrayHeader(output, len(value))
+		for _, item := range value {
+			if err := encode(output, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if value == nil {
+			*output = append(*output, 0xc0)
+			break
+		}
+		encodeMapHeader(output, len(value))
+		for _, k := range sortedKeys(value) {
+			encodeString(output, k)
+			if err := encode(output, value[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Cannot encode value %v of type %T as msgpack", value, value)
+	}
+	return nil
+}
+
+// Appends [msg] to [output] as a compact message (see Header) if [compact] is
+// set, or as a plain msgpack map otherwise. In compact mode, the "oper",
+// "echo" and "nodeid" keys go into the header, and keys with nil values are
+// left out of the body
+func encodeMessage(output *[]byte, msg map[string]interface{}, compact bool) error {
+	if !compact {
+		return encode(output, msg)
+	}
+	oper, _ := msg["oper"].(string)
+	msgtype, found := operType(oper)
+	if !found {
+		return fmt.Errorf("Cannot encode oper %q in compact mode", oper)
+	}
+	echo := getUint64(msg["echo"])
+	if echo > math.MaxUint32 {
+		return fmt.Errorf("Echo tag %v does not fit in a compact header", echo)
+	}
+	start := len(*output)
+	*output = append(*output, byte(msgtype), 0, 0)
+	putUintLE(output, echo, 4)
+	putUintLE(output, getUint64(msg["nodeid"]), 8)
+
+	var keys []string
+	for _, k := range sortedKeys(msg) {
+		if !isNil(msg[k]) && k != "oper" && k != "echo" && k != "nodeid" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) > 0 {
+		encodeMapHeader(output, len(keys))
+		for _, k := range keys {
+			encodeString(output, k)
+			if err := encode(output, msg[k]); err != nil {
+				*output = (*output)[:start]
+				return err
+			}
+		}
+	}
+	total := len(*output) - start
+	if total > math.MaxUint16 {
+		*output = (*output)[:start]
+		return fmt.Errorf("Message of %v bytes is too long for compact mode", total)
+	}
+	(*output)[start+1] = byte(total)
+	(*output)[start+2] = byte(total >> 8)
+	return nil
+}
+
+// returns the keys of [m] in order, so that maps always encode to the same
+// bytes
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func putUintLE(output *[]byte, value uint64, length int) {
+	for i := 0; i < length; i++ {
+		*output = append(*output, byte(value>>uint(i*8)))
+	}
+}
+
+// returns true if [value] encodes as msgpack nil
+func isNil(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return value == nil
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package mpdb
+
+import (
+	"github.com/ugorji/go/codec"
+	"testing"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, vector := range decodeVectors {
+		buf := []byte{}
+		if err := encode(&buf, vector.value); err != nil {
+			t.Errorf("Could not encode %v (%v)", vector.value, err)
+			continue
+		}
+		decoded, consumed, err := decode(&buf, 0)
+		if err != nil {
+			t.Errorf("Could not decode encoded %T (%v)", vector.value, err)
+			continue
+		}
+		if consumed != len(buf) {
+			t.Errorf("Decoding encoded %T consumed %v of %v bytes", vector.value, consumed, len(buf))
+		}
+		if !sameValue(decoded, vector.expected) {
+			t.Errorf("Decoded %T %v did not match %v", decoded, decoded, vector.expected)
+		}
+	}
+}
+
+func TestEncodeSmallest(t *testing.T) {
+	for _, vector := range []struct {
+		value interface{}
+		size  int
+	}{
+		{0, 1},
+		{int64(127), 1},
+		{int64(128), 2},
+		{uint64(255), 2},
+		{int64(256), 3},
+		{-1, 1},
+		{-32, 1},
+		{-33, 2},
+		{-129, 3},
+		{uint64(1 << 32), 9},
+		{"", 1},
+		{"0123456789012345678901234567890", 32},
+		{"01234567890123456789012345678901", 34},
+		{[]interface{}{}, 1},
+		{map[string]interface{}{"a": 1}, 4},
+	} {
+		buf := []byte{}
+		if err := encode(&buf, vector.value); err != nil {
+			t.Errorf("Could not encode %v (%v)", vector.value, err)
+		}
+		if len(buf) != vector.size {
+			t.Errorf("Encoded %v %T in %v bytes instead of %v", vector.value, vector.value, len(buf), vector.size)
+		}
+	}
+}
+
+// a typical response to a GET
+var benchmarkResponse = map[string]interface{}{
+	"oper":   "RESPONSE",
+	"nodeid": uint64(0xbeef),
+	"echo":   uint64(1234),
+	"result": map[string]interface{}{"a": 1, "col.b": "hello", "col.c": int64(-40000)},
+	"error":  nil,
+}
+
+func BenchmarkEncode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := getBuffer()
+		if err := encode(buf, benchmarkResponse); err != nil {
+			b.Fatal(err)
+		}
+		putBuffer(buf)
+	}
+}
+
+func BenchmarkCodecEncode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := []byte{}
+		if err := codec.NewEncoderBytes(&buf, &mh).Encode(benchmarkResponse); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEncodeDeterministic(t *testing.T) {
+	msg := map[string]interface{}{"oper": "RESPONSE", "nodeid": uint64(1), "echo": uint64(2), "result": map[string]interface{}{
+		"a": uint64(1), "b": "two", "c": int64(-3), "d": nil, "e": map[string]interface{}{"z": uint64(1), "y": uint64(2)},
+	}}
+	for _, compact := range []bool{false, true} {
+		var first []byte
+		if err := encodeMessage(&first, msg, compact); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			var buf []byte
+			if err := encodeMessage(&buf, msg, compact); err != nil || string(buf) != string(first) {
+				t.Fatalf("Encoding of %v changed from %x to %x (%v)", msg, first, buf, err)
+			}
+		}
+	}
+	var buf []byte
+	encode(&buf, map[string]interface{}{"b": uint64(2), "a": uint64(1)})
+	if string(buf) != "\x82\xa1a\x01\xa1b\x02" {
+		t.Errorf("Map keys were not encoded in order: %x", buf)
+	}
+}
+
+func TestCompactMessage(t *testing.T) {
+	request := map[string]interface{}{
+		"oper":   "GET",
+		"nodeid": uint64(0xbeef),
+		"echo":   uint64(3),
+		"keys":   []interface{}{"a", "col.b"},
+	}
+	plain := map[string]interface{}{"oper": "INSERT", "nodeid": uint64(1), "echo": uint64(4)}
+	var buf []byte
+	if err := encodeMessage(&buf, request, true); err != nil {
+		t.Fatal(err)
+	}
+	compactLength := len(buf)
+	if err := encodeMessage(&buf, plain, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeMessage(&buf, map[string]interface{}{"oper": "LISTNODES", "nodeid": uint64(1), "echo": uint64(5), "result": nil}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := ParseHeader(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Type != OPER_GET || h.Length != compactLength || h.Echo != 3 || h.Nodeid != 0xbeef {
+		t.Errorf("Unexpected header %+v", h)
+	}
+	var decoded []*Request
+	for offset := 0; offset < len(buf); {
+		req, consumed, err := decodeRequest(&buf, offset)
+		if err != nil {
+			t.Fatalf("Could not decode request at offset %v (%v)", offset, err)
+		}
+		offset += consumed
+		decoded = append(decoded, req)
+	}
+	if len(decoded) != 3 {
+		t.Fatalf("Expected 3 requests, got %v", len(decoded))
+	}
+	if req := decoded[0]; req.Oper != "GET" || req.Nodeid != 0xbeef || req.Echo != 3 || len(req.keys) != 2 || req.keys[1].name != "col.b" {
+		t.Errorf("Compact request did not round trip: %+v", req)
+	}
+	if req := decoded[1]; req.Oper != "INSERT" || req.Nodeid != 1 || req.Echo != 4 {
+		t.Errorf("Plain request did not round trip: %+v", req)
+	}
+	if req := decoded[2]; req.Oper != "LISTNODES" || req.Echo != 5 {
+		t.Errorf("Expected compact request without body, got %+v", req)
+	}
+
+	// length shorter than the header, and longer than the input
+	for _, bad := range [][]byte{
+		{byte(OPER_GET), 14, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0},
+		{byte(OPER_GET), 16, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0},
+		{byte(OPER_GET), 16, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0x01},
+	} {
+		if _, _, err := decodeRequest(&bad, 0); err == nil {
+			t.Errorf("Expected error decoding %v", bad)
+		}
+	}
+}
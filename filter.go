@@ -0,0 +1,85 @@
+package mpdb
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A Filter selects entries of a collection by key and value (see
+// GetBucketFiltered). Every condition that is set must hold. Keys are matched
+// without the collection prefix
+type Filter struct {
+	// keys must start with Prefix
+	Prefix string
+	// keys must match the pattern Glob, in the syntax of path.Match, e.g.
+	// "r*.temp"
+	Glob string
+	// values must have this type: one of uint64, int64, int, uint and string
+	Type string
+	// values must be equal to Eq, not equal to Ne, less than Lt, and so on.
+	// Integers of any type compare by value, and strings bytewise. Integers
+	// and strings are never equal, and not ordered, so a string only matches
+	// a Lt, Le, Gt or Ge bound that is a string
+	Eq, Ne, Lt, Le, Gt, Ge interface{}
+}
+
+// checks that the bounds of [f] can be compared with and that its pattern is
+// well-formed
+func (f *Filter) validate() error {
+	for _, bound := range []interface{}{f.Eq, f.Ne, f.Lt, f.Le, f.Gt, f.Ge} {
+		if bound != nil && !storableValue(bound) {
+			return fmt.Errorf("Cannot compare with value %v of type %T", bound, bound)
+		}
+	}
+	if f.Type != "" && !containsString(valueTypes, f.Type) {
+		return fmt.Errorf("Unknown value type %s", f.Type)
+	}
+	if _, err := path.Match(f.Glob, ""); err != nil {
+		return fmt.Errorf("Invalid pattern %s (%s)", f.Glob, err)
+	}
+	return nil
+}
+
+// returns true if the entry with [key] (without the collection prefix) and
+// Record [rec] matches [f]
+func (f *Filter) match(key string, rec *Record) (bool, error) {
+	if !strings.HasPrefix(key, f.Prefix) {
+		return false, nil
+	}
+	if f.Glob != "" {
+		if matched, err := path.Match(f.Glob, key); err != nil || !matched {
+			return false, err
+		}
+	}
+	if f.Type != "" && (rec.Which < 0 || rec.Which >= len(valueTypes) || valueTypes[rec.Which] != f.Type) {
+		return false, nil
+	}
+	value, err := rec.value()
+	if err != nil {
+		return false, err
+	}
+	for _, cond := range []struct {
+		bound interface{}
+		holds func(cmp int) bool
+	}{
+		{f.Eq, func(cmp int) bool { return cmp == 0 }},
+		{f.Lt, func(cmp int) bool { return cmp < 0 }},
+		{f.Le, func(cmp int) bool { return cmp <= 0 }},
+		{f.Gt, func(cmp int) bool { return cmp > 0 }},
+		{f.Ge, func(cmp int) bool { return cmp >= 0 }},
+	} {
+		if cond.bound == nil {
+			continue
+		}
+		if cmp, ok := compareValues(value, cond.bound); !ok || !cond.holds(cmp) {
+			return false, nil
+		}
+	}
+	if f.Ne != nil {
+		if cmp, ok := compareValues(value, f.Ne); ok && cmp == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,597 @@
+package mpdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The HTTP gateway exposes the collections and persist buckets as JSON
+// resources, for dashboards and scripts that cannot speak the UDP protocol:
+//
+//	GET    /collections/{c}?after={k}&limit={n}  entries of a collection, in key order
+//	GET    /collections/{c}/keys/{k}             entry of a key
+//	PUT    /collections/{c}/keys/{k}             stores a value
+//	DELETE /collections/{c}/keys/{k}             deletes a key
+//	GET    /nodes/{nodeid}/persist               persist bucket of a node
+//	GET    /nodes/{nodeid}/persist/{k}           value of a persist key
+//	PUT    /nodes/{nodeid}/persist/{k}           stores a persist value
+//	GET    /changes?collection={c}&prefix={p}    server-sent events for each commit
+//
+// Path segments are URL-escaped, so keys can contain slashes. Requests are
+// made on behalf of the node of the bearer token in the Authorization header,
+// or of the node the client address resolves to, and are subject to the same
+// ACLs as over UDP. The persist endpoints require the token of the node
+
+// the default and maximum number of entries in a page of a collection
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// the largest request body the gateway reads
+const maxBodySize = 1 << 16
+
+// how often an idle change stream sends a comment, so that proxies do not
+// close it, and the number of commits it reads from the change log at once
+const (
+	streamKeepalive = 15 * time.Second
+	streamPageSize  = 100
+)
+
+// names of the types a Record can hold, indexed by Record.Which
+var valueTypes = []string{"uint64", "int64", "int", "uint", "string"}
+
+// JSON form of a stored value, which keeps the type it is stored with
+type jsonValue struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// JSON form of an Entry
+type jsonEntry struct {
+	Key string `json:"key"`
+	jsonValue
+	Modified time.Time `json:"modified"`
+	Writer   string    `json:"writer"`
+	Revision uint64    `json:"revision"`
+}
+
+// JSON form of a Change. The type and value are left out for deletions
+type jsonChange struct {
+	Key        string `json:"key"`
+	Collection string `json:"collection"`
+	Persist    bool   `json:"persist,omitempty"`
+	Deleted    bool   `json:"deleted,omitempty"`
+	*jsonValue
+}
+
+// JSON form of a ChangeSet
+type jsonChangeSet struct {
+	Revision uint64       `json:"revision"`
+	Time     time.Time    `json:"time"`
+	Writer   string       `json:"writer"`
+	Changes  []jsonChange `json:"changes"`
+}
+
+// a page of the entries of a collection. Next is the key to pass as [after]
+// to get the next page, or "" on the last page
+type jsonPage struct {
+	Entries []jsonEntry `json:"entries"`
+	Next    string      `json:"next,omitempty"`
+}
+
+// returns the JSON form of [value], which was read from the database and so
+// has a type a Record can hold
+func toJSONValue(value interface{}) jsonValue {
+	rec, _ := toRecord(value)
+	return jsonValue{Type: valueTypes[rec.Which], Value: value}
+}
+
+// returns the JSON form of [entry], stored under the full key [key]
+func toJSONEntry(key string, entry *Entry) jsonEntry {
+	return jsonEntry{Key: key, jsonValue: toJSONValue(entry.Value),
+		Modified: entry.Modified, Writer: entry.Writer, Revision: entry.Revision}
+}
+
+// parses a value to store. The body is either a typed value like
+// {"type": "int64", "value": -3}, or a bare string or integer. Bare integers
+// are stored as uint64 if they are not negative and as int64 otherwise, like
+// msgpack integers
+func parseJSONValue(body []byte) (interface{}, error) {
+	var raw interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("Invalid JSON value (%s)", err)
+	}
+	switch raw := raw.(type) {
+	case string:
+		return raw, nil
+	case json.Number:
+		if u, err := strconv.ParseUint(raw.String(), 10, 64); err == nil {
+			return u, nil
+		}
+		if i, err := strconv.ParseInt(raw.String(), 10, 64); err == nil {
+			return i, nil
+		}
+		return nil, fmt.Errorf("Value %v is not a 64-bit integer", raw)
+	case map[string]interface{}:
+		typ, _ := raw["type"].(string)
+		if len(raw) != 2 || typ == "" || raw["value"] == nil {
+			return nil, fmt.Errorf("Typed values need exactly a type and a value")
+		}
+		if typ == "string" {
+			if s, ok := raw["value"].(string); ok {
+				return s, nil
+			}
+			return nil, fmt.Errorf("Value of type string is not a string")
+		}
+		num, ok := raw["value"].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("Value of type %s is not a number", typ)
+		}
+		return parseTypedInteger(typ, num.String())
+	default:
+		return nil, fmt.Errorf("Values must be strings or integers")
+	}
+}
+
+// parses [s] as an integer of the Record type named [typ]
+func parseTypedInteger(typ, s string) (interface{}, error) {
+	var (
+		u   uint64
+		i   int64
+		err error
+	)
+	switch typ {
+	case "uint64":
+		u, err = strconv.ParseUint(s, 10, 64)
+		return u, err
+	case "int64":
+		i, err = strconv.ParseInt(s, 10, 64)
+		return i, err
+	case "uint":
+		u, err = strconv.ParseUint(s, 10, strconv.IntSize)
+		return uint(u), err
+	case "int":
+		i, err = strconv.ParseInt(s, 10, strconv.IntSize)
+		return int(i), err
+	default:
+		return nil, fmt.Errorf("Unknown value type %q", typ)
+	}
+}
+
+// an error with the HTTP status it is reported with
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func httpErrorf(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+// Handler returns the HTTP gateway of the server, so that it can be mounted in
+// another HTTP server. Start serves it on the addresses in ListenHTTP
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(s.serveHTTP)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+	segments, err := pathSegments(r.URL)
+	switch {
+	case err != nil:
+	case len(segments) == 1 && segments[0] == "changes":
+		// once the stream has started, errors can no longer be reported
+		if err = s.httpChanges(w, r); err == nil {
+			return
+		}
+	case len(segments) == 2 && segments[0] == "collections":
+		result, err = s.httpCollection(r, segments[1])
+	case len(segments) == 4 && segments[0] == "collections" && segments[2] == "keys":
+		result, err = s.httpKey(r, segments[1], segments[3])
+	case len(segments) >= 3 && len(segments) <= 4 && segments[0] == "nodes" && segments[2] == "persist":
+		var key string
+		if len(segments) == 4 {
+			key = segments[3]
+		}
+		result, err = s.httpPersist(r, segments[1], key)
+	default:
+		err = httpErrorf(http.StatusNotFound, "No resource at %s", r.URL.Path)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if herr, ok := err.(*httpError); ok {
+			status = herr.status
+		}
+		s.log.Warning("HTTP %v %v from %v failed (%v)", r.Method, r.URL.Path, r.RemoteAddr, err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// splits the path of [u] into unescaped segments
+func pathSegments(u *url.URL) ([]string, error) {
+	segments := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+	for idx, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil || unescaped == "" {
+			return nil, httpErrorf(http.StatusBadRequest, "Invalid path %s", u.EscapedPath())
+		}
+		segments[idx] = unescaped
+	}
+	return segments, nil
+}
+
+// returns the node the request is made on behalf of: the node of its bearer
+// token if it has one, and otherwise the node its address resolves to
+func (s *Server) httpPeer(r *http.Request) (*peer, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	p := &peer{ip: net.ParseIP(host)}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return nil, httpErrorf(http.StatusUnauthorized, "Only bearer tokens are supported")
+		}
+		nodeid, found, err := s.db.tokenNode(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, httpErrorf(http.StatusUnauthorized, "Unknown token")
+		}
+		p.nodeid = nodeid
+		return p, nil
+	}
+	s.resolve(p)
+	// a node with a key has to prove its identity, which over HTTP takes a
+	// token
+	nk, err := s.db.getNodeKey(p.nodeid)
+	if err != nil {
+		return nil, err
+	}
+	if p.identityErr == nil && nk != nil {
+		return nil, httpErrorf(http.StatusUnauthorized, "Node %v requires authenticated requests", p.nodeid)
+	}
+	return p, nil
+}
+
+// checks that the node of [r] has the rights [oper] needs
+func (s *Server) httpAccess(r *http.Request, oper string, keys []string, data map[string]interface{}, collection string) (*peer, error) {
+	p, err := s.httpPeer(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.checkAccess(p, oper, keys, data, collection); err != nil {
+		return nil, &httpError{status: http.StatusForbidden, err: err}
+	}
+	return p, nil
+}
+
+// reads the value in the body of [r]
+func readJSONValue(r *http.Request) (interface{}, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodySize {
+		return nil, httpErrorf(http.StatusRequestEntityTooLarge, "Body is longer than %v bytes", maxBodySize)
+	}
+	value, err := parseJSONValue(body)
+	if err != nil {
+		return nil, &httpError{status: http.StatusBadRequest, err: err}
+	}
+	return value, nil
+}
+
+// checks that [collection] names a collection that can be accessed
+func checkCollectionName(collection string) error {
+	if !validCollectionName(collection) {
+		return httpErrorf(http.StatusBadRequest, "Invalid collection name %s", collection)
+	}
+	return nil
+}
+
+// returns true if [collection] names a collection that clients can access
+func validCollectionName(collection string) bool {
+	return !isSystemBucket(collection) && !strings.Contains(collection, ".")
+}
+
+// GET /collections/{c}
+func (s *Server) httpCollection(r *http.Request, collection string) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, httpErrorf(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+	if err := checkCollectionName(collection); err != nil {
+		return nil, err
+	}
+	var (
+		query = r.URL.Query()
+		limit = defaultPageSize
+	)
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxPageSize {
+			return nil, httpErrorf(http.StatusBadRequest, "Limit must be between 1 and %v", maxPageSize)
+		}
+	}
+	if _, err := s.httpAccess(r, "GETBUCKET", nil, nil, collection); err != nil {
+		return nil, err
+	}
+	keys, entries, more, err := s.db.GetBucketPage(collection, query.Get("after"), limit)
+	if err != nil {
+		return nil, httpErrorf(http.StatusNotFound, "Collection %s does not exist", collection)
+	}
+	page := jsonPage{Entries: make([]jsonEntry, len(keys))}
+	for idx, key := range keys {
+		page.Entries[idx] = toJSONEntry(key, entries[key])
+	}
+	if more {
+		_, page.Next = splitKey(keys[len(keys)-1])
+	}
+	return page, nil
+}
+
+// GET, PUT and DELETE /collections/{c}/keys/{k}
+func (s *Server) httpKey(r *http.Request, collection, key string) (interface{}, error) {
+	if err := checkCollectionName(collection); err != nil {
+		return nil, err
+	}
+	// the collection is always spelled out, so that keys in the global
+	// collection can contain periods
+	fullkey := collection + "." + key
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := s.httpAccess(r, "GET", []string{fullkey}, nil, ""); err != nil {
+			return nil, err
+		}
+		entries, err := s.db.GetWithMeta([]string{fullkey})
+		if err != nil || entries[joinKey(collection, key)] == nil {
+			return nil, httpErrorf(http.StatusNotFound, "Key %s does not exist", joinKey(collection, key))
+		}
+		return toJSONEntry(joinKey(collection, key), entries[joinKey(collection, key)]), nil
+	case http.MethodPut:
+		value, err := readJSONValue(r)
+		if err != nil {
+			return nil, err
+		}
+		data := map[string]interface{}{fullkey: value}
+		p, err := s.httpAccess(r, "INSERT", nil, data, "")
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.db.InsertFrom(strconv.FormatUint(p.nodeid, 10), data)
+	case http.MethodDelete:
+		p, err := s.httpAccess(r, "DELETE", []string{fullkey}, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.db.DeleteFrom(strconv.FormatUint(p.nodeid, 10), []string{fullkey})
+	default:
+		return nil, httpErrorf(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+}
+
+// GET /nodes/{nodeid}/persist, and GET and PUT /nodes/{nodeid}/persist/{k}.
+// [key] is empty for the whole bucket
+func (s *Server) httpPersist(r *http.Request, node, key string) (interface{}, error) {
+	nodeid, err := strconv.ParseUint(node, 10, 64)
+	if err != nil {
+		return nil, httpErrorf(http.StatusBadRequest, "Invalid nodeid %s", node)
+	}
+	node = strconv.FormatUint(nodeid, 10)
+	if r.Header.Get("Authorization") == "" {
+		return nil, httpErrorf(http.StatusUnauthorized, "Persist buckets require a token")
+	}
+	p, err := s.httpPeer(r)
+	if err != nil {
+		return nil, err
+	}
+	if p.nodeid != nodeid {
+		return nil, httpErrorf(http.StatusForbidden, "Node %v cannot access data with nodeid %v", p.nodeid, nodeid)
+	}
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		values, err := s.db.GetPersist(node, nil)
+		if err != nil {
+			// the node has not persisted anything yet
+			values = nil
+		}
+		res := make(map[string]jsonValue, len(values))
+		for k, v := range values {
+			res[k] = toJSONValue(v)
+		}
+		return res, nil
+	case r.Method == http.MethodGet:
+		values, err := s.db.GetPersist(node, []string{key})
+		if err != nil || values[key] == nil {
+			return nil, httpErrorf(http.StatusNotFound, "Key %s does not exist", key)
+		}
+		return toJSONValue(values[key]), nil
+	case r.Method == http.MethodPut && key != "":
+		value, err := readJSONValue(r)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.db.Persist(node, map[string]interface{}{key: value})
+	default:
+		return nil, httpErrorf(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+}
+
+// selects the changes a stream sends
+type changeFilter struct {
+	// if not empty, only changes to these collections are sent
+	collections []string
+	// if not empty, only changes to full keys with one of these prefixes are
+	// sent
+	prefixes []string
+	// the persist bucket whose changes are sent, if any
+	persist string
+}
+
+// returns true if [change] passes the filter
+func (f *changeFilter) match(change Change) bool {
+	if change.Persist {
+		return f.persist != "" && change.Collection == f.persist
+	}
+	if len(f.collections) > 0 {
+		var found bool
+		for _, collection := range f.collections {
+			found = found || change.Collection == collection
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.prefixes) > 0 {
+		var found bool
+		for _, prefix := range f.prefixes {
+			found = found || strings.HasPrefix(change.Key, prefix)
+		}
+		return found
+	}
+	return true
+}
+
+// GET /changes streams the commits to the database as server-sent events. The
+// id of each event is the revision of its commit, which can be passed as
+// [after] or in the Last-Event-ID header to resume the stream after that
+// commit. If the commits after it are no longer in the change log, the stream
+// sends a reset event and continues from the current revision. Changes to
+// collections the node cannot read are left out. Returns an error if the
+// stream could not be started
+func (s *Server) httpChanges(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return httpErrorf(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("Streaming is not supported")
+	}
+	var (
+		query  = r.URL.Query()
+		filter = changeFilter{collections: query["collection"], prefixes: query["prefix"]}
+	)
+	for _, collection := range filter.collections {
+		if err := checkCollectionName(collection); err != nil {
+			return err
+		}
+	}
+	p, err := s.httpPeer(r)
+	if err != nil {
+		return err
+	}
+	if query.Get("persist") == "true" {
+		if r.Header.Get("Authorization") == "" {
+			return httpErrorf(http.StatusUnauthorized, "Persist buckets require a token")
+		}
+		filter.persist = strconv.FormatUint(p.nodeid, 10)
+	}
+	after := query.Get("after")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		after = id
+	}
+	var revision uint64
+	if after != "" {
+		if revision, err = strconv.ParseUint(after, 10, 64); err != nil {
+			return httpErrorf(http.StatusBadRequest, "Invalid revision %s", after)
+		}
+	} else if revision, err = s.db.Revision(); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		// wait on the channel from before reading the change log, so that
+		// commits made after reading it are not missed
+		changed := s.db.Changed()
+		sets, err := s.db.ChangesSince(revision, streamPageSize)
+		if err == ErrChangesPruned {
+			if revision, err = s.db.Revision(); err != nil {
+				s.log.Error("Could not read revision for change stream (%v)", err)
+				return nil
+			}
+			fmt.Fprintf(w, "id: %v\nevent: reset\ndata: {\"revision\":%v}\n\n", revision, revision)
+			flusher.Flush()
+			continue
+		} else if err != nil {
+			s.log.Error("Could not read change log (%v)", err)
+			return nil
+		}
+		// rights are looked up once per batch of commits
+		var readable = make(map[string]bool)
+		for _, set := range sets {
+			revision = set.Revision
+			var changes []jsonChange
+			for _, change := range set.Changes {
+				if !filter.match(change) {
+					continue
+				}
+				if _, found := readable[change.Collection]; !found && !change.Persist {
+					readable[change.Collection] = s.checkAccess(p, "GETBUCKET", nil, nil, change.Collection) == nil
+				}
+				if !change.Persist && !readable[change.Collection] {
+					continue
+				}
+				jc := jsonChange{Key: change.Key, Collection: change.Collection, Persist: change.Persist, Deleted: change.Deleted}
+				if !change.Deleted {
+					value := toJSONValue(change.Value)
+					jc.jsonValue = &value
+				}
+				changes = append(changes, jc)
+			}
+			if len(changes) == 0 {
+				continue
+			}
+			data, err := json.Marshal(jsonChangeSet{Revision: set.Revision, Time: set.Time, Writer: set.Writer, Changes: changes})
+			if err != nil {
+				s.log.Error("Could not encode changes (%v)", err)
+				return nil
+			}
+			fmt.Fprintf(w, "id: %v\nevent: change\ndata: %s\n\n", set.Revision, data)
+		}
+		if len(sets) > 0 {
+			flusher.Flush()
+			continue
+		}
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return nil
+		case <-s.listenCtx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package mpdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// makes an HTTP request to the gateway of [s] and decodes the JSON response
+// into [out] if it is not nil
+func httpRequest(t *testing.T, s *Server, method, path, token, body string, out interface{}) int {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Errorf("Could not decode response to %v %v (%v)", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestParseJSONValue(t *testing.T) {
+	for body, expected := range map[string]interface{}{
+		`"abc"`:                            "abc",
+		`5`:                                uint64(5),
+		`-5`:                               int64(-5),
+		`18446744073709551615`:             uint64(18446744073709551615),
+		`{"type": "int64", "value": 7}`:    int64(7),
+		`{"type": "int", "value": -7}`:     int(-7),
+		`{"type": "uint", "value": 7}`:     uint(7),
+		`{"type": "uint64", "value": 7}`:   uint64(7),
+		`{"type": "string", "value": "7"}`: "7",
+	} {
+		value, err := parseJSONValue([]byte(body))
+		if err != nil || value != expected {
+			t.Errorf("Parsed %s as %#v (%v), expected %#v", body, value, err, expected)
+		}
+	}
+	for _, body := range []string{`1.5`, `true`, `[1]`, `{"type": "uint64", "value": -1}`, `{"type": "float", "value": 1}`, `{"type": "string", "value": 1}`, `{"value": 1}`} {
+		if value, err := parseJSONValue([]byte(body)); err == nil {
+			t.Errorf("Expected error parsing %s, got %#v", body, value)
+		}
+	}
+}
+
+func TestHTTPCollections(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, body := range map[string]string{
+		"a":       `{"type": "int64", "value": 3}`,
+		"b":       `"text"`,
+		"c%2Fd.e": `{"type": "uint", "value": 4}`,
+	} {
+		if code := httpRequest(t, s, "PUT", "/collections/web/keys/"+key, "", body, nil); code != http.StatusNoContent {
+			t.Errorf("PUT of key %v failed with status %v", key, code)
+		}
+	}
+	var entry jsonEntry
+	if code := httpRequest(t, s, "GET", "/collections/web/keys/a", "", "", &entry); code != http.StatusOK {
+		t.Errorf("GET failed with status %v", code)
+	}
+	if entry.Key != "web.a" || entry.Type != "int64" || entry.Value != 3.0 || entry.Revision == 0 {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if value, _ := db.Get([]string{"web.a", "web.c/d.e"}); value["web.a"] != int64(3) || value["web.c/d.e"] != uint(4) {
+		t.Errorf("Values were not stored with their types: %v", value)
+	}
+
+	var (
+		keys []string
+		next string
+	)
+	for {
+		var page jsonPage
+		path := "/collections/web?limit=2"
+		if next != "" {
+			path += "&after=" + next
+		}
+		if code := httpRequest(t, s, "GET", path, "", "", &page); code != http.StatusOK {
+			t.Fatalf("GET of collection failed with status %v", code)
+		}
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if next = page.Next; next == "" {
+			break
+		}
+	}
+	if strings.Join(keys, ",") != "web.a,web.b,web.c/d.e" {
+		t.Errorf("Unexpected keys from pages %v", keys)
+	}
+
+	if code := httpRequest(t, s, "DELETE", "/collections/web/keys/a", "", "", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE failed with status %v", code)
+	}
+	if code := httpRequest(t, s, "GET", "/collections/web/keys/a", "", "", nil); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for deleted key, got %v", code)
+	}
+	if code := httpRequest(t, s, "PUT", "/collections/web/keys/f", "", `1.5`, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for float value, got %v", code)
+	}
+	if code := httpRequest(t, s, "GET", "/collections/.acl", "", "", nil); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for system bucket, got %v", code)
+	}
+
+	// httptest requests come from 192.0.2.1
+	webnode := deriveNodeid(net.ParseIP("192.0.2.1"))
+	if err = db.SetACL("web", []ACLEntry{{First: webnode, Last: webnode, Rights: RightRead}}); err != nil {
+		t.Fatal("Could not set ACL", err)
+	}
+	defer db.SetACL("web", nil)
+	if code := httpRequest(t, s, "PUT", "/collections/web/keys/b", "", `"denied"`, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 without write rights, got %v", code)
+	}
+}
+
+func TestHTTPPersist(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const token = "0123456789abcdef-http"
+	if err = db.AddNodeToken(77, "short"); err == nil {
+		t.Error("Expected error adding a short token")
+	}
+	if err = db.AddNodeToken(77, token); err != nil {
+		t.Fatal("Could not add token", err)
+	}
+
+	if code := httpRequest(t, s, "PUT", "/nodes/77/persist/k", "", `5`, nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without token, got %v", code)
+	}
+	if code := httpRequest(t, s, "PUT", "/nodes/78/persist/k", token, `5`, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for another node, got %v", code)
+	}
+	if code := httpRequest(t, s, "PUT", "/nodes/77/persist/k", token, `{"type": "int", "value": 5}`, nil); code != http.StatusNoContent {
+		t.Errorf("PUT failed with status %v", code)
+	}
+	var values map[string]jsonValue
+	if code := httpRequest(t, s, "GET", "/nodes/77/persist", token, "", &values); code != http.StatusOK {
+		t.Errorf("GET failed with status %v", code)
+	}
+	if v := values["k"]; v.Type != "int" || v.Value != 5.0 {
+		t.Errorf("Unexpected persist values %v", values)
+	}
+
+	if err = db.RemoveNodeToken(token); err != nil {
+		t.Error("Could not remove token", err)
+	}
+	if code := httpRequest(t, s, "GET", "/nodes/77/persist/k", token, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 with revoked token, got %v", code)
+	}
+}
+
+// reads server-sent events from [r] until one of type [event] arrives, and
+// returns its id and data
+func readEvent(t *testing.T, r *bufio.Reader, event string) (string, string) {
+	var id, typ, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal("Could not read event", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && typ != "":
+			if typ == event {
+				return id, data
+			}
+			typ = ""
+		}
+	}
+}
+
+func TestHTTPChanges(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	if err = db.Insert(map[string]interface{}{"sse.before": "missed"}); err != nil {
+		t.Fatal("Could not insert", err)
+	}
+	start, _ := db.Revision()
+	resp, err := http.Get(ts.URL + "/changes?collection=sse")
+	if err != nil {
+		t.Fatal("Could not open stream", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected stream response %v", resp.Status)
+	}
+	r := bufio.NewReader(resp.Body)
+
+	if err = db.Insert(map[string]interface{}{"other.x": 1, "sse.a": uint64(1)}); err != nil {
+		t.Fatal("Could not insert", err)
+	}
+	if err = db.Delete([]string{"sse.a"}); err != nil {
+		t.Fatal("Could not delete", err)
+	}
+	id, data := readEvent(t, r, "change")
+	var set struct {
+		Revision uint64
+		Changes  []map[string]interface{}
+	}
+	if err = json.Unmarshal([]byte(data), &set); err != nil {
+		t.Fatal("Could not decode change", err)
+	}
+	if id != strconv.FormatUint(start+1, 10) || set.Revision != start+1 || len(set.Changes) != 1 ||
+		set.Changes[0]["key"] != "sse.a" || set.Changes[0]["type"] != "uint64" {
+		t.Errorf("Unexpected change %v %+v", id, set)
+	}
+	_, data = readEvent(t, r, "change")
+	if !strings.Contains(data, `"deleted":true`) || strings.Contains(data, `"value"`) {
+		t.Errorf("Unexpected deletion %v", data)
+	}
+
+	// resuming from the first revision replays the commits after it
+	req, _ := http.NewRequest("GET", ts.URL+"/changes?prefix=sse.bef", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(start-1, 10))
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Could not resume stream", err)
+	}
+	defer resumed.Body.Close()
+	id, data = readEvent(t, bufio.NewReader(resumed.Body), "change")
+	if id != strconv.FormatUint(start, 10) || !strings.Contains(data, `"missed"`) {
+		t.Errorf("Unexpected resumed change %v %v", id, data)
+	}
+
+	if code := httpRequest(t, s, "GET", "/changes?persist=true", "", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for persist changes without token, got %v", code)
+	}
+}
@@ -0,0 +1,301 @@
+package mpdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"net"
+	"time"
+)
+
+// The registry maps the identities of nodes to nodeids. Identities are either
+// the full address of a node ("addr:<address>") or its EUI-64
+// ("eui64:<16 hex digits>"). Each nodeid maps to a NodeInfo. Only nodes that
+// REGISTER are added; other nodes get the nodeid derived from their address
+// each time they are resolved. Nodeids are never reused, even after a node is
+// retired
+var (
+	nodesBucket      = []byte(".nodes")
+	identitiesBucket = []byte(".identities")
+)
+
+// nodeids allocated by the registry, for nodes whose preferred nodeid is
+// taken, have the high bit set. Nodeids derived from addresses never do
+const allocatedNodeids = 1 << 63
+
+// NodeInfo describes a registered node
+type NodeInfo struct {
+	Nodeid     uint64
+	Name       string
+	Identities []string
+	Registered time.Time
+	Retired    bool
+}
+
+// Returns the preferred nodeid of the node with address [ip]: the interface
+// identifier of its address (see interfaceIdentifier) with the high bit
+// cleared, which is reserved for nodeids the registry allocates. IPv4 and
+// IPv4-mapped IPv6 addresses get the interface identifier of the mapped
+// address, 0000:ffff followed by the IPv4 address, so that a node has the
+// same nodeid on IPv4 and dual-stack listeners. A node only gets its
+// preferred nodeid if no other node has registered it
+func deriveNodeid(ip net.IP) uint64 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return 0xffff<<32 | uint64(binary.BigEndian.Uint32(ip4))
+	}
+	return interfaceIdentifier(ip) &^ allocatedNodeids
+}
+
+// returns the interface identifier (the last 8 bytes) of the IPv6 address
+// [ip]. For nodes that autoconfigure their address from their EUI-64, this is
+// the EUI-64 with the universal/local bit flipped
+func interfaceIdentifier(ip net.IP) uint64 {
+	return binary.BigEndian.Uint64(ip.To16()[8:])
+}
+
+// returns true if the IPv6 address [ip] was autoconfigured from [eui64],
+// which is how a node shows that the EUI-64 is its own
+func autoconfiguredFrom(ip net.IP, eui64 uint64) bool {
+	return ip.To4() == nil && interfaceIdentifier(ip) == eui64^0x0200000000000000
+}
+
+// returns the identities a node with address [ip] may have registered under:
+// its address, and for IPv6 addresses, the EUI-64 it was autoconfigured from
+func nodeIdentities(ip net.IP) []string {
+	if ip.To4() != nil {
+		return []string{addressIdentity(ip)}
+	}
+	return []string{addressIdentity(ip), eui64Identity(interfaceIdentifier(ip) ^ 0x0200000000000000)}
+}
+
+func addressIdentity(ip net.IP) string {
+	return "addr:" + ip.String()
+}
+
+func eui64Identity(eui64 uint64) string {
+	return fmt.Sprintf("eui64:%016x", eui64)
+}
+
+// ResolveNode returns the nodeid of the node with address [ip]. Registered
+// nodes are looked up by their address, and then by the EUI-64 their address
+// was autoconfigured from, so that they keep their nodeid if their prefix
+// changes. Other nodes get their preferred nodeid (see deriveNodeid), unless a
+// registered node has it. Resolving never writes to the registry. Retired
+// nodes cannot be resolved
+func (db *DB) ResolveNode(ip net.IP) (uint64, error) {
+	var nodeid uint64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		ib, nb := tx.Bucket(identitiesBucket), tx.Bucket(nodesBucket)
+		registered, found, err := db.findNode(ib, nb, ip)
+		if err != nil || found {
+			nodeid = registered
+			return err
+		}
+		nodeid = deriveNodeid(ip)
+		if nb != nil && nb.Get(itob(nodeid)) != nil {
+			return fmt.Errorf("Nodeid %v of %v belongs to another node; register to obtain a nodeid", nodeid, ip)
+		}
+		return nil
+	})
+	return nodeid, err
+}
+
+// looks up the nodeid of the node with address [ip] in the registry buckets
+// [ib] and [nb], which may be nil. [found] is false if the node is not known
+func (db *DB) findNode(ib, nb *bolt.Bucket, ip net.IP) (nodeid uint64, found bool, err error) {
+	if ib == nil || nb == nil {
+		return 0, false, nil
+	}
+	for _, identity := range nodeIdentities(ip) {
+		if v := ib.Get([]byte(identity)); v != nil {
+			info, err := db.getNodeInfo(nb, binary.BigEndian.Uint64(v))
+			if err != nil {
+				return 0, false, err
+			}
+			if info.Retired {
+				return 0, false, fmt.Errorf("Node %v is retired", info.Nodeid)
+			}
+			return info.Nodeid, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// RegisterNode registers the node with address [ip] and returns its nodeid.
+// If [eui64] is not 0, the node is also registered under its EUI-64, so that
+// it keeps its nodeid on other prefixes. Callers must check that the EUI-64
+// belongs to the node (see autoconfiguredFrom). A node that is already known
+// under either identity keeps its nodeid (and its name, if [name] is empty).
+// An EUI-64 cannot move from one node to another, and an address only joins
+// the node registered under an EUI-64 if it was autoconfigured from it. New
+// nodes get their preferred nodeid unless another registered node has it, in
+// which case a new nodeid is allocated
+func (db *DB) RegisterNode(ip net.IP, eui64 uint64, name string) (uint64, error) {
+	var nodeid uint64
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		ib, nb, err := createRegistry(tx)
+		if err != nil {
+			return err
+		}
+		identities := []string{addressIdentity(ip)}
+		if eui64 != 0 {
+			identities = append(identities, eui64Identity(eui64))
+		}
+
+		var info *NodeInfo
+		for idx, identity := range identities {
+			v := ib.Get([]byte(identity))
+			if v == nil {
+				continue
+			}
+			registered := binary.BigEndian.Uint64(v)
+			// an address only joins the node of an EUI-64 if it was
+			// autoconfigured from it
+			if idx > 0 && (info != nil && info.Nodeid != registered || info == nil && !autoconfiguredFrom(ip, eui64)) {
+				return fmt.Errorf("EUI-64 %016x belongs to node %v", eui64, registered)
+			}
+			if info, err = db.getNodeInfo(nb, registered); err != nil {
+				return err
+			}
+		}
+		if info != nil && info.Retired {
+			return fmt.Errorf("Node %v is retired", info.Nodeid)
+		}
+		if info == nil {
+			info = &NodeInfo{Nodeid: deriveNodeid(ip), Registered: time.Now()}
+			if eui64 != 0 {
+				info.Nodeid = (eui64 ^ 0x0200000000000000) &^ allocatedNodeids
+			}
+			if err = allocateNodeid(nb, info); err != nil {
+				return err
+			}
+		}
+		if name != "" {
+			info.Name = name
+		}
+		nodeid = info.Nodeid
+		return db.bindIdentities(ib, nb, info, identities)
+	})
+	return nodeid, err
+}
+
+// returns the identities and nodes buckets of the registry, creating them if
+// needed
+func createRegistry(tx *bolt.Tx) (ib, nb *bolt.Bucket, err error) {
+	if ib, err = tx.CreateBucketIfNotExists(identitiesBucket); err != nil {
+		return nil, nil, fmt.Errorf("Could not create identities bucket (%s)", err)
+	}
+	if nb, err = tx.CreateBucketIfNotExists(nodesBucket); err != nil {
+		return nil, nil, fmt.Errorf("Could not create nodes bucket (%s)", err)
+	}
+	return ib, nb, nil
+}
+
+// replaces the preferred nodeid of the new node [info] with a newly allocated
+// one if another node has it already
+func allocateNodeid(nb *bolt.Bucket, info *NodeInfo) error {
+	for nb.Get(itob(info.Nodeid)) != nil {
+		seq, err := nb.NextSequence()
+		if err != nil {
+			return err
+		}
+		info.Nodeid = allocatedNodeids | seq
+	}
+	return nil
+}
+
+// binds [identities] to the node [info] and stores it
+func (db *DB) bindIdentities(ib, nb *bolt.Bucket, info *NodeInfo, identities []string) error {
+	for _, identity := range identities {
+		if err := ib.Put([]byte(identity), itob(info.Nodeid)); err != nil {
+			return err
+		}
+		if !containsString(info.Identities, identity) {
+			info.Identities = append(info.Identities, identity)
+		}
+	}
+	return db.putNodeInfo(nb, info)
+}
+
+// RenameNode changes the name of a registered node
+func (db *DB) RenameNode(nodeid uint64, name string) error {
+	return db.updateNode(nodeid, func(info *NodeInfo) {
+		info.Name = name
+	})
+}
+
+// RetireNode marks a registered node as retired. Requests from a retired node
+// are rejected, and its nodeid is never given to another node
+func (db *DB) RetireNode(nodeid uint64) error {
+	return db.updateNode(nodeid, func(info *NodeInfo) {
+		info.Retired = true
+	})
+}
+
+// ListNodes returns all registered nodes, including retired ones
+func (db *DB) ListNodes() ([]NodeInfo, error) {
+	var nodes []NodeInfo
+	err := db.db.View(func(tx *bolt.Tx) error {
+		nb := tx.Bucket(nodesBucket)
+		if nb == nil {
+			return nil
+		}
+		return nb.ForEach(func(k, v []byte) error {
+			info, err := db.getNodeInfo(nb, binary.BigEndian.Uint64(k))
+			if err != nil {
+				return err
+			}
+			nodes = append(nodes, *info)
+			return nil
+		})
+	})
+	return nodes, err
+}
+
+// applies [fn] to the NodeInfo of a registered node
+func (db *DB) updateNode(nodeid uint64, fn func(info *NodeInfo)) error {
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		nb := tx.Bucket(nodesBucket)
+		if nb == nil || nb.Get(itob(nodeid)) == nil {
+			return fmt.Errorf("Node %v is not registered", nodeid)
+		}
+		info, err := db.getNodeInfo(nb, nodeid)
+		if err != nil {
+			return err
+		}
+		fn(info)
+		return db.putNodeInfo(nb, info)
+	})
+	return err
+}
+
+func (db *DB) getNodeInfo(nb *bolt.Bucket, nodeid uint64) (*NodeInfo, error) {
+	var info NodeInfo
+	v := nb.Get(itob(nodeid))
+	if v == nil {
+		return nil, fmt.Errorf("Node %v is not registered", nodeid)
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("Could not decode info for node %v (%s)", nodeid, err)
+	}
+	return &info, nil
+}
+
+func (db *DB) putNodeInfo(nb *bolt.Bucket, info *NodeInfo) error {
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(info); err != nil {
+		return err
+	}
+	return nb.Put(itob(info.Nodeid), buf.Bytes())
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
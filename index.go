@@ -0,0 +1,291 @@
+package mpdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"strings"
+)
+
+// Collections can have secondary indexes, which map values back to the keys
+// that hold them, so that keys can be looked up by value (see Find) without
+// reading the whole collection. An index covers either the values of all keys
+// of the collection, or a field of the structured values stored in it. MPDB
+// stores structures as one key per field, so field "temp" of "r1" is the key
+// "r1.temp", and an index on field "temp" covers the keys ending in ".temp".
+//
+// The fields indexed for each collection are kept in the .indexing bucket.
+// The entries of an index are kept in a bucket per field (named "=" followed
+// by the field, "=" for the whole value) within the bucket of the collection
+// in .index. Entry keys are the sortable encoding of the value (see
+// indexValue) followed by the key, and entry values are the key. Indexes are
+// updated by every write within the same transaction
+var (
+	indexingBucket = []byte(".indexing")
+	indexBucket    = []byte(".index")
+)
+
+// the number of indexes a collection can have
+const maxIndexes = 16
+
+// SetIndexes replaces the indexes of [collection] with indexes on [fields].
+// The field "" indexes the whole value of every key. Indexes that are added
+// are built from the values already stored, and indexes that are left out
+// are dropped. An empty list drops all indexes of the collection
+func (db *DB) SetIndexes(collection string, fields []string) error {
+	if collection == "" || isSystemBucket(collection) || strings.Contains(collection, ".") {
+		return fmt.Errorf("Invalid collection name %s", collection)
+	}
+	if len(fields) > maxIndexes {
+		return fmt.Errorf("A collection can have at most %v indexes", maxIndexes)
+	}
+	var seen = make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if seen[field] {
+			return fmt.Errorf("Field %s is listed twice", field)
+		}
+		seen[field] = true
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		old, err := db.getIndexes(tx, collection)
+		if err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(indexingBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create indexing bucket (%s)", err)
+		}
+		ib, err := tx.CreateBucketIfNotExists(indexBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create index bucket (%s)", err)
+		}
+		cb, err := ib.CreateBucketIfNotExists([]byte(collection))
+		if err != nil {
+			return fmt.Errorf("Could not create index for collection %s (%s)", collection, err)
+		}
+		for _, field := range old {
+			if !seen[field] && cb.Bucket(indexFieldBucket(field)) != nil {
+				if err = cb.DeleteBucket(indexFieldBucket(field)); err != nil {
+					return fmt.Errorf("Could not drop index on field %s (%s)", field, err)
+				}
+			}
+			delete(seen, field)
+		}
+		// build the new indexes
+		if data := tx.Bucket([]byte(collection)); data != nil {
+			for field := range seen {
+				fb, err := cb.CreateBucket(indexFieldBucket(field))
+				if err != nil {
+					return fmt.Errorf("Could not create index on field %s (%s)", field, err)
+				}
+				err = data.ForEach(func(k, v []byte) error {
+					if !indexedKey(string(k), field) {
+						return nil
+					}
+					value, err := db.decodeInterface(v)
+					if err != nil {
+						return err
+					}
+					return fb.Put(indexEntry(value, string(k)), []byte(string(k)))
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if len(fields) == 0 {
+			if err = ib.DeleteBucket([]byte(collection)); err != nil {
+				return err
+			}
+			return b.Delete([]byte(collection))
+		}
+		var buf = new(bytes.Buffer)
+		if err = gob.NewEncoder(buf).Encode(fields); err != nil {
+			return err
+		}
+		return b.Put([]byte(collection), buf.Bytes())
+	})
+}
+
+// GetIndexes returns the fields indexed in [collection], in the order they
+// were given to SetIndexes
+func (db *DB) GetIndexes(collection string) ([]string, error) {
+	var fields []string
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var err error
+		fields, err = db.getIndexes(tx, collection)
+		return err
+	})
+	return fields, err
+}
+
+// Find returns the keys of [collection] whose value, or whose field [field]
+// if it is not "", lies between [min] and [max] inclusive, along with their
+// values. The field must be indexed (see SetIndexes). A nil bound leaves the
+// range open on that side, and equal bounds look up a single value.
+// Integers of any type compare by value and sort before strings. Like
+// GetBucket, keys are prefixed with the name of the collection
+func (db *DB) Find(collection, field string, min, max interface{}) (map[string]interface{}, error) {
+	for _, bound := range []interface{}{min, max} {
+		if bound != nil && !storableValue(bound) {
+			return nil, fmt.Errorf("Cannot compare with value %v of type %T", bound, bound)
+		}
+	}
+	var result = make(map[string]interface{})
+	err := db.db.View(func(tx *bolt.Tx) error {
+		fields, err := db.getIndexes(tx, collection)
+		if err != nil {
+			return err
+		}
+		if !containsString(fields, field) {
+			return fmt.Errorf("Collection %s has no index on field %q", collection, field)
+		}
+		fb := db.getIndexBucket(tx, collection, field)
+		data := tx.Bucket([]byte(collection))
+		if fb == nil || data == nil {
+			return nil
+		}
+		var upper []byte
+		if max != nil {
+			upper = indexValue(max)
+		}
+		c := fb.Cursor()
+		k, v := c.First()
+		if min != nil {
+			k, v = c.Seek(indexValue(min))
+		}
+		for ; k != nil; k, v = c.Next() {
+			if upper != nil && bytes.Compare(k[:len(k)-len(v)], upper) > 0 {
+				break
+			}
+			value, err := db.decodeInterface(data.Get(v))
+			if err != nil {
+				return err
+			}
+			result[collection+"."+string(v)] = value
+		}
+		return nil
+	})
+	return result, err
+}
+
+// returns the fields indexed in [collection]
+func (db *DB) getIndexes(tx *bolt.Tx, collection string) ([]string, error) {
+	b := tx.Bucket(indexingBucket)
+	if b == nil {
+		return nil, nil
+	}
+	v := b.Get([]byte(collection))
+	if v == nil {
+		return nil, nil
+	}
+	var fields []string
+	if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&fields); err != nil {
+		return nil, fmt.Errorf("Could not decode indexes of collection %s (%s)", collection, err)
+	}
+	return fields, nil
+}
+
+// returns the bucket holding the entries of the index on [field] of
+// [collection], or nil if it has no entries
+func (db *DB) getIndexBucket(tx *bolt.Tx, collection, field string) *bolt.Bucket {
+	ib := tx.Bucket(indexBucket)
+	if ib == nil {
+		return nil
+	}
+	cb := ib.Bucket([]byte(collection))
+	if cb == nil {
+		return nil
+	}
+	return cb.Bucket(indexFieldBucket(field))
+}
+
+// updates the indexes of collection [bucketname] for [key] changing from the
+// stored value [old] (nil if it had none) to [value] (nil if it is deleted)
+func (db *DB) reindex(tx *bolt.Tx, bucketname, key string, old []byte, value interface{}) error {
+	fields, err := db.getIndexes(tx, bucketname)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	var oldValue interface{}
+	if old != nil {
+		if oldValue, err = db.decodeInterface(old); err != nil {
+			return err
+		}
+	}
+	for _, field := range fields {
+		if !indexedKey(key, field) {
+			continue
+		}
+		ib, err := tx.CreateBucketIfNotExists(indexBucket)
+		if err != nil {
+			return fmt.Errorf("Could not create index bucket (%s)", err)
+		}
+		cb, err := ib.CreateBucketIfNotExists([]byte(bucketname))
+		if err != nil {
+			return fmt.Errorf("Could not create index for collection %s (%s)", bucketname, err)
+		}
+		fb, err := cb.CreateBucketIfNotExists(indexFieldBucket(field))
+		if err != nil {
+			return fmt.Errorf("Could not create index on field %s (%s)", field, err)
+		}
+		if oldValue != nil {
+			if err = fb.Delete(indexEntry(oldValue, key)); err != nil {
+				return err
+			}
+		}
+		if value != nil {
+			if err = fb.Put(indexEntry(value, key), []byte(key)); err != nil {
+				return fmt.Errorf("Could not index key %s (%s)", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// returns the name of the bucket holding the index on [field]. Bucket names
+// cannot be empty, so the index on the whole value is named "="
+func indexFieldBucket(field string) []byte {
+	return []byte("=" + field)
+}
+
+// returns true if the index on [field] covers [key]
+func indexedKey(key, field string) bool {
+	return field == "" || (len(key) > len(field)+1 && strings.HasSuffix(key, "."+field))
+}
+
+// returns the key of the index entry for [key] holding [value]
+func indexEntry(value interface{}, key string) []byte {
+	return append(indexValue(value), key...)
+}
+
+// Returns the encoding of [value] in index entries, which sorts like the
+// values: integers of any type by value, then strings bytewise. Integers are
+// a 0x01 tag, a sign byte and 8 big-endian bytes. Strings are a 0x02 tag and
+// the string, with 0x00 escaped as 0x00 0xff, terminated by 0x00 0x01 so that
+// a string sorts before the strings it is a prefix of
+func indexValue(value interface{}) []byte {
+	if n, ok := integerValue(value); ok {
+		var buf = make([]byte, 10)
+		buf[0] = 0x01
+		if n.Sign() < 0 {
+			// the two's complement of negative int64s sorts by value
+			binary.BigEndian.PutUint64(buf[2:], uint64(n.Int64()))
+		} else {
+			buf[1] = 1
+			binary.BigEndian.PutUint64(buf[2:], n.Uint64())
+		}
+		return buf
+	}
+	s, _ := value.(string)
+	var buf = make([]byte, 0, len(s)+3)
+	buf = append(buf, 0x02)
+	for idx := 0; idx < len(s); idx++ {
+		if buf = append(buf, s[idx]); s[idx] == 0x00 {
+			buf = append(buf, 0xff)
+		}
+	}
+	return append(buf, 0x00, 0x01)
+}
@@ -0,0 +1,609 @@
+package mpdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/op/go-logging"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The MQTT bridge connects a DB to an MQTT broker. Every value written to a
+// collection, over any transport, is published under {Topic}/{collection}/{key},
+// and values published under {CommandTopic}/{collection}/{key} are inserted.
+// Values are published from an outbox in the database file, so that none are
+// lost while the broker is unreachable: the bridge follows the change log and
+// copies the values to publish into the outbox, and deletes them once the
+// broker has acknowledged them. Both directions use QoS 1
+var mqttBucket = []byte(".mqtt")
+
+const (
+	// the number of values in the outbox of a bridge, beyond which the oldest
+	// are dropped
+	maxMQTTOutboxLength = 100000
+	// the number of values published but not acknowledged yet
+	maxMQTTInflight = 32
+	// the longest a bridge waits before reconnecting
+	maxMQTTRetryInterval = time.Minute
+	// the largest packet the bridge reads from the broker
+	maxMQTTPacketLength = 1 << 20
+)
+
+// MQTTOptions configure an MQTTBridge. Zero values are replaced by the
+// defaults given for each field
+type MQTTOptions struct {
+	// the database to bridge. The bridge does not close it
+	DB *DB
+	// TCP address of the broker, e.g. "broker:1883"
+	Broker string
+	// defaults to "mpdb". The broker keeps the session of the client, so
+	// commands published while the bridge is disconnected are delivered once
+	// it reconnects. The outbox of the bridge is named after it as well
+	ClientID string
+	// credentials, if the broker requires them
+	Username string
+	Password string
+	// prefix of the topics values are published under. Defaults to "mpdb"
+	Topic string
+	// prefix of the topics commands are read from. Defaults to "mpdb-set"
+	CommandTopic string
+	// the nodeid commands are written as. A command is only inserted if this
+	// nodeid has write rights on its collection. Defaults to 0
+	Nodeid uint64
+	// how often the bridge pings the broker when idle is half of this.
+	// Defaults to 60 seconds
+	KeepAlive time.Duration
+	// how long the bridge waits before reconnecting the first time. The wait
+	// doubles with every failed attempt, up to a minute. Defaults to 1 second
+	RetryInterval time.Duration
+	// defaults to the "mphandler" logger
+	Logger *logging.Logger
+}
+
+// fills in the defaults for zero values and checks the options
+func (opts *MQTTOptions) normalize() error {
+	if opts.DB == nil {
+		return fmt.Errorf("No database to bridge")
+	}
+	if opts.Broker == "" {
+		return fmt.Errorf("No MQTT broker")
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = "mpdb"
+	}
+	if opts.Topic == "" {
+		opts.Topic = "mpdb"
+	}
+	if opts.CommandTopic == "" {
+		opts.CommandTopic = "mpdb-set"
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = time.Minute
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = time.Second
+	}
+	if opts.Logger == nil {
+		opts.Logger = log
+	}
+	if !validMQTTTopic(opts.Topic) || !validMQTTTopic(opts.CommandTopic) {
+		return fmt.Errorf("Invalid MQTT topics %s and %s", opts.Topic, opts.CommandTopic)
+	}
+	// commands must not be read from the topics values are published under
+	if strings.HasPrefix(opts.CommandTopic+"/", opts.Topic+"/") || strings.HasPrefix(opts.Topic+"/", opts.CommandTopic+"/") {
+		return fmt.Errorf("MQTT topics %s and %s overlap", opts.Topic, opts.CommandTopic)
+	}
+	if opts.KeepAlive < time.Second || opts.KeepAlive > 0xffff*time.Second || opts.RetryInterval < 0 {
+		return fmt.Errorf("Invalid MQTT options %+v", *opts)
+	}
+	return nil
+}
+
+// MQTTBridge publishes the values written to a DB to an MQTT broker, and
+// inserts the values published to its command topics
+type MQTTBridge struct {
+	db   *DB
+	log  *logging.Logger
+	opts MQTTOptions
+	// signalled when values are added to the outbox
+	queued chan struct{}
+	// key of the last value published to the broker, in any session.
+	// Values up to it are published again with the DUP flag
+	sent []byte
+	// the number of values in the outbox beyond which the oldest are dropped
+	maxOutbox int
+	// cancelled by Stop
+	ctx  context.Context
+	stop context.CancelFunc
+	// the goroutines following the change log and talking to the broker
+	running sync.WaitGroup
+}
+
+// a value waiting in the outbox
+type mqttOutboxRecord struct {
+	Topic   string
+	Payload []byte
+}
+
+// NewMQTTBridge creates a bridge with the given options. It does not connect
+// until Start is called
+func NewMQTTBridge(opts MQTTOptions) (*MQTTBridge, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	b := &MQTTBridge{db: opts.DB, log: opts.Logger, opts: opts, queued: make(chan struct{}, 1),
+		maxOutbox: maxMQTTOutboxLength}
+	b.ctx, b.stop = context.WithCancel(context.Background())
+	return b, nil
+}
+
+// Start connects to the broker and starts publishing. The bridge keeps
+// reconnecting if the broker is unreachable, so this only fails if the
+// outbox cannot be read
+func (b *MQTTBridge) Start() error {
+	revision, err := b.loadRevision()
+	if err != nil {
+		return err
+	}
+	b.running.Add(2)
+	go func() {
+		defer b.running.Done()
+		b.collect(revision)
+	}()
+	go func() {
+		defer b.running.Done()
+		b.connect()
+	}()
+	return nil
+}
+
+// Stop disconnects from the broker. Values that were not published yet stay
+// in the outbox, and are published when a bridge with the same ClientID is
+// started again. If [ctx] is done first, Stop returns its error
+func (b *MQTTBridge) Stop(ctx context.Context) error {
+	b.stop()
+	done := make(chan struct{})
+	go func() {
+		b.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// returns the bucket of the bridge within .mqtt, creating it if [tx] is
+// writable
+func (b *MQTTBridge) bucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	if !tx.Writable() {
+		if root := tx.Bucket(mqttBucket); root != nil {
+			if bucket := root.Bucket([]byte(b.opts.ClientID)); bucket != nil {
+				return bucket, nil
+			}
+		}
+		return nil, fmt.Errorf("Bucket does not exist")
+	}
+	root, err := tx.CreateBucketIfNotExists(mqttBucket)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create MQTT bucket (%s)", err)
+	}
+	bucket, err := root.CreateBucketIfNotExists([]byte(b.opts.ClientID))
+	if err != nil {
+		return nil, fmt.Errorf("Could not create MQTT bucket (%s)", err)
+	}
+	if _, err = bucket.CreateBucketIfNotExists([]byte("outbox")); err != nil {
+		return nil, fmt.Errorf("Could not create MQTT outbox (%s)", err)
+	}
+	return bucket, nil
+}
+
+// returns the last revision copied into the outbox. A new bridge starts from
+// the current revision, so that only values written from then on are
+// published
+func (b *MQTTBridge) loadRevision() (uint64, error) {
+	var revision uint64
+	err := b.db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+		if v := bucket.Get([]byte("revision")); v != nil {
+			revision = getUint(&v, 0, 8)
+			return nil
+		}
+		if rb := tx.Bucket(revisionBucket); rb != nil {
+			revision = rb.Sequence()
+		}
+		return bucket.Put([]byte("revision"), itob(revision))
+	})
+	return revision, err
+}
+
+// copies the values written by INSERTs in [sets] into the outbox, and
+// records the revision of the last set as copied. Deletions and PERSIST
+// values are not published
+func (b *MQTTBridge) enqueue(sets []ChangeSet) error {
+	return b.db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+		outbox := bucket.Bucket([]byte("outbox"))
+		n := outboxCount(bucket)
+		for _, set := range sets {
+			for _, change := range set.Changes {
+				if change.Persist || change.Deleted {
+					continue
+				}
+				// keys in the global collection have no prefix
+				key := strings.TrimPrefix(change.Key, change.Collection+".")
+				topic := b.opts.Topic + "/" + change.Collection + "/" + key
+				if !validMQTTTopic(topic) {
+					b.log.Warning("Not publishing key %s, which cannot be an MQTT topic", change.Key)
+					continue
+				}
+				payload, err := json.Marshal(toJSONEntry(change.Key, &Entry{Value: change.Value,
+					Modified: set.Time, Writer: set.Writer, Revision: set.Revision}))
+				if err != nil {
+					return err
+				}
+				var buf = new(bytes.Buffer)
+				if err = gob.NewEncoder(buf).Encode(mqttOutboxRecord{Topic: topic, Payload: payload}); err != nil {
+					return err
+				}
+				seq, _ := outbox.NextSequence()
+				if err = outbox.Put(itob(seq), buf.Bytes()); err != nil {
+					return fmt.Errorf("Could not add to MQTT outbox (%s)", err)
+				}
+				n++
+			}
+			if err = bucket.Put([]byte("revision"), itob(set.Revision)); err != nil {
+				return err
+			}
+		}
+		// drop the oldest values if the broker has been unreachable for long
+		if n > b.maxOutbox {
+			dropped := n - b.maxOutbox
+			c := outbox.Cursor()
+			for k, _ := c.First(); k != nil && n > b.maxOutbox; k, _ = c.First() {
+				if err = c.Delete(); err != nil {
+					return err
+				}
+				n--
+			}
+			b.log.Warning("Dropped %v values from the full MQTT outbox", dropped)
+		}
+		return bucket.Put([]byte("length"), itob(uint64(n)))
+	})
+}
+
+// returns the number of values in the outbox of [bucket], which is kept next
+// to it so that the outbox does not have to be counted
+func outboxCount(bucket *bolt.Bucket) int {
+	if v := bucket.Get([]byte("length")); v != nil {
+		return int(getUint(&v, 0, 8))
+	}
+	return 0
+}
+
+// an entry of the outbox
+type mqttOutboxEntry struct {
+	key []byte
+	mqttOutboxRecord
+}
+
+// returns up to [limit] entries of the outbox with keys after [after], or
+// from the start if [after] is nil
+func (b *MQTTBridge) outboxEntries(after []byte, limit int) ([]mqttOutboxEntry, error) {
+	var entries []mqttOutboxEntry
+	err := b.db.db.View(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+		c := bucket.Bucket([]byte("outbox")).Cursor()
+		k, v := c.First()
+		if after != nil {
+			if k, v = c.Seek(after); k != nil && bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && len(entries) < limit; k, v = c.Next() {
+			entry := mqttOutboxEntry{key: append([]byte(nil), k...)}
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&entry.mqttOutboxRecord); err != nil {
+				return fmt.Errorf("Could not decode MQTT outbox entry (%s)", err)
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// returns the number of values in the outbox
+func (b *MQTTBridge) outboxLength() (int, error) {
+	var n int
+	err := b.db.db.View(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+		n = outboxCount(bucket)
+		return nil
+	})
+	return n, err
+}
+
+// removes the value with [key] from the outbox, once the broker has
+// acknowledged it
+func (b *MQTTBridge) acknowledge(key []byte) error {
+	return b.db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+		outbox := bucket.Bucket([]byte("outbox"))
+		if outbox.Get(key) == nil {
+			return nil
+		}
+		if err = outbox.Delete(key); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("length"), itob(uint64(outboxCount(bucket)-1)))
+	})
+}
+
+// follows the change log from [revision] and copies the values to publish
+// into the outbox, until the bridge stops
+func (b *MQTTBridge) collect(revision uint64) {
+	for {
+		// wait on the channel from before reading the change log, so that
+		// commits made after reading it are not missed
+		changed := b.db.Changed()
+		sets, err := b.db.ChangesSince(revision, streamPageSize)
+		if err == ErrChangesPruned {
+			current, err := b.db.Revision()
+			if err == nil {
+				b.log.Warning("Not publishing the commits between revisions %v and %v, which were pruned from the change log", revision, current)
+				err = b.enqueue([]ChangeSet{{Revision: current}})
+			}
+			if err == nil {
+				revision = current
+				continue
+			}
+		}
+		if err == nil && len(sets) > 0 {
+			if err = b.enqueue(sets); err == nil {
+				revision = sets[len(sets)-1].Revision
+				select {
+				case b.queued <- struct{}{}:
+				default:
+				}
+				continue
+			}
+		}
+		if err != nil {
+			b.log.Error("Could not fill MQTT outbox (%v)", err)
+		}
+		select {
+		case <-changed:
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// keeps the bridge connected to the broker until it stops, waiting longer
+// after every failed attempt
+func (b *MQTTBridge) connect() {
+	retry := b.opts.RetryInterval
+	for {
+		connected, err := b.session()
+		if b.ctx.Err() != nil {
+			return
+		}
+		if connected {
+			retry = b.opts.RetryInterval
+		}
+		b.log.Warning("Lost connection to MQTT broker %v (%v), reconnecting in %v", b.opts.Broker, err, retry)
+		select {
+		case <-time.After(retry):
+		case <-b.ctx.Done():
+			return
+		}
+		if retry *= 2; retry > maxMQTTRetryInterval {
+			retry = maxMQTTRetryInterval
+		}
+	}
+}
+
+// writes [p] to [conn]
+func (b *MQTTBridge) write(conn net.Conn, p *mqttPacket) error {
+	var buf []byte
+	p.marshal(&buf)
+	conn.SetWriteDeadline(time.Now().Add(b.opts.KeepAlive))
+	_, err := conn.Write(buf)
+	return err
+}
+
+// connects to the broker, and publishes the outbox and handles commands
+// until the connection fails or the bridge stops. [connected] is set if the
+// broker accepted the connection
+func (b *MQTTBridge) session() (connected bool, err error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(b.ctx, "tcp", b.opts.Broker)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	keepAlive := uint16(b.opts.KeepAlive / time.Second)
+	if err = b.write(conn, mqttConnectPacket(b.opts.ClientID, b.opts.Username, b.opts.Password, keepAlive, false)); err != nil {
+		return false, err
+	}
+	conn.SetReadDeadline(time.Now().Add(b.opts.KeepAlive))
+	p, err := readMQTTPacket(r, maxMQTTPacketLength)
+	if err != nil {
+		return false, err
+	}
+	if p.Type != mqttConnack || len(p.Body) != 2 {
+		return false, fmt.Errorf("Expected CONNACK, got MQTT packet type %v", p.Type)
+	}
+	if p.Body[1] != 0 {
+		return false, fmt.Errorf("Broker refused connection with return code %v", p.Body[1])
+	}
+	b.log.Notice("Connected to MQTT broker %v", b.opts.Broker)
+	// packet identifier 0 is not allowed, and 1 is used by the subscription
+	if err = b.write(conn, mqttSubscribePacket(1, b.opts.CommandTopic+"/#", 1)); err != nil {
+		return true, err
+	}
+
+	var (
+		incoming = make(chan *mqttPacket)
+		readErr  = make(chan error, 1)
+		done     = make(chan struct{})
+	)
+	defer close(done)
+	go func() {
+		for {
+			// the broker answers the pings sent every half keepalive
+			conn.SetReadDeadline(time.Now().Add(b.opts.KeepAlive))
+			p, err := readMQTTPacket(r, maxMQTTPacketLength)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case incoming <- p:
+			case <-done:
+				return
+			}
+		}
+	}()
+	ping := time.NewTicker(b.opts.KeepAlive / 2)
+	defer ping.Stop()
+
+	var (
+		// outbox keys of the values published but not acknowledged yet
+		inflight = make(map[uint16][]byte)
+		// key of the last value published in this session
+		last     []byte
+		packetID uint16 = 1
+	)
+	for {
+		if len(inflight) < maxMQTTInflight {
+			entries, err := b.outboxEntries(last, maxMQTTInflight-len(inflight))
+			if err != nil {
+				return true, err
+			}
+			for _, entry := range entries {
+				for packetID++; packetID <= 1 || inflight[packetID] != nil; packetID++ {
+				}
+				m := &mqttMessage{Topic: entry.Topic, QoS: 1, PacketID: packetID, Payload: entry.Payload,
+					Dup: b.sent != nil && bytes.Compare(entry.key, b.sent) <= 0}
+				if err = b.write(conn, m.packet()); err != nil {
+					return true, err
+				}
+				inflight[packetID], last = entry.key, entry.key
+				if bytes.Compare(last, b.sent) > 0 {
+					b.sent = last
+				}
+			}
+		}
+		select {
+		case p := <-incoming:
+			switch p.Type {
+			case mqttPuback:
+				id, err := p.packetID()
+				if err != nil {
+					return true, err
+				}
+				if key, found := inflight[id]; found {
+					if err = b.acknowledge(key); err != nil {
+						b.log.Error("Could not remove value from MQTT outbox (%v)", err)
+					}
+					delete(inflight, id)
+				}
+			case mqttPublish:
+				m, err := parseMQTTPublish(p)
+				if err != nil {
+					return true, err
+				}
+				b.command(m)
+				if m.QoS == 1 {
+					if err = b.write(conn, mqttAckPacket(mqttPuback, m.PacketID)); err != nil {
+						return true, err
+					}
+				}
+			case mqttSuback:
+				if len(p.Body) != 3 || p.Body[2] == 0x80 {
+					return true, fmt.Errorf("Broker refused subscription to %s/#", b.opts.CommandTopic)
+				}
+			case mqttPingresp:
+			default:
+				return true, fmt.Errorf("Unexpected MQTT packet type %v", p.Type)
+			}
+		case err = <-readErr:
+			return true, err
+		case <-b.queued:
+		case <-ping.C:
+			if err = b.write(conn, &mqttPacket{Type: mqttPingreq}); err != nil {
+				return true, err
+			}
+		case <-b.ctx.Done():
+			b.write(conn, &mqttPacket{Type: mqttDisconnect})
+			return true, nil
+		}
+	}
+}
+
+// inserts the value of a command published under
+// {CommandTopic}/{collection}/{key}. The payload is a value in the form the
+// HTTP gateway takes. Invalid commands, and commands to collections the
+// nodeid of the bridge cannot write, are logged and dropped
+func (b *MQTTBridge) command(m *mqttMessage) {
+	var collection, key string
+	if rest := strings.TrimPrefix(m.Topic, b.opts.CommandTopic+"/"); rest != m.Topic {
+		if idx := strings.Index(rest, "/"); idx > 0 {
+			collection, key = rest[:idx], rest[idx+1:]
+		}
+	}
+	if key == "" || !validCollectionName(collection) {
+		b.log.Warning("Ignoring MQTT command on invalid topic %s", m.Topic)
+		return
+	}
+	if m.QoS > 1 {
+		b.log.Warning("Ignoring MQTT command on %s with QoS %v", m.Topic, m.QoS)
+		return
+	}
+	value, err := parseJSONValue(m.Payload)
+	if err != nil {
+		b.log.Warning("Ignoring MQTT command on %s (%v)", m.Topic, err)
+		return
+	}
+	rights, err := b.db.Rights(collection, b.opts.Nodeid)
+	if err != nil {
+		b.log.Error("Could not check rights for MQTT command on %s (%v)", m.Topic, err)
+		return
+	}
+	if rights&RightWrite == 0 {
+		b.log.Warning("Ignoring MQTT command on %s: node %v cannot write collection %s", m.Topic, b.opts.Nodeid, collection)
+		return
+	}
+	// the collection is always spelled out, so that keys in the global
+	// collection can contain periods
+	if err = b.db.InsertFrom(strconv.FormatUint(b.opts.Nodeid, 10), map[string]interface{}{collection + "." + key: value}); err != nil {
+		b.log.Error("Could not insert value of MQTT command on %s (%v)", m.Topic, err)
+	}
+}
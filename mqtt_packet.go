@@ -0,0 +1,211 @@
+package mpdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A minimal MQTT 3.1.1 codec for the bridge: just the packets a client that
+// publishes and subscribes with QoS 0 and 1 needs. Every packet has a fixed
+// header (type and flags in the first byte, then the remaining length as a
+// variable-length integer), followed by the variable header and payload
+
+// MQTT control packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// the largest remaining length MQTT can encode
+const maxMQTTPacketSize = 268435455
+
+// an MQTT control packet
+type mqttPacket struct {
+	Type byte
+	// the lower 4 bits of the first byte
+	Flags byte
+	// the variable header and payload
+	Body []byte
+}
+
+// a PUBLISH packet
+type mqttMessage struct {
+	Topic   string
+	QoS     byte
+	Dup     bool
+	Retain  bool
+	Payload []byte
+	// only set for QoS 1 and 2
+	PacketID uint16
+}
+
+// reads the next packet from [r]. Packets longer than [maxSize] are rejected
+func readMQTTPacket(r *bufio.Reader, maxSize int) (*mqttPacket, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var length, shift int
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return nil, fmt.Errorf("Invalid MQTT remaining length")
+		}
+	}
+	if length > maxSize {
+		return nil, fmt.Errorf("MQTT packet of %v bytes is longer than the maximum of %v", length, maxSize)
+	}
+	p := &mqttPacket{Type: first >> 4, Flags: first & 0xf, Body: make([]byte, length)}
+	if _, err = io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// appends the encoding of [p] to [output]
+func (p *mqttPacket) marshal(output *[]byte) {
+	*output = append(*output, p.Type<<4|p.Flags)
+	length := len(p.Body)
+	for {
+		b := byte(length & 0x7f)
+		if length >>= 7; length > 0 {
+			b |= 0x80
+		}
+		*output = append(*output, b)
+		if length == 0 {
+			break
+		}
+	}
+	*output = append(*output, p.Body...)
+}
+
+// appends [s] to [output] with its 2-byte length
+func appendMQTTString(output *[]byte, s string) {
+	*output = append(*output, byte(len(s)>>8), byte(len(s)))
+	*output = append(*output, s...)
+}
+
+// parses the length-prefixed string at [offset] of [body] and returns it
+// along with the offset after it
+func parseMQTTString(body []byte, offset int) (string, int, error) {
+	if offset+2 > len(body) {
+		return "", 0, fmt.Errorf("MQTT string is truncated")
+	}
+	length := int(binary.BigEndian.Uint16(body[offset:]))
+	offset += 2
+	if offset+length > len(body) {
+		return "", 0, fmt.Errorf("MQTT string is truncated")
+	}
+	return string(body[offset : offset+length]), offset + length, nil
+}
+
+// returns the packet identifier at the start of [p], as in PUBACK and SUBACK
+func (p *mqttPacket) packetID() (uint16, error) {
+	if len(p.Body) < 2 {
+		return 0, fmt.Errorf("MQTT packet without a packet identifier")
+	}
+	return binary.BigEndian.Uint16(p.Body), nil
+}
+
+// returns a CONNECT packet. The session is kept by the broker unless [clean]
+// is set
+func mqttConnectPacket(clientID, username, password string, keepAlive uint16, clean bool) *mqttPacket {
+	var body []byte
+	appendMQTTString(&body, "MQTT")
+	var flags byte
+	if clean {
+		flags |= 0x02
+	}
+	if username != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	appendMQTTString(&body, clientID)
+	if username != "" {
+		appendMQTTString(&body, username)
+		if password != "" {
+			appendMQTTString(&body, password)
+		}
+	}
+	return &mqttPacket{Type: mqttConnect, Body: body}
+}
+
+// returns a SUBSCRIBE packet for the single topic filter [filter]
+func mqttSubscribePacket(packetID uint16, filter string, qos byte) *mqttPacket {
+	body := []byte{byte(packetID >> 8), byte(packetID)}
+	appendMQTTString(&body, filter)
+	body = append(body, qos)
+	// the flags of SUBSCRIBE are reserved and must be 0010
+	return &mqttPacket{Type: mqttSubscribe, Flags: 0x02, Body: body}
+}
+
+// returns a packet that holds only the packet identifier [packetID], e.g. a
+// PUBACK
+func mqttAckPacket(typ byte, packetID uint16) *mqttPacket {
+	return &mqttPacket{Type: typ, Body: []byte{byte(packetID >> 8), byte(packetID)}}
+}
+
+// returns the PUBLISH packet of [m]
+func (m *mqttMessage) packet() *mqttPacket {
+	p := &mqttPacket{Type: mqttPublish, Flags: m.QoS << 1}
+	if m.Dup {
+		p.Flags |= 0x08
+	}
+	if m.Retain {
+		p.Flags |= 0x01
+	}
+	appendMQTTString(&p.Body, m.Topic)
+	if m.QoS > 0 {
+		p.Body = append(p.Body, byte(m.PacketID>>8), byte(m.PacketID))
+	}
+	p.Body = append(p.Body, m.Payload...)
+	return p
+}
+
+// parses the PUBLISH packet [p]
+func parseMQTTPublish(p *mqttPacket) (*mqttMessage, error) {
+	m := &mqttMessage{QoS: p.Flags >> 1 & 3, Dup: p.Flags&0x08 != 0, Retain: p.Flags&0x01 != 0}
+	if m.QoS == 3 {
+		return nil, fmt.Errorf("Invalid MQTT QoS 3")
+	}
+	topic, offset, err := parseMQTTString(p.Body, 0)
+	if err != nil {
+		return nil, err
+	}
+	m.Topic = topic
+	if m.QoS > 0 {
+		if offset+2 > len(p.Body) {
+			return nil, fmt.Errorf("MQTT PUBLISH without a packet identifier")
+		}
+		m.PacketID = binary.BigEndian.Uint16(p.Body[offset:])
+		offset += 2
+	}
+	m.Payload = p.Body[offset:]
+	return m, nil
+}
+
+// returns true if [topic] can be published to: it is not empty and does not
+// contain wildcards or NUL characters
+func validMQTTTopic(topic string) bool {
+	return topic != "" && len(topic) <= 0xffff && !strings.ContainsAny(topic, "+#\x00")
+}
@@ -0,0 +1,316 @@
+package mpdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMQTTPacket(t *testing.T) {
+	m := &mqttMessage{Topic: "a/b", QoS: 1, Dup: true, PacketID: 0x1234, Payload: bytes.Repeat([]byte("x"), 200)}
+	var buf []byte
+	m.packet().marshal(&buf)
+	// 200 + 5 + 2 bytes need a 2-byte remaining length
+	if !bytes.Equal(buf[:3], []byte{0x3a, 0xcf, 0x01}) {
+		t.Errorf("Unexpected fixed header %x", buf[:3])
+	}
+	p, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(buf)), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := parseMQTTPublish(p); err != nil || got.Topic != m.Topic || got.QoS != 1 || !got.Dup || got.Retain ||
+		got.PacketID != m.PacketID || !bytes.Equal(got.Payload, m.Payload) {
+		t.Errorf("Decoded %+v as %+v (%v)", m, got, err)
+	}
+	if _, err = readMQTTPacket(bufio.NewReader(bytes.NewReader(buf)), 100); err == nil {
+		t.Error("Read packet longer than the maximum")
+	}
+	if _, err = readMQTTPacket(bufio.NewReader(bytes.NewReader(buf[:100])), 1024); err == nil {
+		t.Error("Read truncated packet")
+	}
+
+	buf = nil
+	mqttConnectPacket("id", "user", "pass", 60, true).marshal(&buf)
+	expected := []byte{0x10, 26, 0, 4, 'M', 'Q', 'T', 'T', 4, 0xc2, 0, 60, 0, 2, 'i', 'd',
+		0, 4, 'u', 's', 'e', 'r', 0, 4, 'p', 'a', 's', 's'}
+	if !bytes.Equal(buf, expected) {
+		t.Errorf("Encoded CONNECT as %x, expected %x", buf, expected)
+	}
+	for topic, valid := range map[string]bool{"a/b": true, "": false, "a/+": false, "a/#": false} {
+		if validMQTTTopic(topic) != valid {
+			t.Errorf("Expected validity of topic %q to be %v", topic, valid)
+		}
+	}
+}
+
+// a minimal MQTT broker that acknowledges everything, records the messages
+// published to it and can publish to the client connected to it
+type testBroker struct {
+	t         *testing.T
+	l         net.Listener
+	published chan *mqttMessage
+	// the topic filters subscribed to
+	subscribed chan string
+	mu         sync.Mutex
+	conns      []net.Conn
+}
+
+func newTestBroker(t *testing.T, addr string) *testBroker {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{t: t, l: l, published: make(chan *mqttMessage, 16), subscribed: make(chan string, 16)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) write(conn net.Conn, p *mqttPacket) {
+	var buf []byte
+	p.marshal(&buf)
+	conn.Write(buf)
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		p, err := readMQTTPacket(r, maxMQTTPacketLength)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case mqttConnect:
+			b.write(conn, &mqttPacket{Type: mqttConnack, Body: []byte{0, 0}})
+		case mqttSubscribe:
+			id, _ := p.packetID()
+			filter, offset, err := parseMQTTString(p.Body, 2)
+			if err != nil {
+				b.t.Error(err)
+				return
+			}
+			b.write(conn, &mqttPacket{Type: mqttSuback, Body: []byte{byte(id >> 8), byte(id), p.Body[offset]}})
+			b.subscribed <- filter
+		case mqttPublish:
+			m, err := parseMQTTPublish(p)
+			if err != nil {
+				b.t.Error(err)
+				return
+			}
+			if m.QoS == 1 {
+				b.write(conn, mqttAckPacket(mqttPuback, m.PacketID))
+			}
+			b.published <- m
+		case mqttPingreq:
+			b.write(conn, &mqttPacket{Type: mqttPingresp})
+		case mqttPuback:
+		case mqttDisconnect:
+			return
+		default:
+			b.t.Errorf("Unexpected packet %+v", p)
+		}
+	}
+}
+
+// publishes [payload] under [topic] to the connected clients
+func (b *testBroker) publish(topic string, payload string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		b.write(conn, (&mqttMessage{Topic: topic, QoS: 1, PacketID: 7, Payload: []byte(payload)}).packet())
+	}
+}
+
+func (b *testBroker) close() {
+	b.l.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// returns the next message published to [b], skipping those under other
+// topics than [topic]
+func (b *testBroker) next(t *testing.T, topic string) *mqttMessage {
+	for {
+		select {
+		case m := <-b.published:
+			if m.Topic == topic {
+				return m
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Nothing was published under %s", topic)
+		}
+	}
+}
+
+// polls [cond] until it holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	// start from an empty outbox
+	db.db.Update(func(tx *bolt.Tx) error {
+		tx.DeleteBucket(mqttBucket)
+		return nil
+	})
+	broker := newTestBroker(t, "127.0.0.1:0")
+	if _, err := NewMQTTBridge(MQTTOptions{DB: db, Broker: broker.l.Addr().String(), CommandTopic: "mpdb/set"}); err == nil {
+		t.Error("Created bridge with overlapping topics")
+	}
+	bridge, err := NewMQTTBridge(MQTTOptions{DB: db, Broker: broker.l.Addr().String(), RetryInterval: 10 * time.Millisecond, Nodeid: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bridge.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case filter := <-broker.subscribed:
+		if filter != "mpdb-set/#" {
+			t.Errorf("Subscribed to %s", filter)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bridge did not subscribe")
+	}
+
+	// inserts are published
+	if err = db.Insert(map[string]interface{}{"mqtt.temp": int64(21)}); err != nil {
+		t.Fatal(err)
+	}
+	m := broker.next(t, "mpdb/mqtt/temp")
+	var entry struct {
+		Key   string
+		Type  string
+		Value json.Number
+	}
+	if err = json.Unmarshal(m.Payload, &entry); err != nil || m.QoS != 1 || entry.Key != "mqtt.temp" ||
+		entry.Type != "int64" || entry.Value != "21" {
+		t.Errorf("Unexpected message %+v (%v)", m, err)
+	}
+
+	// commands are inserted as the nodeid of the bridge, and then published
+	// like any other insert. Commands to collections it cannot write are
+	// dropped
+	if err = db.SetACL("mqttlocked", []ACLEntry{{0, math.MaxUint64, RightRead}}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.SetACL("mqttlocked", nil)
+	db.Delete([]string{"mqttlocked.setpoint"})
+	broker.publish("mpdb-set/mqttlocked/setpoint", `{"type": "string", "value": "high"}`)
+	broker.publish("mpdb-set/mqtt/setpoint", `{"type": "string", "value": "low"}`)
+	broker.next(t, "mpdb/mqtt/setpoint")
+	if entries, _ := db.GetWithMeta([]string{"mqtt.setpoint"}); entries["mqtt.setpoint"] == nil ||
+		entries["mqtt.setpoint"].Value != "low" || entries["mqtt.setpoint"].Writer != "7" {
+		t.Errorf("Command was not inserted as node 7: %+v", entries["mqtt.setpoint"])
+	}
+	if values, _ := db.Get([]string{"mqttlocked.setpoint"}); values["mqttlocked.setpoint"] != nil {
+		t.Errorf("Command to a collection the bridge cannot write was inserted: %v", values)
+	}
+
+	// values inserted while the broker is down wait in the outbox
+	addr := broker.l.Addr().String()
+	broker.close()
+	if err = db.Insert(map[string]interface{}{"mqtt.offline": uint64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "outbox", func() bool {
+		n, _ := bridge.outboxLength()
+		return n == 1
+	})
+	broker = newTestBroker(t, addr)
+	defer broker.close()
+	broker.next(t, "mpdb/mqtt/offline")
+	waitFor(t, "acknowledgement", func() bool {
+		n, _ := bridge.outboxLength()
+		return n == 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = bridge.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMQTTOutboxFull(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	db.db.Update(func(tx *bolt.Tx) error {
+		tx.DeleteBucket(mqttBucket)
+		return nil
+	})
+	bridge, err := NewMQTTBridge(MQTTOptions{DB: db, Broker: "127.0.0.1:1883"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge.maxOutbox = 5
+	// fills the outbox with one value for each of [values], in one commit
+	fill := func(values ...uint64) {
+		set := ChangeSet{Revision: values[0]}
+		for _, value := range values {
+			set.Changes = append(set.Changes, Change{Key: "full.a", Collection: "full", Value: value})
+		}
+		if err := bridge.enqueue([]ChangeSet{set}); err != nil {
+			t.Fatal("Could not fill MQTT outbox", err)
+		}
+	}
+	// checks that the outbox holds the values [first] to [last]
+	check := func(first, last uint64) {
+		if n, err := bridge.outboxLength(); err != nil || n != int(last-first+1) {
+			t.Errorf("Outbox length %v (%v) did not match %v", n, err, last-first+1)
+		}
+		entries, err := bridge.outboxEntries(nil, 100)
+		if err != nil || len(entries) != int(last-first+1) {
+			t.Fatalf("Unexpected outbox entries %v (%v)", entries, err)
+		}
+		for idx, entry := range entries {
+			var value struct{ Value uint64 }
+			if err = json.Unmarshal(entry.Payload, &value); err != nil || value.Value != first+uint64(idx) {
+				t.Errorf("Outbox entry %v was %s instead of value %v (%v)", idx, entry.Payload, first+uint64(idx), err)
+			}
+		}
+	}
+
+	fill(1, 2, 3)
+	check(1, 3)
+	fill(4, 5, 6, 7, 8, 9)
+	check(5, 9)
+	entries, _ := bridge.outboxEntries(nil, 1)
+	if err = bridge.acknowledge(entries[0].key); err != nil {
+		t.Fatal(err)
+	}
+	// acknowledging a value twice does not change the length
+	if err = bridge.acknowledge(entries[0].key); err != nil {
+		t.Fatal(err)
+	}
+	check(6, 9)
+	fill(10, 11)
+	check(7, 11)
+}
@@ -0,0 +1,602 @@
+package mpdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// Request is a decoded request. Requests are decoded straight from the
+// datagram into this struct, checking the type of every field, so that
+// malformed requests are rejected before they are queued. Fields that an
+// oper does not use are left at their zero value
+type Request struct {
+	Oper   string
+	Nodeid uint64
+	Echo   uint64
+	// data, keys and collection, with dictionary indexes expanded. These are
+	// only set once the request is expanded
+	Data       map[string]interface{}
+	Keys       []string
+	Collection string
+	// the zero Time unless the request has an "asof" field
+	Asof     time.Time
+	Meta     bool
+	Versions uint64
+	Maxage   uint64
+	ACL      []ACLEntry
+	Eui64    uint64
+	Name     string
+	Node     uint64
+	Dict     []string
+	// the sub-operations of a TXN, in order
+	Ops []*Request
+	// the values a CAS expects, keyed like Data. Only set once the request is
+	// expanded
+	Expect map[string]interface{}
+	// the fields to index (SETINDEX), and the field to look up (FIND)
+	Fields []string
+	Field  string
+	// the value FIND looks up, or the bounds of the range it looks up. Nil
+	// bounds leave the range open
+	Value    interface{}
+	Min      interface{}
+	Max      interface{}
+	hasValue bool
+	// the entries GETBUCKET returns, and the form it returns them in
+	Where   *Filter
+	Project string
+
+	// data, keys and collection as they were sent. They are expanded when the
+	// request is executed, so that a request can use a dictionary set by an
+	// earlier request in the same window
+	data          []dataItem
+	keys          []dictKey
+	collection    dictKey
+	hasCollection bool
+	expect        []dataItem
+	// set for the sub-operations of a TXN, which cannot be TXNs themselves
+	inTxn bool
+	// set if the data or expect field holds a value MPDB cannot store. The
+	// request is still decoded, so that the node gets an error in response
+	invalid error
+}
+
+// A dictKey is a key or collection name that was sent either as a string, or
+// as an index into the dictionary of the node
+type dictKey struct {
+	name    string
+	index   uint64
+	indexed bool
+}
+
+func (k dictKey) String() string {
+	if k.indexed {
+		return fmt.Sprintf("#%v", k.index)
+	}
+	return k.name
+}
+
+// a key/value pair from the data field of a request
+type dataItem struct {
+	key   dictKey
+	value interface{}
+}
+
+// the fields every request must have
+const (
+	hasOper = 1 << iota
+	hasNodeid
+	hasEcho
+)
+
+// Decodes the request at [offset], in compact or plain mode, and returns it
+// along with the number of bytes consumed
+func decodeRequest(input *[]byte, offset int) (*Request, int, error) {
+	var req = new(Request)
+	if !isCompact(input, offset) {
+		if err := need(input, offset, 1); err != nil {
+			return nil, 0, err
+		}
+		consumed, fields, err := req.decodeFields(input, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, field := range []struct {
+			flag int
+			name string
+		}{{hasOper, "oper"}, {hasNodeid, "nodeid"}, {hasEcho, "echo"}} {
+			if fields&field.flag == 0 {
+				return nil, 0, fmt.Errorf("Request at offset %v does not have field %q", offset, field.name)
+			}
+		}
+		return req, consumed, nil
+	}
+	h, err := ParseHeader(input, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.Length > headerLength {
+		body := (*input)[:offset+h.Length]
+		if body[offset+headerLength] != 0xc0 { // nil body
+			consumed, _, err := req.decodeFields(&body, offset+headerLength)
+			if err != nil {
+				return nil, 0, err
+			}
+			if headerLength+consumed != h.Length {
+				return nil, 0, fmt.Errorf("Request at offset %v is longer than its body", offset)
+			}
+		} else if h.Length != headerLength+1 {
+			return nil, 0, fmt.Errorf("Request at offset %v is longer than its body", offset)
+		}
+	}
+	req.Oper, req.Nodeid, req.Echo = h.Type.String(), h.Nodeid, uint64(h.Echo)
+	return req, h.Length, nil
+}
+
+// decodes the msgpack map at [offset] into the fields of the request, and
+// returns the number of bytes consumed and which of the required fields were
+// present. Unknown fields are skipped
+func (req *Request) decodeFields(input *[]byte, offset int) (int, int, error) {
+	var fields int
+	initialoffset := offset
+	length, consumed, err := parseMapHeader(input, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset += consumed
+	for idx := 0; idx < length; idx++ {
+		if err = need(input, offset, 1); err != nil {
+			return 0, 0, err
+		}
+		field, consumed, err := parseString(input, offset)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Request field name at offset %v is not a string", offset)
+		}
+		offset += consumed
+		if err = need(input, offset, 1); err != nil {
+			return 0, 0, err
+		}
+		switch field {
+		case "oper":
+			fields |= hasOper
+			consumed, err = req.decodeOper(input, offset)
+		case "nodeid":
+			fields |= hasNodeid
+			req.Nodeid, consumed, err = decodeUintField(input, offset)
+		case "echo":
+			fields |= hasEcho
+			req.Echo, consumed, err = decodeUintField(input, offset)
+		case "data":
+			req.data, consumed, err = decodeDataField(input, offset)
+			if err == nil && req.invalid == nil {
+				req.invalid = checkValues(req.data, false)
+			}
+		case "keys":
+			req.keys, consumed, err = decodeKeysField(input, offset)
+		case "collection":
+			req.hasCollection = true
+			req.collection, consumed, err = decodeKeyField(input, offset)
+		case "asof":
+			req.Asof, consumed, err = decodeTimeField(input, offset)
+		case "meta":
+			req.Meta, consumed, err = decodeBoolField(input, offset)
+		case "versions":
+			req.Versions, consumed, err = decodeUintField(input, offset)
+		case "maxage":
+			req.Maxage, consumed, err = decodeUintField(input, offset)
+		case "acl":
+			req.ACL, consumed, err = decodeACLField(input, offset)
+		case "eui64":
+			req.Eui64, consumed, err = decodeUintField(input, offset)
+		case "name":
+			req.Name, consumed, err = decodeStringField(input, offset)
+		case "node":
+			req.Node, consumed, err = decodeUintField(input, offset)
+		case "dict":
+			req.Dict, consumed, err = decodeStringsField(input, offset)
+		case "ops":
+			if req.inTxn {
+				err = fmt.Errorf("transactions cannot be nested")
+			} else {
+				req.Ops, consumed, err = decodeOpsField(input, offset)
+			}
+		case "expect":
+			req.expect, consumed, err = decodeDataField(input, offset)
+			if err == nil && req.invalid == nil {
+				req.invalid = checkValues(req.expect, true)
+			}
+		case "fields":
+			req.Fields, consumed, err = decodeStringsField(input, offset)
+		case "field":
+			req.Field, consumed, err = decodeStringField(input, offset)
+		case "value":
+			req.hasValue = true
+			req.Value, consumed, err = decodeValue(input, offset, 2)
+		case "min":
+			req.Min, consumed, err = decodeValue(input, offset, 2)
+		case "max":
+			req.Max, consumed, err = decodeValue(input, offset, 2)
+		case "where":
+			req.Where, consumed, err = decodeFilterField(input, offset)
+		case "project":
+			req.Project, consumed, err = decodeStringField(input, offset)
+		default:
+			_, consumed, err = decode(input, offset)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid field %q (%s)", field, err)
+		}
+		offset += consumed
+	}
+	return offset - initialoffset, fields, nil
+}
+
+// opers are either names or integer opcodes
+func (req *Request) decodeOper(input *[]byte, offset int) (int, error) {
+	if c := (*input)[offset]; (c >= 0xa0 && c <= 0xbf) || c == 0xd9 || c == 0xda || c == 0xdb {
+		oper, consumed, err := parseString(input, offset)
+		req.Oper = oper
+		return consumed, err
+	}
+	opcode, consumed, err := decodeUintField(input, offset)
+	if err != nil {
+		return 0, fmt.Errorf("expected a string or an opcode at offset %v", offset)
+	}
+	if req.Oper = MessageType(opcode).String(); req.Oper == "" {
+		return 0, fmt.Errorf("unknown opcode %v at offset %v", opcode, offset)
+	}
+	return consumed, nil
+}
+
+// decodes a non-negative integer, in any of the msgpack integer formats
+func decodeUintField(input *[]byte, offset int) (uint64, int, error) {
+	c := (*input)[offset]
+	switch {
+	case c >= 0xcc && c <= 0xcf:
+		return parseUint(input, offset)
+	case c <= 0x7f, c >= 0xd0 && c <= 0xd3:
+		value, consumed, err := parseInt(input, offset)
+		if err == nil && value < 0 {
+			err = fmt.Errorf("expected an unsigned integer at offset %v, got %v", offset, value)
+		}
+		return uint64(value), consumed, err
+	}
+	return 0, 0, fmt.Errorf("expected an unsigned integer at offset %v", offset)
+}
+
+func decodeStringField(input *[]byte, offset int) (string, int, error) {
+	value, consumed, err := parseString(input, offset)
+	if err != nil {
+		return "", 0, fmt.Errorf("expected a string at offset %v", offset)
+	}
+	return value, consumed, nil
+}
+
+func decodeBoolField(input *[]byte, offset int) (bool, int, error) {
+	switch (*input)[offset] {
+	case 0xc2:
+		return false, 1, nil
+	case 0xc3:
+		return true, 1, nil
+	}
+	return false, 0, fmt.Errorf("expected a boolean at offset %v", offset)
+}
+
+// decodes a msgpack timestamp, or an integer number of seconds since the unix
+// epoch
+func decodeTimeField(input *[]byte, offset int) (time.Time, int, error) {
+	if c := (*input)[offset]; c >= 0xc7 && c <= 0xc9 || c >= 0xd4 && c <= 0xd8 {
+		value, consumed, err := parseExt(input, offset)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		if t, ok := value.(time.Time); ok {
+			return t, consumed, nil
+		}
+		return time.Time{}, 0, fmt.Errorf("expected a timestamp at offset %v", offset)
+	}
+	seconds, consumed, err := decodeUintField(input, offset)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("expected a timestamp or unix time at offset %v", offset)
+	}
+	return time.Unix(int64(seconds), 0), consumed, nil
+}
+
+// decodes a key or collection name, which is a string or a dictionary index
+func decodeKeyField(input *[]byte, offset int) (dictKey, int, error) {
+	if name, consumed, err := parseString(input, offset); err == nil {
+		return dictKey{name: name}, consumed, nil
+	}
+	index, consumed, err := decodeUintField(input, offset)
+	if err != nil {
+		return dictKey{}, 0, fmt.Errorf("expected a string or a dictionary index at offset %v", offset)
+	}
+	return dictKey{index: index, indexed: true}, consumed, nil
+}
+
+func decodeKeysField(input *[]byte, offset int) ([]dictKey, int, error) {
+	initialoffset := offset
+	length, consumed, err := parseArrayHeader(input, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += consumed
+	var keys = make([]dictKey, length)
+	for idx := range keys {
+		if err = need(input, offset, 1); err != nil {
+			return nil, 0, err
+		}
+		if keys[idx], consumed, err = decodeKeyField(input, offset); err != nil {
+			return nil, 0, err
+		}
+		offset += consumed
+	}
+	return keys, offset - initialoffset, nil
+}
+
+func decodeStringsField(input *[]byte, offset int) ([]string, int, error) {
+	initialoffset := offset
+	length, consumed, err := parseArrayHeader(input, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += consumed
+	var list = make([]string, length)
+	for idx := range list {
+		if err = need(input, offset, 1); err != nil {
+			return nil, 0, err
+		}
+		if list[idx], consumed, err = decodeStringField(input, offset); err != nil {
+			return nil, 0, err
+		}
+		offset += consumed
+	}
+	return list, offset - initialoffset, nil
+}
+
+// decodes the data of a request, which is either a map, or an array of
+// alternating keys and values whose keys can be dictionary indexes
+func decodeDataField(input *[]byte, offset int) ([]dataItem, int, error) {
+	var length, consumed int
+	initialoffset := offset
+	isMap := (*input)[offset]>>4 == 0x8 || (*input)[offset] == 0xde || (*input)[offset] == 0xdf
+	if isMap {
+		l, c, err := parseMapHeader(input, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		length, consumed = l, c
+	} else {
+		l, c, err := parseArrayHeader(input, offset)
+		if err != nil {
+			return nil, 0, fmt.Errorf("expected a map or an array at offset %v", offset)
+		}
+		if l%2 != 0 {
+			return nil, 0, fmt.Errorf("data array at offset %v has an odd number of elements", offset)
+		}
+		length, consumed = l/2, c
+	}
+	offset += consumed
+	var items = make([]dataItem, length)
+	for idx := range items {
+		var err error
+		if err = need(input, offset, 1); err != nil {
+			return nil, 0, err
+		}
+		if isMap {
+			items[idx].key.name, consumed, err = decodeStringField(input, offset)
+		} else {
+			items[idx].key, consumed, err = decodeKeyField(input, offset)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += consumed
+		if items[idx].value, consumed, err = decodeValue(input, offset, 2); err != nil {
+			return nil, 0, err
+		}
+		offset += consumed
+	}
+	return items, offset - initialoffset, nil
+}
+
+// checks that the values of [items] can be stored. Nil values are only
+// allowed if [allowNil] is set, for the values a CAS expects to be missing
+func checkValues(items []dataItem, allowNil bool) error {
+	for _, item := range items {
+		if !storableValue(item.value) && !(allowNil && item.value == nil) {
+			return fmt.Errorf("Cannot store value %v of type %T under key %v", item.value, item.value, item.key)
+		}
+	}
+	return nil
+}
+
+// decodes the sub-operations of a TXN, an array of maps with the same fields
+// as a request. Only "oper" is required
+func decodeOpsField(input *[]byte, offset int) ([]*Request, int, error) {
+	initialoffset := offset
+	length, consumed, err := parseArrayHeader(input, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += consumed
+	var ops = make([]*Request, length)
+	for idx := range ops {
+		if err = need(input, offset, 1); err != nil {
+			return nil, 0, err
+		}
+		ops[idx] = &Request{inTxn: true}
+		consumed, fields, err := ops[idx].decodeFields(input, offset)
+		if err != nil {
+			return nil, 0, fmt.Errorf("operation %v: %s", idx, err)
+		}
+		if fields&hasOper == 0 {
+			return nil, 0, fmt.Errorf("operation %v does not have field \"oper\"", idx)
+		}
+		offset += consumed
+	}
+	return ops, offset - initialoffset, nil
+}
+
+// decodes a list of ACL entries. Each entry is a map with keys "first", "last"
+// (defaults to "first") and "rights" (a string of letters: "r" for read, "w"
+// for write and "a" for admin)
+func decodeACLField(input *[]byte, offset int) ([]ACLEntry, int, error) {
+	initialoffset := offset
+	length, consumed, err := parseArrayHeader(input, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += consumed
+	var entries = make([]ACLEntry, length)
+	for idx := range entries {
+		if err = need(input, offset, 1); err != nil {
+			return nil, 0, err
+		}
+		fields, consumed, err := parseMapHeader(input, offset)
+		if err != nil {
+			return nil, 0, fmt.Errorf("ACL entry at offset %v is not a map", offset)
+		}
+		offset += consumed
+		var hasFirst, hasLast bool
+		for fieldidx := 0; fieldidx < fields; fieldidx++ {
+			if err = need(input, offset, 1); err != nil {
+				return nil, 0, err
+			}
+			field, consumed, err := decodeStringField(input, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += consumed
+			if err = need(input, offset, 1); err != nil {
+				return nil, 0, err
+			}
+			switch field {
+			case "first":
+				hasFirst = true
+				entries[idx].First, consumed, err = decodeUintField(input, offset)
+			case "last":
+				hasLast = true
+				entries[idx].Last, consumed, err = decodeUintField(input, offset)
+			case "rights":
+				var rights string
+				if rights, consumed, err = decodeStringField(input, offset); err == nil {
+					entries[idx].Rights, err = ParseRights(rights)
+				}
+			default:
+				_, consumed, err = decode(input, offset)
+			}
+			if err != nil {
+				return nil, 0, fmt.Errorf("ACL entry %v: %q: %s", idx, field, err)
+			}
+			offset += consumed
+		}
+		if !hasFirst {
+			return nil, 0, fmt.Errorf("ACL entry %v does not have key 'first'", idx)
+		}
+		if !hasLast {
+			entries[idx].Last = entries[idx].First
+		}
+	}
+	return entries, offset - initialoffset, nil
+}
+
+// decodes a GETBUCKET filter, a map with any of the keys "prefix", "glob" and
+// "type" (strings), and "eq", "ne", "lt", "le", "gt" and "ge" (values)
+func decodeFilterField(input *[]byte, offset int) (*Filter, int, error) {
+	initialoffset := offset
+	fields, consumed, err := parseMapHeader(input, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("filter at offset %v is not a map", offset)
+	}
+	offset += consumed
+	var filter = new(Filter)
+	for idx := 0; idx < fields; idx++ {
+		if err = need(input, offset, 1); err != nil {
+			return nil, 0, err
+		}
+		field, consumed, err := decodeStringField(input, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += consumed
+		if err = need(input, offset, 1); err != nil {
+			return nil, 0, err
+		}
+		switch field {
+		case "prefix":
+			filter.Prefix, consumed, err = decodeStringField(input, offset)
+		case "glob":
+			filter.Glob, consumed, err = decodeStringField(input, offset)
+		case "type":
+			filter.Type, consumed, err = decodeStringField(input, offset)
+		case "eq":
+			filter.Eq, consumed, err = decodeValue(input, offset, 2)
+		case "ne":
+			filter.Ne, consumed, err = decodeValue(input, offset, 2)
+		case "lt":
+			filter.Lt, consumed, err = decodeValue(input, offset, 2)
+		case "le":
+			filter.Le, consumed, err = decodeValue(input, offset, 2)
+		case "gt":
+			filter.Gt, consumed, err = decodeValue(input, offset, 2)
+		case "ge":
+			filter.Ge, consumed, err = decodeValue(input, offset, 2)
+		default:
+			_, consumed, err = decode(input, offset)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("filter %q: %s", field, err)
+		}
+		offset += consumed
+	}
+	return filter, offset - initialoffset, nil
+}
+
+// expands the data, keys and collection of the request using the dictionary
+// of the node. Fails if the request holds a value that cannot be stored
+func (req *Request) expand(exp *expander) error {
+	if req.invalid != nil {
+		return req.invalid
+	}
+	var err error
+	if req.data != nil {
+		req.Data = make(map[string]interface{}, len(req.data))
+		for _, item := range req.data {
+			key, err := exp.expand(item.key)
+			if err != nil {
+				return err
+			}
+			req.Data[key] = item.value
+		}
+	}
+	if req.keys != nil {
+		req.Keys = make([]string, len(req.keys))
+		for idx, k := range req.keys {
+			if req.Keys[idx], err = exp.expand(k); err != nil {
+				return err
+			}
+		}
+	}
+	if req.hasCollection {
+		if req.Collection, err = exp.expand(req.collection); err != nil {
+			return err
+		}
+	}
+	if req.expect != nil {
+		req.Expect = make(map[string]interface{}, len(req.expect))
+		for _, item := range req.expect {
+			key, err := exp.expand(item.key)
+			if err != nil {
+				return err
+			}
+			req.Expect[key] = item.value
+		}
+	}
+	for _, op := range req.Ops {
+		if err = op.expand(exp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,58 +2,392 @@
 
 // Package mpdb is MsgPack Database -- a collection-based key-value store for
 // embedded clients
-package main
+package mpdb
 
 import (
+	"context"
+	"fmt"
 	"github.com/op/go-logging"
-	"github.com/ugorji/go/codec"
 	"net"
-	"os"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var mh codec.MsgpackHandle
-
+// the default logger, used by DB and by servers without their own Logger
 var log = logging.MustGetLogger("mphandler")
-var format = "%{color}%{level} %{time:Jan 02 15:04:05} %{shortfile}%{color:reset} ▶ %{message}"
-var logBackend = logging.NewLogBackend(os.Stderr, "", 0)
-var db *DB
-var clients = make(map[string]*Client)
 
-func ServeUDP(addr *net.UDPAddr) {
-	conn, err := net.ListenUDP("udp6", addr)
-	if err != nil {
-		log.Error("Error on listening: %v", err)
+// Options configure a Server. Zero values are replaced by the defaults given
+// for each field
+type Options struct {
+	// the database to serve. The server does not close it
+	DB *DB
+	// UDP addresses to listen on. IPv6 link-local addresses need a zone, e.g.
+	// "[fe80::1%eth0]:7000". An address without a host, e.g. ":7000",
+	// listens on all IPv4 and IPv6 addresses with a single socket. Defaults
+	// to "[::]:7000"
+	Listen []string
+	// TCP addresses to listen on, in the same form as Listen. Defaults to none
+	ListenTCP []string
+	// TCP addresses to serve the HTTP gateway on. Defaults to none
+	ListenHTTP []string
+	// UDP addresses to serve the CoAP front-end on, e.g. "[::]:5683".
+	// Defaults to none
+	ListenCoAP []string
+	// how long a client waits before resending responses that were not
+	// acknowledged. Defaults to 2 seconds
+	Timeout time.Duration
+	// number of echo tags in the window of each client. Defaults to 5
+	WindowSize uint64
+	// largest datagram responses are packed into. Defaults to 1024 bytes
+	MaxDatagramSize int
+	// largest datagram the server reads. Defaults to 4096 bytes
+	MaxRequestSize int
+	// largest frame the server reads from TCP connections. Defaults to 1 MiB
+	MaxFrameSize int
+	// maximum number of clients with a session, or 0 for no limit. Datagrams
+	// from new clients beyond the limit are dropped
+	MaxClients int
+	// defaults to the "mphandler" logger
+	Logger *logging.Logger
+}
+
+// fills in the defaults for zero values and checks the options
+func (opts *Options) normalize() error {
+	if opts.DB == nil {
+		return fmt.Errorf("No database to serve")
+	}
+	if len(opts.Listen) == 0 {
+		opts.Listen = []string{"[::]:7000"}
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	if opts.WindowSize == 0 {
+		opts.WindowSize = 5
+	}
+	if opts.MaxDatagramSize == 0 {
+		opts.MaxDatagramSize = 1024
+	}
+	if opts.MaxRequestSize == 0 {
+		opts.MaxRequestSize = 4096
+	}
+	if opts.MaxFrameSize == 0 {
+		opts.MaxFrameSize = 1 << 20
+	}
+	if opts.Logger == nil {
+		opts.Logger = log
+	}
+	if opts.Timeout < 0 || opts.MaxDatagramSize < 64 || opts.MaxRequestSize < 64 || opts.MaxFrameSize < 64 || opts.MaxClients < 0 {
+		return fmt.Errorf("Invalid server options %+v", *opts)
 	}
-	defer conn.Close()
+	return nil
+}
 
-	for {
-		buf := make([]byte, 4096)
-		n, fromaddr, err := conn.ReadFrom(buf)
+// Server serves a DB to clients over UDP, TCP, HTTP and CoAP. All UDP
+// listeners of a server share its clients
+type Server struct {
+	db  *DB
+	log *logging.Logger
+	// holds the *Options in use, which SetOptions replaces as a whole so that
+	// client goroutines can read them without locking
+	opts atomic.Value
+
+	conns         []*net.UDPConn
+	tcpListeners  []*net.TCPListener
+	httpListeners []net.Listener
+	httpServers   []*http.Server
+	coapConns     []*net.UDPConn
+	coap          *coapState
+	// the goroutines reading datagrams and TCP connections, and notifying
+	// CoAP observers
+	listeners sync.WaitGroup
+	// cancelled by Stop to stop reading datagrams
+	listenCtx     context.Context
+	stopListening context.CancelFunc
+
+	// clients of all listeners, keyed by address. Their loops stop when
+	// clientsCtx is cancelled
+	clients     map[string]*Client
+	clientsLock sync.Mutex
+	clientsCtx  context.Context
+	stopClients context.CancelFunc
+}
+
+// NewServer creates a server with the given options. It does not listen until
+// Start is called
+func NewServer(opts Options) (*Server, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	s := &Server{db: opts.DB, log: opts.Logger, clients: make(map[string]*Client), coap: newCoAPState()}
+	s.opts.Store(&opts)
+	s.listenCtx, s.stopListening = context.WithCancel(context.Background())
+	s.clientsCtx, s.stopClients = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// returns the options in use
+func (s *Server) options() *Options {
+	return s.opts.Load().(*Options)
+}
+
+// SetOptions applies the options that can change while the server runs: the
+// timeout (for new clients), window size (for new sessions), datagram and
+// frame sizes and maximum number of clients. The database, listen addresses
+// and logger cannot change
+func (s *Server) SetOptions(opts Options) error {
+	old := s.options()
+	opts.DB, opts.Listen, opts.ListenTCP, opts.ListenHTTP = old.DB, old.Listen, old.ListenTCP, old.ListenHTTP
+	opts.ListenCoAP = old.ListenCoAP
+	opts.Logger = old.Logger
+	if err := opts.normalize(); err != nil {
+		return err
+	}
+	s.opts.Store(&opts)
+	return nil
+}
+
+// Start listens on all addresses of the server and starts serving them. If
+// any address cannot be listened on, none are
+func (s *Server) Start() error {
+	for _, listen := range s.options().Listen {
+		addr, err := net.ResolveUDPAddr("udp", listen)
 		if err != nil {
-			log.Error("Problem reading connection %v", err)
+			s.closeConns()
+			return fmt.Errorf("Could not resolve UDP address %v (%s)", listen, err)
 		}
-		if n > 0 {
-			var client *Client
-			var found bool
-			var addr *net.UDPAddr = fromaddr.(*net.UDPAddr)
-			log.Debug("Handling incoming from %v", addr)
-			if client, found = clients[addr.String()]; !found {
-				log.Debug("creating new client")
-				client = NewClient(2*time.Second, addr)
-				clients[addr.String()] = client
+		conn, err := net.ListenUDP(listenNetwork(addr), addr)
+		if err != nil {
+			s.closeConns()
+			return fmt.Errorf("Could not listen on %v (%s)", listen, err)
+		}
+		s.conns = append(s.conns, conn)
+	}
+	for _, listen := range s.options().ListenTCP {
+		addr, err := net.ResolveTCPAddr("tcp", listen)
+		if err != nil {
+			s.closeConns()
+			return fmt.Errorf("Could not resolve TCP address %v (%s)", listen, err)
+		}
+		l, err := net.ListenTCP(listenNetworkTCP(addr), addr)
+		if err != nil {
+			s.closeConns()
+			return fmt.Errorf("Could not listen on %v (%s)", listen, err)
+		}
+		s.tcpListeners = append(s.tcpListeners, l)
+	}
+	for _, listen := range s.options().ListenHTTP {
+		l, err := net.Listen("tcp", listen)
+		if err != nil {
+			s.closeConns()
+			return fmt.Errorf("Could not listen on %v (%s)", listen, err)
+		}
+		s.httpListeners = append(s.httpListeners, l)
+	}
+	for _, listen := range s.options().ListenCoAP {
+		addr, err := net.ResolveUDPAddr("udp", listen)
+		if err != nil {
+			s.closeConns()
+			return fmt.Errorf("Could not resolve UDP address %v (%s)", listen, err)
+		}
+		conn, err := net.ListenUDP(listenNetwork(addr), addr)
+		if err != nil {
+			s.closeConns()
+			return fmt.Errorf("Could not listen on %v (%s)", listen, err)
+		}
+		s.coapConns = append(s.coapConns, conn)
+	}
+	for _, l := range s.httpListeners {
+		srv := &http.Server{Handler: s.Handler()}
+		s.httpServers = append(s.httpServers, srv)
+		go func(l net.Listener) {
+			s.log.Notice("Serving HTTP on %v", l.Addr())
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				s.log.Error("Problem serving HTTP on %v (%v)", l.Addr(), err)
+			}
+		}(l)
+	}
+	for _, l := range s.tcpListeners {
+		s.listeners.Add(1)
+		go func(l *net.TCPListener) {
+			defer s.listeners.Done()
+			s.serveTCP(l)
+		}(l)
+	}
+	for _, conn := range s.conns {
+		s.listeners.Add(1)
+		go func(conn *net.UDPConn) {
+			defer s.listeners.Done()
+			s.serveUDP(conn)
+		}(conn)
+	}
+	if len(s.coapConns) > 0 {
+		s.listeners.Add(1)
+		go func() {
+			defer s.listeners.Done()
+			s.notifyCoAPObservers()
+		}()
+	}
+	for _, conn := range s.coapConns {
+		s.listeners.Add(1)
+		go func(conn *net.UDPConn) {
+			defer s.listeners.Done()
+			s.serveCoAP(conn)
+		}(conn)
+	}
+	return nil
+}
+
+// Addrs returns the addresses the server listens on: the UDP addresses
+// followed by the TCP, HTTP and CoAP addresses
+func (s *Server) Addrs() []net.Addr {
+	var addrs = make([]net.Addr, 0, len(s.conns)+len(s.tcpListeners)+len(s.httpListeners)+len(s.coapConns))
+	for _, conn := range s.conns {
+		addrs = append(addrs, conn.LocalAddr())
+	}
+	for _, l := range s.tcpListeners {
+		addrs = append(addrs, l.Addr())
+	}
+	for _, l := range s.httpListeners {
+		addrs = append(addrs, l.Addr())
+	}
+	for _, conn := range s.coapConns {
+		addrs = append(addrs, conn.LocalAddr())
+	}
+	return addrs
+}
+
+// Stop shuts the server down gracefully: it stops reading datagrams and
+// accepting connections, lets every client finish the request it is executing
+// (including HTTP requests) and send the responses it has not sent yet, and
+// closes the listeners and connections. If [ctx] is done first, Stop
+// returns its error and the server finishes shutting down in the background
+func (s *Server) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.stopListening()
+		for _, srv := range s.httpServers {
+			if srv.Shutdown(ctx) != nil {
+				srv.Close()
 			}
-			client.handleIncoming(buf[:n], nil)
 		}
+		s.listeners.Wait()
+		s.stopAllClients()
+		s.closeConns()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func main() {
-	db = NewDB("mpdb.db")
+func (s *Server) closeConns() {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	for _, l := range s.tcpListeners {
+		l.Close()
+	}
+	for _, l := range s.httpListeners {
+		l.Close()
+	}
+	for _, conn := range s.coapConns {
+		conn.Close()
+	}
+}
 
-	addr, err := net.ResolveUDPAddr("udp6", "[::]:7000")
-	if err != nil {
-		log.Error("Error resolving UDP address for msgpack %v", err)
+// returns the network to listen on for [addr]: udp4 or udp6 for IPv4 and IPv6
+// addresses, or udp for addresses without a host, which listens on both
+func listenNetwork(addr *net.UDPAddr) string {
+	switch {
+	case addr.IP == nil:
+		return "udp"
+	case addr.IP.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
+
+// the TCP counterpart of listenNetwork
+func listenNetworkTCP(addr *net.TCPAddr) string {
+	switch {
+	case addr.IP == nil:
+		return "tcp"
+	case addr.IP.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// returns the client with address [addr], creating it if this is the first
+// datagram from that address. Returns nil if the client is new and there
+// already are as many clients as the options allow
+func (s *Server) getClient(addr *net.UDPAddr, conn *net.UDPConn, opts *Options) *Client {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	if client, found := s.clients[addr.String()]; found {
+		return client
+	}
+	if opts.MaxClients > 0 && len(s.clients) >= opts.MaxClients {
+		s.log.Warning("Dropping datagram from %v: already serving %v clients", addr, len(s.clients))
+		return nil
+	}
+	s.log.Debug("creating new client")
+	client := s.newClient(addr, conn)
+	s.clients[addr.String()] = client
+	return client
+}
+
+// stops the loops of all clients, once they have sent the responses waiting
+// in their outbox
+func (s *Server) stopAllClients() {
+	s.stopClients()
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	for _, client := range s.clients {
+		<-client.done
+	}
+}
+
+// handles the datagrams arriving on [conn] until the server stops listening.
+// The connection stays open, so that clients can still send responses
+// through it
+func (s *Server) serveUDP(conn *net.UDPConn) {
+	s.log.Notice("Listening on %v", conn.LocalAddr())
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-s.listenCtx.Done():
+			// unblock the read below
+			conn.SetReadDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
+
+	for {
+		opts := s.options()
+		buf := make([]byte, opts.MaxRequestSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if s.listenCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.log.Error("Problem reading connection %v", err)
+			continue
+		}
+		if n > 0 {
+			s.log.Debug("Handling incoming from %v", addr)
+			if client := s.getClient(addr, conn, opts); client != nil {
+				client.handleIncoming(buf[:n], conn)
+			}
+		}
 	}
-	ServeUDP(addr)
 }
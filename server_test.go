@@ -0,0 +1,486 @@
+package mpdb
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenNetwork(t *testing.T) {
+	for listen, network := range map[string]string{
+		":7000":               "udp",
+		"0.0.0.0:7000":        "udp4",
+		"127.0.0.1:7000":      "udp4",
+		"[::]:7000":           "udp6",
+		"[fe80::1%lo]:7000":   "udp6",
+		"[::ffff:1.2.3.4]:70": "udp4",
+	} {
+		addr, err := net.ResolveUDPAddr("udp", listen)
+		if err != nil {
+			t.Errorf("Could not resolve %v (%v)", listen, err)
+			continue
+		}
+		if got := listenNetwork(addr); got != network {
+			t.Errorf("Expected network %v for %v, got %v", network, listen, got)
+		}
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	c := s.newClient(peer.LocalAddr().(*net.UDPAddr), conn)
+	buf := encodeMsgpack(t, map[string]interface{}{"oper": "INSERT", "nodeid": 1, "echo": 1, "data": map[string]interface{}{"shutdown": 1}})
+	c.handleIncoming(buf, conn)
+	s.stopClients()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client did not stop")
+	}
+	// requests after the client stopped are dropped instead of blocking
+	buf = encodeMsgpack(t, map[string]interface{}{"oper": "INSERT", "nodeid": 1, "echo": 2, "data": map[string]interface{}{"shutdown": 2}})
+	c.handleIncoming(buf, conn)
+
+	resp := make([]byte, 1024)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := peer.ReadFromUDP(resp)
+	if err != nil {
+		t.Fatal("Did not receive response", err)
+	}
+	if from.String() != conn.LocalAddr().String() {
+		t.Errorf("Response came from %v instead of the listener %v", from, conn.LocalAddr())
+	}
+	resp = resp[:n]
+	decoded, _, err := decode(&resp, 0)
+	if msg, ok := decoded.(map[string]interface{}); err != nil || !ok || msg["oper"] != "RESPONSE" || getUint64(msg["echo"]) != 1 {
+		t.Errorf("Unexpected response %v (%v)", decoded, err)
+	}
+}
+
+func TestEncryptedResend(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stopClients()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	c := s.newClient(peer.LocalAddr().(*net.UDPAddr), conn)
+	key := []byte("0123456789abcdef")
+	if err = db.SetNodeKey(c.nodeid, key, PolicyEncrypt); err != nil {
+		t.Fatal(err)
+	}
+	defer db.SetNodeKey(c.nodeid, nil, PolicyAuthenticate)
+	// epochs only increase, and test.db is kept between runs
+	epoch := uint32(time.Now().Unix())
+	for echo := uint64(1); echo <= 2; echo++ {
+		buf := encodeMsgpack(t, map[string]interface{}{"oper": "INSERT", "nodeid": c.nodeid, "echo": echo,
+			"data": map[string]interface{}{"encrypted.a": 1, "encrypted.b": 2, "encrypted.c": 3}})
+		sealed, err := sealEnvelope(key, envelopeEncrypt, toServer, epoch, echo, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.handleIncoming(sealed, conn)
+	}
+
+	// every response is sealed once with a counter of its own, and resent as is
+	var (
+		datagrams = make(map[uint64]string)
+		counters  = make(map[uint64]uint64)
+	)
+	for deadline := time.Now().Add(300 * time.Millisecond); time.Now().Before(deadline); {
+		resp := make([]byte, 1024)
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := peer.ReadFromUDP(resp)
+		if err != nil {
+			t.Fatal("Did not receive response", err)
+		}
+		resp = resp[:n]
+		counter := envelopeEcho(resp)
+		if first, found := datagrams[counter]; found && first != string(resp) {
+			t.Fatalf("Datagrams %x and %x share counter %v", first, resp, counter)
+		}
+		datagrams[counter] = string(resp)
+		_, _, payload, err := verifyEnvelope(key, fromServer, resp)
+		if err != nil {
+			t.Fatal("Could not open response", err)
+		}
+		decoded, _, err := decode(&payload, 0)
+		msg, ok := decoded.(map[string]interface{})
+		if err != nil || !ok || msg["oper"] != "RESPONSE" {
+			t.Fatalf("Unexpected response %v (%v)", decoded, err)
+		}
+		echo := getUint64(msg["echo"])
+		if previous, found := counters[echo]; found && previous != counter {
+			t.Errorf("Response to echo %v was sealed with counters %v and %v", echo, previous, counter)
+		}
+		counters[echo] = counter
+	}
+	if len(counters) != 2 || counters[1] == counters[2] {
+		t.Errorf("Unexpected counters of responses %v", counters)
+	}
+}
+
+func TestInvalidDatagram(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stopClients()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	c := s.newClient(peer.LocalAddr().(*net.UDPAddr), conn)
+
+	// returns the error of the first response to [echo]
+	receive := func(echo uint64) string {
+		for {
+			resp := make([]byte, 1024)
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := peer.ReadFromUDP(resp)
+			if err != nil {
+				t.Fatalf("Did not receive response to echo %v (%v)", echo, err)
+			}
+			resp = resp[:n]
+			decoded, _, err := decode(&resp, 0)
+			msg, ok := decoded.(map[string]interface{})
+			if err != nil || !ok || msg["oper"] != "RESPONSE" {
+				t.Fatalf("Unexpected response %v (%v)", decoded, err)
+			}
+			if getUint64(msg["echo"]) == echo {
+				errmsg, _ := msg["error"].(string)
+				return errmsg
+			}
+		}
+	}
+	// a value that cannot be stored fails the request, not the server
+	c.handleIncoming(encodeMsgpack(t, map[string]interface{}{"oper": "INSERT", "nodeid": c.nodeid, "echo": 1,
+		"data": map[string]interface{}{"invalid.nil": nil}}), conn)
+	if errmsg := receive(1); !strings.Contains(errmsg, "Cannot store") {
+		t.Errorf("Unexpected error %q in response to INSERT of nil", errmsg)
+	}
+	c.handleIncoming([]byte{0x90}, conn)
+	if errmsg := receive(0); !strings.Contains(errmsg, "Could not decode request") {
+		t.Errorf("Unexpected error %q in response to undecodable datagram", errmsg)
+	}
+}
+
+func TestServer(t *testing.T) {
+	if _, err := NewServer(Options{}); err == nil {
+		t.Error("Expected error creating a server without a database")
+	}
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db, Listen: []string{"127.0.0.1:0"}, ListenHTTP: []string{"127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal("Could not start server", err)
+	}
+	addrs := s.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Expected 2 listeners, got %v", addrs)
+	}
+	// without keep-alives, the client does not leave connections open that
+	// Shutdown would wait on
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	httpResp, err := client.Get("http://" + addrs[1].String() + "/collections/nonexistent")
+	if err != nil {
+		t.Fatal("Could not reach HTTP gateway", err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 from HTTP gateway, got %v", httpResp.StatusCode)
+	}
+	// open change streams do not hold up Stop
+	stream, err := client.Get("http://" + addrs[1].String() + "/changes")
+	if err != nil {
+		t.Fatal("Could not open change stream", err)
+	}
+	defer stream.Body.Close()
+	if err = s.SetOptions(Options{WindowSize: 3}); err != nil {
+		t.Error("Could not set options", err)
+	}
+	if opts := s.options(); opts.WindowSize != 3 || opts.DB != db || len(opts.Listen) != 1 {
+		t.Errorf("Unexpected options after SetOptions %+v", opts)
+	}
+
+	conn, err := net.DialUDP("udp4", nil, addrs[0].(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := encodeMsgpack(t, map[string]interface{}{"oper": "INSERT", "nodeid": 1, "echo": 1, "data": map[string]interface{}{"server": 1}})
+	if _, err = conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(resp)
+	if err != nil {
+		t.Fatal("Did not receive response", err)
+	}
+	resp = resp[:n]
+	decoded, _, err := decode(&resp, 0)
+	if msg, ok := decoded.(map[string]interface{}); err != nil || !ok || msg["oper"] != "RESPONSE" || getUint64(msg["echo"]) != 1 {
+		t.Errorf("Unexpected response %v (%v)", decoded, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Stop(ctx); err != nil {
+		t.Error("Could not stop server", err)
+	}
+}
+
+// decodes the request [msg] and executes it on behalf of [p]
+func executeTest(t *testing.T, s *Server, p *peer, msg map[string]interface{}) (map[string]interface{}, error) {
+	buf := encodeMsgpack(t, msg)
+	req, _, err := decodeRequest(&buf, 0)
+	if err != nil {
+		t.Fatal("Could not decode request", err)
+	}
+	ret, ok, err := s.execute(p, req)
+	if !ok {
+		t.Fatalf("Oper %v is not known", req.Oper)
+	}
+	return ret, err
+}
+
+func TestExecuteTxn(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &peer{ip: net.IPv4(127, 0, 0, 1)}
+	s.resolve(p)
+	db.Delete([]string{"txnreq.count"})
+
+	run := func(msg map[string]interface{}) (map[string]interface{}, error) {
+		return executeTest(t, s, p, msg)
+	}
+	ret, err := run(map[string]interface{}{"oper": "TXN", "nodeid": p.nodeid, "echo": 1, "ops": []interface{}{
+		map[string]interface{}{"oper": "INCR", "data": map[string]interface{}{"txnreq.count": 4}},
+		map[string]interface{}{"oper": uint64(OPER_CAS), "expect": map[string]interface{}{"txnreq.count": uint64(4)},
+			"data": map[string]interface{}{"txnreq.state": "four"}},
+		map[string]interface{}{"oper": "PERSIST", "data": map[string]interface{}{"txnreq": 1}},
+		map[string]interface{}{"oper": "GET", "keys": []interface{}{"txnreq.state"}},
+	}})
+	results, _ := ret["results"].([]interface{})
+	if err != nil || len(results) != 4 || results[1] != nil {
+		t.Fatalf("Unexpected TXN result %v (%v)", ret, err)
+	}
+	if get, _ := results[3].(map[string]interface{}); get["txnreq.state"] != "four" {
+		t.Errorf("Unexpected GET result %v", results[3])
+	}
+	if ret, err = run(map[string]interface{}{"oper": "INCR", "nodeid": p.nodeid, "echo": 2,
+		"data": map[string]interface{}{"txnreq.count": -1}}); err != nil || ret["txnreq.count"] != int64(3) {
+		t.Errorf("Unexpected INCR result %v (%v)", ret, err)
+	}
+
+	// PERSIST needs the nodeid of the sender, like the PERSIST oper
+	_, err = run(map[string]interface{}{"oper": "TXN", "nodeid": p.nodeid + 1, "echo": 3, "ops": []interface{}{
+		map[string]interface{}{"oper": "PERSIST", "data": map[string]interface{}{"txnreq": 2}},
+	}})
+	if err == nil {
+		t.Error("Expected error persisting for another node")
+	}
+}
+
+func TestExecuteWriter(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &peer{ip: net.IPv4(127, 0, 0, 1)}
+	s.resolve(p)
+	writer := strconv.FormatUint(p.nodeid, 10)
+
+	// the nodeid a request claims does not change the recorded writer
+	claimed := p.nodeid + 1
+	for echo, msg := range []map[string]interface{}{
+		{"oper": "INSERT", "data": map[string]interface{}{"writer.a": 1}},
+		{"oper": "TXN", "ops": []interface{}{map[string]interface{}{"oper": "INSERT", "data": map[string]interface{}{"writer.b": 2}}}},
+	} {
+		msg["nodeid"], msg["echo"] = claimed, echo+1
+		if _, err = executeTest(t, s, p, msg); err != nil {
+			t.Fatalf("Could not execute %v (%v)", msg, err)
+		}
+	}
+	entries, err := db.GetWithMeta([]string{"writer.a", "writer.b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, entry := range entries {
+		if entry == nil || entry.Writer != writer {
+			t.Errorf("Key %v was recorded as written by %+v instead of %v", key, entry, writer)
+		}
+	}
+	revision, err := db.Revision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = executeTest(t, s, p, map[string]interface{}{"oper": "DELETE", "nodeid": claimed, "echo": 3,
+		"keys": []interface{}{"writer.a"}}); err != nil {
+		t.Fatal("Could not delete", err)
+	}
+	if sets, err := db.ChangesSince(revision, 1); err != nil || len(sets) != 1 || sets[0].Writer != writer {
+		t.Errorf("Deletion was not recorded as written by %v: %+v (%v)", writer, sets, err)
+	}
+}
+
+func TestExecuteFind(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &peer{ip: net.IPv4(127, 0, 0, 1)}
+	s.resolve(p)
+	if err = db.Insert(map[string]interface{}{"alarms.door": int64(1), "alarms.fire": int64(0), "alarms.smoke": int64(2)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = executeTest(t, s, p, map[string]interface{}{"oper": "SETINDEX", "nodeid": 1, "echo": 1,
+		"collection": "alarms", "fields": []interface{}{""}}); err != nil {
+		t.Fatal("Could not set index", err)
+	}
+	ret, err := executeTest(t, s, p, map[string]interface{}{"oper": "FIND", "nodeid": 1, "echo": 2,
+		"collection": "alarms", "min": 1})
+	if err != nil || len(ret) != 2 || ret["alarms.door"] != int64(1) || ret["alarms.smoke"] != int64(2) {
+		t.Errorf("Unexpected FIND result %v (%v)", ret, err)
+	}
+	ret, err = executeTest(t, s, p, map[string]interface{}{"oper": "FIND", "nodeid": 1, "echo": 3,
+		"collection": "alarms", "value": uint64(0)})
+	if err != nil || len(ret) != 1 || ret["alarms.fire"] != int64(0) {
+		t.Errorf("Unexpected FIND result %v (%v)", ret, err)
+	}
+}
+
+func TestExecuteGetBucketFiltered(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &peer{ip: net.IPv4(127, 0, 0, 1)}
+	s.resolve(p)
+	if err = db.Insert(map[string]interface{}{"meters.a": uint64(5), "meters.b": uint64(12), "meters.c": "off", "meters.d": uint64(40)}); err != nil {
+		t.Fatal(err)
+	}
+	run := func(echo int, where map[string]interface{}, project string) (map[string]interface{}, error) {
+		msg := map[string]interface{}{"oper": "GETBUCKET", "nodeid": 1, "echo": echo, "collection": "meters", "project": project}
+		if where != nil {
+			msg["where"] = where
+		}
+		return executeTest(t, s, p, msg)
+	}
+	ret, err := run(1, map[string]interface{}{"type": "uint64", "gt": 10}, "")
+	if err != nil || len(ret) != 2 || ret["meters.b"] != uint64(12) || ret["meters.d"] != uint64(40) {
+		t.Errorf("Unexpected GETBUCKET result %v (%v)", ret, err)
+	}
+	ret, err = run(2, map[string]interface{}{"ne": uint64(12)}, "keys")
+	if keys, _ := ret["keys"].([]interface{}); err != nil || len(keys) != 3 || keys[0] != "meters.a" || keys[1] != "meters.c" || keys[2] != "meters.d" {
+		t.Errorf("Unexpected GETBUCKET keys %v (%v)", ret, err)
+	}
+	ret, err = run(3, map[string]interface{}{"glob": "[ab]"}, "values")
+	if values, _ := ret["values"].([]interface{}); err != nil || len(values) != 2 || values[0] != uint64(5) || values[1] != uint64(12) {
+		t.Errorf("Unexpected GETBUCKET values %v (%v)", ret, err)
+	}
+	if ret, err = run(4, nil, "count"); err != nil || ret["count"] != uint64(4) {
+		t.Errorf("Unexpected GETBUCKET count %v (%v)", ret, err)
+	}
+	if _, err = run(5, nil, "sum"); err == nil {
+		t.Error("Expected error for an unknown projection")
+	}
+}
+
+func TestExecuteRegister(t *testing.T) {
+	// registrations cannot be undone, so use a fresh database
+	os.Remove("register_test.db")
+	db := NewDB("register_test.db")
+	defer os.Remove("register_test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const eui64 = 0x0211223344556677
+	victim := &peer{ip: net.ParseIP("2001:db8::11:2233:4455:6677")}
+	attacker := &peer{ip: net.ParseIP("2001:db8:2::9")}
+	admin := &peer{ip: net.ParseIP("2001:db8:2::1")}
+	for _, p := range []*peer{victim, attacker, admin} {
+		s.resolve(p)
+	}
+	if err = db.SetACL(DefaultACL, []ACLEntry{{0, math.MaxUint64, RightRead | RightWrite}, {admin.nodeid, admin.nodeid, RightAdmin}}); err != nil {
+		t.Fatal(err)
+	}
+	register := func(p *peer, eui64 uint64) (map[string]interface{}, error) {
+		return executeTest(t, s, p, map[string]interface{}{"oper": "REGISTER", "nodeid": p.nodeid, "echo": 1, "eui64": eui64})
+	}
+
+	if _, err = register(attacker, eui64); err == nil {
+		t.Error("Expected error registering an EUI-64 the address was not autoconfigured from")
+	}
+	if ret, err := register(victim, eui64); err != nil || ret["nodeid"] != victim.nodeid {
+		t.Errorf("Unexpected REGISTER result %v (%v)", ret, err)
+	}
+	moved := &peer{ip: net.ParseIP("2001:db8:1::11:2233:4455:6677")}
+	if s.resolve(moved); moved.nodeid != victim.nodeid {
+		t.Errorf("Node %v resolved to nodeid %v instead of %v", moved.ip, moved.nodeid, victim.nodeid)
+	}
+	if _, err = register(admin, eui64); err == nil {
+		t.Error("Expected error registering the EUI-64 of another node")
+	}
+	if _, err = register(admin, 0x02000000000000aa); err != nil {
+		t.Error("Could not register EUI-64 as administrator", err)
+	}
+}
@@ -0,0 +1,172 @@
+package mpdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Over TCP, requests and responses are carried in frames: a 4-byte
+// little-endian length followed by that many bytes holding a single message,
+// in compact or plain mode. The stream is already reliable and ordered, so
+// there is no echo tag window: requests are executed in the order they
+// arrive, and the echo tag of each response tells the client which request it
+// answers. Clients can send many requests without waiting for their
+// responses, which are written back in batches
+const frameHeader = 4
+
+// reads the next frame from [r] and returns its payload. Frames longer than
+// [maxSize] are rejected
+func readFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	var header [frameHeader]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[:])
+	if length == 0 {
+		return nil, fmt.Errorf("Empty frame")
+	}
+	if int64(length) > int64(maxSize) {
+		return nil, fmt.Errorf("Frame of %v bytes is longer than the maximum of %v", length, maxSize)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// returns true if a whole frame is waiting in [r], so that it can be read
+// without blocking
+func frameBuffered(r *bufio.Reader) bool {
+	n := r.Buffered()
+	if n < frameHeader {
+		return false
+	}
+	header, _ := r.Peek(frameHeader)
+	return n-frameHeader >= int(binary.LittleEndian.Uint32(header))
+}
+
+// appends [msg] to [output] as a frame, in compact mode if [compact] is set
+func encodeFrame(output *[]byte, msg map[string]interface{}, compact bool) error {
+	start := len(*output)
+	*output = append(*output, 0, 0, 0, 0)
+	if err := encodeMessage(output, msg, compact); err != nil {
+		*output = (*output)[:start]
+		return err
+	}
+	binary.LittleEndian.PutUint32((*output)[start:], uint32(len(*output)-start-frameHeader))
+	return nil
+}
+
+// accepts connections on [l] until the server stops listening
+func (s *Server) serveTCP(l *net.TCPListener) {
+	s.log.Notice("Listening on %v/tcp", l.Addr())
+	go func() {
+		<-s.listenCtx.Done()
+		// unblock the accept below
+		l.Close()
+	}()
+	for {
+		conn, err := l.AcceptTCP()
+		if s.listenCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.log.Error("Problem accepting connection %v", err)
+			continue
+		}
+		s.log.Debug("Accepted connection from %v", conn.RemoteAddr())
+		s.listeners.Add(1)
+		go func() {
+			defer s.listeners.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// handles the frames arriving on [conn] until the client closes it or the
+// server stops listening. Responses are buffered while more requests are
+// waiting, and flushed before blocking on the next read. When the server
+// stops, the responses to the requests already read are still sent
+func (s *Server) serveConn(conn *net.TCPConn) {
+	defer conn.Close()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-s.listenCtx.Done():
+			// unblock the read below
+			conn.SetReadDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
+
+	var (
+		p = &peer{ip: conn.RemoteAddr().(*net.TCPAddr).IP}
+		r = bufio.NewReader(conn)
+		w = bufio.NewWriter(conn)
+	)
+	defer w.Flush()
+	for {
+		frame, err := readFrame(r, s.options().MaxFrameSize)
+		if err != nil {
+			if err != io.EOF && s.listenCtx.Err() == nil {
+				s.log.Warning("Closing connection from %v (%v)", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if err = s.handleFrame(p, frame, w); err != nil {
+			s.log.Warning("Closing connection from %v (%v)", conn.RemoteAddr(), err)
+			return
+		}
+		if !frameBuffered(r) {
+			if err = w.Flush(); err != nil {
+				s.log.Error("Error writing to client %v (%v)", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// executes the request in [frame] on behalf of [p] and writes the response to
+// [w]. Returns an error if the frame cannot be decoded or the response cannot
+// be written, in which case the connection is closed
+func (s *Server) handleFrame(p *peer, frame []byte, w io.Writer) error {
+	req, consumed, err := decodeRequest(&frame, 0)
+	if err != nil {
+		return err
+	}
+	if consumed != len(frame) {
+		return fmt.Errorf("Frames can only carry a single request")
+	}
+	compact := isCompact(&frame, 0)
+
+	s.resolve(p)
+	var (
+		ret map[string]interface{}
+		nk  *nodeKey
+	)
+	// TCP carries no envelopes, so nodes with a key have to use UDP
+	if nk, err = s.db.getNodeKey(p.nodeid); err == nil && nk != nil {
+		err = fmt.Errorf("Node %v requires authenticated requests, which are only supported over UDP", p.nodeid)
+	} else if err == nil {
+		s.log.Debug("COMMIT oper %v echo %v", req.Oper, req.Echo)
+		ret, _, err = s.execute(p, req)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err = encodeFrame(buf, response(req.Nodeid, req.Echo, ret, err), compact); err != nil {
+		// e.g. because the response is too long for compact mode
+		s.log.Error("Could not encode response to %v (%v)", p.ip, err)
+		if err = encodeFrame(buf, response(req.Nodeid, req.Echo, nil, err), compact); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(*buf)
+	return err
+}
@@ -0,0 +1,134 @@
+package mpdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// returns [msg] encoded as a frame
+func frame(t testing.TB, msg map[string]interface{}, compact bool) []byte {
+	var buf []byte
+	if err := encodeFrame(&buf, msg, compact); err != nil {
+		t.Fatal("Could not encode frame", err)
+	}
+	return buf
+}
+
+func TestReadFrame(t *testing.T) {
+	buf := frame(t, map[string]interface{}{"oper": "GET", "nodeid": 1, "echo": 1}, false)
+	buf = append(buf, frame(t, map[string]interface{}{"oper": "GET", "nodeid": uint64(1), "echo": uint64(2)}, true)...)
+	r := bufio.NewReader(bytes.NewReader(buf))
+	for echo := uint64(1); echo <= 2; echo++ {
+		payload, err := readFrame(r, 64)
+		if err != nil {
+			t.Fatal("Could not read frame", err)
+		}
+		req, consumed, err := decodeRequest(&payload, 0)
+		if err != nil || consumed != len(payload) || req.Echo != echo {
+			t.Errorf("Unexpected request %+v in frame %v (%v)", req, echo, err)
+		}
+	}
+
+	var long = make([]byte, frameHeader)
+	binary.LittleEndian.PutUint32(long, 65)
+	long = append(long, make([]byte, 65)...)
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(long)), 64); err == nil {
+		t.Error("Expected error reading a frame longer than the maximum")
+	}
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 0})), 64); err == nil {
+		t.Error("Expected error reading an empty frame")
+	}
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(buf[:5])), 64); err == nil {
+		t.Error("Expected error reading a truncated frame")
+	}
+}
+
+func TestServeTCP(t *testing.T) {
+	db := NewDB("test.db")
+	defer db.Close()
+	s, err := NewServer(Options{DB: db, Listen: []string{"127.0.0.1:0"}, ListenTCP: []string{"127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal("Could not start server", err)
+	}
+	addrs := s.Addrs()
+	if len(addrs) != 2 || addrs[1].Network() != "tcp" {
+		t.Fatalf("Expected a UDP and a TCP listener, got %v", addrs)
+	}
+	conn, err := net.Dial("tcp", addrs[1].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// pipeline all requests in a single write. Echo tags need not be
+	// consecutive
+	var reqs []byte
+	reqs = append(reqs, frame(t, map[string]interface{}{"oper": "INSERT", "nodeid": 1, "echo": 7, "data": map[string]interface{}{"tcp.a": 1, "tcp.b": "two"}}, false)...)
+	reqs = append(reqs, frame(t, map[string]interface{}{"oper": "GETBUCKET", "nodeid": 1, "echo": 3, "collection": "tcp"}, false)...)
+	reqs = append(reqs, frame(t, map[string]interface{}{"oper": "GET", "nodeid": uint64(1), "echo": uint64(100), "keys": []interface{}{"tcp.b"}}, true)...)
+	if _, err = conn.Write(reqs); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	var responses []map[string]interface{}
+	for len(responses) < 3 {
+		payload, err := readFrame(r, 1<<20)
+		if err != nil {
+			t.Fatal("Did not receive response", err)
+		}
+		if isCompact(&payload, 0) {
+			h, err := ParseHeader(&payload, 0)
+			if err != nil || h.Type != OPER_RESPONSE || h.Echo != 100 {
+				t.Fatalf("Unexpected compact response %+v (%v)", h, err)
+			}
+			payload = payload[headerLength:]
+			body, _, err := decode(&payload, 0)
+			if err != nil {
+				t.Fatal("Could not decode compact response", err)
+			}
+			msg, _ := body.(map[string]interface{})
+			msg["echo"] = uint64(h.Echo)
+			responses = append(responses, msg)
+			continue
+		}
+		decoded, _, err := decode(&payload, 0)
+		msg, ok := decoded.(map[string]interface{})
+		if err != nil || !ok {
+			t.Fatalf("Unexpected response %v (%v)", decoded, err)
+		}
+		responses = append(responses, msg)
+	}
+	for idx, echo := range []uint64{7, 3, 100} {
+		if resp := responses[idx]; getUint64(resp["echo"]) != echo || resp["error"] != nil {
+			t.Errorf("Unexpected response %v to echo %v", resp, echo)
+		}
+	}
+	if result, _ := responses[1]["result"].(map[string]interface{}); len(result) != 2 || result["tcp.b"] != "two" {
+		t.Errorf("Unexpected GETBUCKET result %v", responses[1]["result"])
+	}
+	if result, _ := responses[2]["result"].(map[string]interface{}); result["tcp.b"] != "two" {
+		t.Errorf("Unexpected GET result %v", responses[2]["result"])
+	}
+
+	// a frame that is not a request closes the connection
+	conn.Write(frame(t, map[string]interface{}{"echo": 1}, false))
+	if _, err = readFrame(r, 1<<20); err == nil {
+		t.Error("Expected connection to be closed after an invalid request")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Stop(ctx); err != nil {
+		t.Error("Could not stop server", err)
+	}
+}
@@ -0,0 +1,264 @@
+package mpdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// A TxnOp is one of the operations of a transaction (see Txn). Keys are full
+// keys, prefixed with their collection in the same way as for Insert
+type TxnOp struct {
+	// one of GET, INSERT, PERSIST, DELETE, CAS and INCR
+	Oper string
+	// the keys to read (GET) or delete (DELETE)
+	Keys []string
+	// the values to store (INSERT, PERSIST and CAS), or the amounts to add to
+	// the integers stored under each key (INCR)
+	Data map[string]interface{}
+	// the values the keys must hold for a CAS to store its data. A nil value
+	// means that the key must not have a value
+	Expect map[string]interface{}
+}
+
+// Txn runs [ops] in order within a single write transaction, as one commit by
+// [nodeid]: either all of them take effect or, if any of them fails, none
+// do. Later operations see the writes of earlier ones. PERSIST writes to the
+// persist bucket of [nodeid]. A CAS fails unless every key of its Expect holds
+// the expected value, in which case it stores its Data like INSERT. INCR adds
+// to integers, keeping their type, and treats keys without a value as 0.
+//
+// Returns one result per operation: the values of the keys for GET, the new
+// values for INCR, and nil for the others. A transaction that only reads
+// does not make a commit
+func (db *DB) Txn(nodeid string, ops []TxnOp) ([]map[string]interface{}, error) {
+	for idx, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid operation %v (%s)", idx, err)
+		}
+	}
+	var results = make([]map[string]interface{}, len(ops))
+	err := db.update(nodeid, func(cm *commit) error {
+		for idx, op := range ops {
+			var err error
+			if results[idx], err = db.runTxnOp(cm, op); err != nil {
+				return fmt.Errorf("Operation %v (%s) failed (%s)", idx, op.Oper, err)
+			}
+		}
+		if len(cm.changes) == 0 {
+			// roll back the revision allocated for the commit
+			return errReadOnlyTxn
+		}
+		return nil
+	})
+	if err == errReadOnlyTxn {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// returned within Txn to roll back transactions that did not write anything
+var errReadOnlyTxn = errors.New("Read-only transaction")
+
+// checks that [op] is known and only holds values MPDB can store
+func (op TxnOp) validate() error {
+	switch op.Oper {
+	case "GET", "DELETE":
+		return nil
+	case "INSERT", "PERSIST", "CAS":
+		for k, v := range op.Data {
+			if !storableValue(v) {
+				return fmt.Errorf("Cannot store value %v of type %T under key %s", v, v, k)
+			}
+		}
+		for k, v := range op.Expect {
+			if v != nil && !storableValue(v) {
+				return fmt.Errorf("Cannot compare with value %v of type %T for key %s", v, v, k)
+			}
+		}
+		return nil
+	case "INCR":
+		for k, v := range op.Data {
+			if _, ok := integerValue(v); !ok {
+				return fmt.Errorf("Cannot increment key %s by %v of type %T", k, v, v)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown operation %s", op.Oper)
+}
+
+// runs [op] as part of commit [cm] and returns its result
+func (db *DB) runTxnOp(cm *commit, op TxnOp) (map[string]interface{}, error) {
+	switch op.Oper {
+	case "GET":
+		var result = make(map[string]interface{}, len(op.Keys))
+		for _, k := range op.Keys {
+			bucketname, key := splitKey(k)
+			value, err := db.getInCommit(cm, bucketname, key)
+			if err != nil {
+				return nil, err
+			}
+			result[joinKey(bucketname, key)] = value
+		}
+		return result, nil
+	case "PERSIST":
+		return nil, db.putPersist(cm, cm.writer, op.Data)
+	case "DELETE":
+		for _, k := range op.Keys {
+			bucketname, key := splitKey(k)
+			if err := db.remove(cm, bucketname, key); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case "CAS":
+		for k, expected := range op.Expect {
+			bucketname, key := splitKey(k)
+			value, err := db.getInCommit(cm, bucketname, key)
+			if err != nil {
+				return nil, err
+			}
+			if cmp, ok := compareValues(value, expected); (value != nil || expected != nil) && (!ok || cmp != 0) {
+				return nil, fmt.Errorf("Key %s holds %v, expected %v", k, value, expected)
+			}
+		}
+		fallthrough
+	case "INSERT":
+		for k, v := range op.Data {
+			bucketname, key := splitKey(k)
+			if err := db.put(cm, bucketname, key, v); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case "INCR":
+		var result = make(map[string]interface{}, len(op.Data))
+		for k, delta := range op.Data {
+			bucketname, key := splitKey(k)
+			value, err := db.getInCommit(cm, bucketname, key)
+			if err != nil {
+				return nil, err
+			}
+			if value, err = addInteger(value, delta); err != nil {
+				return nil, fmt.Errorf("Could not increment key %s (%s)", k, err)
+			}
+			if err = db.put(cm, bucketname, key, value); err != nil {
+				return nil, err
+			}
+			result[joinKey(bucketname, key)] = value
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("Unknown operation %s", op.Oper)
+}
+
+// returns the value of [key] in bucket [bucketname] as seen by commit [cm],
+// or nil if it has none. Unlike getBucket, it does not create the bucket
+func (db *DB) getInCommit(cm *commit, bucketname, key string) (interface{}, error) {
+	b := cm.tx.Bucket([]byte(bucketname))
+	if b == nil {
+		return nil, nil
+	}
+	v := b.Get([]byte(key))
+	if v == nil {
+		return nil, nil
+	}
+	return db.decodeInterface(v)
+}
+
+// returns true if [value] has one of the types a Record holds
+func storableValue(value interface{}) bool {
+	switch value.(type) {
+	case uint64, int64, int, uint, string:
+		return true
+	}
+	return false
+}
+
+// returns [value] as a big.Int if it is one of the integer types a Record
+// holds
+func integerValue(value interface{}) (*big.Int, bool) {
+	switch value := value.(type) {
+	case uint64:
+		return new(big.Int).SetUint64(value), true
+	case uint:
+		return new(big.Int).SetUint64(uint64(value)), true
+	case int64:
+		return big.NewInt(value), true
+	case int:
+		return big.NewInt(int64(value)), true
+	}
+	return nil, false
+}
+
+// compares two stored values: integers of any type by value, and strings
+// lexicographically. [ok] is false if the values cannot be compared, e.g. an
+// integer and a string
+func compareValues(a, b interface{}) (cmp int, ok bool) {
+	if x, ok := integerValue(a); ok {
+		if y, ok := integerValue(b); ok {
+			return x.Cmp(y), true
+		}
+		return 0, false
+	}
+	x, ok := a.(string)
+	y, ok2 := b.(string)
+	if !ok || !ok2 {
+		return 0, false
+	}
+	switch {
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+// adds the integer [delta] to the integer [value], keeping the type of
+// [value]. A nil [value] counts as 0 of the type of [delta], with int and uint
+// deltas giving an int64 and uint64 respectively. Fails if the sum does not
+// fit in the type
+func addInteger(value, delta interface{}) (interface{}, error) {
+	d, ok := integerValue(delta)
+	if !ok {
+		return nil, fmt.Errorf("%v is not an integer", delta)
+	}
+	if value == nil {
+		switch delta.(type) {
+		case uint64, uint:
+			value = uint64(0)
+		default:
+			value = int64(0)
+		}
+	}
+	v, ok := integerValue(value)
+	if !ok {
+		return nil, fmt.Errorf("%v is not an integer", value)
+	}
+	sum := v.Add(v, d)
+	switch value.(type) {
+	case uint64:
+		if sum.Sign() >= 0 && sum.IsUint64() {
+			return sum.Uint64(), nil
+		}
+	case uint:
+		if sum.Sign() >= 0 && sum.IsUint64() && sum.Uint64() <= math.MaxUint {
+			return uint(sum.Uint64()), nil
+		}
+	case int64:
+		if sum.IsInt64() {
+			return sum.Int64(), nil
+		}
+	case int:
+		if sum.IsInt64() && sum.Int64() >= math.MinInt && sum.Int64() <= math.MaxInt {
+			return int(sum.Int64()), nil
+		}
+	}
+	return nil, fmt.Errorf("%v does not fit in a %T", sum, value)
+}